@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+const freezeUsage = `usage:
+  pve-oci-operator [flags] freeze [reason]
+  pve-oci-operator [flags] unfreeze`
+
+// runFreezeCommand freezes or unfreezes every service. While frozen the
+// operator keeps reporting drift but changes no container.
+func runFreezeCommand(args []string, store state.FreezeStore) error {
+	switch {
+	case args[0] == "freeze":
+		freeze := state.Freeze{Reason: strings.Join(args[1:], " "), Time: time.Now().UTC()}
+		if err := store.SaveFreeze(freeze); err != nil {
+			return err
+		}
+		fmt.Println("rollouts frozen until unfreeze")
+		return nil
+	case args[0] == "unfreeze" && len(args) == 1:
+		current, ok, err := store.LoadFreeze()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Println("rollouts are not frozen")
+			return nil
+		}
+		if err := store.RemoveFreeze(); err != nil {
+			return err
+		}
+		fmt.Printf("unfroze rollouts frozen since %s\n", current.Time.Local().Format(time.DateTime))
+		return nil
+	default:
+		return fmt.Errorf("%s", freezeUsage)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+const historyUsage = `usage:
+  pve-oci-operator [flags] history <service>
+  pve-oci-operator [flags] rollback <service> <revision>
+  pve-oci-operator [flags] unpin <service>`
+
+// runHistoryCommand handles the history, rollback and unpin subcommands.
+// Rollback only sets the pin; the running operator rolls the service back on
+// its next reconcile.
+func runHistoryCommand(args []string, store state.HistoryStore, servicesDir string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("%s", historyUsage)
+	}
+	switch {
+	case args[0] == "history" && len(args) == 2:
+		history, err := store.LoadHistory(args[1])
+		if err != nil {
+			return err
+		}
+		printHistory(history)
+		return nil
+	case args[0] == "rollback" && len(args) == 3:
+		id, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid revision %q", args[2])
+		}
+		svc, err := findService(servicesDir, args[1])
+		if err != nil {
+			return err
+		}
+		var rev state.Revision
+		err = store.UpdateHistory(args[1], func(history *state.History) error {
+			rev, err = history.PinRevision(id, svc.Hash())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("pinned %s to revision %d (%s) until its spec changes or it is unpinned\n", args[1], rev.ID, rev.Digest)
+		return nil
+	case args[0] == "unpin" && len(args) == 2:
+		pinned := false
+		err := store.UpdateHistory(args[1], func(history *state.History) error {
+			pinned = history.Pin != nil
+			history.Pin = nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !pinned {
+			fmt.Printf("%s is not pinned\n", args[1])
+			return nil
+		}
+		fmt.Printf("unpinned %s\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("%s", historyUsage)
+	}
+}
+
+func findService(dir, name string) (spec.ServiceSpec, error) {
+	services, skipped, err := spec.LoadServiceSpecs(dir)
+	if err != nil {
+		return spec.ServiceSpec{}, err
+	}
+	for _, svc := range services {
+		if svc.Metadata.Name == name {
+			return svc, nil
+		}
+	}
+	for _, f := range skipped {
+		fmt.Fprintf(os.Stderr, "skipping %v\n", f)
+	}
+	return spec.ServiceSpec{}, fmt.Errorf("no service %q in %s", name, dir)
+}
+
+func printHistory(history state.History) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tTIME\tDIGEST\tTAG\tSPEC\tOUTCOME\tTRIGGER")
+	for _, rev := range history.Revisions {
+		outcome := rev.Outcome
+		if rev.Attempts > 1 {
+			outcome = fmt.Sprintf("%s (%d attempts)", outcome, rev.Attempts)
+		}
+		mark := ""
+		if history.Pin != nil && history.Pin.Revision == rev.ID {
+			mark = " (pinned)"
+		}
+		fmt.Fprintf(w, "%d%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rev.ID, mark, rev.Time.Local().Format(time.DateTime), rev.Digest, rev.Tag, rev.SpecHash, outcome, rev.Trigger)
+	}
+	w.Flush()
+}
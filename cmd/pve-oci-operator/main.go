@@ -2,25 +2,37 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/haasonsaas/pve-oci-operator/internal/analysis"
 	"github.com/haasonsaas/pve-oci-operator/internal/config"
 	"github.com/haasonsaas/pve-oci-operator/internal/health"
+	"github.com/haasonsaas/pve-oci-operator/internal/importer"
 	"github.com/haasonsaas/pve-oci-operator/internal/pve"
 	"github.com/haasonsaas/pve-oci-operator/internal/reconciler"
 	"github.com/haasonsaas/pve-oci-operator/internal/registry"
 	"github.com/haasonsaas/pve-oci-operator/internal/runner"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
 	"github.com/haasonsaas/pve-oci-operator/internal/state"
 )
 
 func main() {
 	var configPath string
+	var templateReport, planOnly bool
+	var output string
 	flag.StringVar(&configPath, "config", "config.yaml", "path to operator config")
+	flag.BoolVar(&templateReport, "template-report", false, "print which converted templates a prune would delete and exit")
+	flag.BoolVar(&planOnly, "plan", false, "print what a reconcile of every service would do and exit")
+	flag.StringVar(&output, "output", "text", "format for -plan: text or json")
 	flag.Parse()
 
 	cfg, err := config.Load(configPath)
@@ -36,16 +48,104 @@ func main() {
 	if err != nil {
 		log.Fatalf("init state store: %v", err)
 	}
-	pveClient := pve.NewCLIClient(cfg.PVE.PctPath, store, cfg.PVE.DryRun)
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "orphans":
+			err = runOrphansCommand(args[1:], store)
+		case "freeze", "unfreeze":
+			err = runFreezeCommand(args, store)
+		default:
+			err = runHistoryCommand(args, store, cfg.Runner.ServicesPath)
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", args[0], err)
+		}
+		return
+	}
+	var pveClient pve.Client
+	switch cfg.PVE.Mode {
+	case "api":
+		httpClient := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.PVE.APIInsecure},
+		}}
+		pveClient = pve.NewAPIClient(cfg.PVE.APIURL, cfg.PVE.APITokenID, cfg.PVE.APIToken, httpClient, store).WithTaskTimeout(cfg.PVE.TaskTimeout).WithStorage(cfg.PVE.StorageFor)
+	default:
+		pveClient = pve.NewCLIClient(cfg.PVE.PctPath, store).WithTaskTimeout(cfg.PVE.TaskTimeout).WithStorage(cfg.PVE.StorageFor).WithVzdumpPath(cfg.PVE.VzdumpPath)
+	}
+	pveClient = pve.NewNodeLimiter(pveClient, cfg.Runner.MaxNodeOperations)
 	registryClient := registry.NewOCIClient(cfg.Registry.Username, cfg.Registry.Password)
 	healthChecker := health.NewHTTPChecker()
-	rec := &reconciler.Reconciler{Registry: registryClient, PVE: pveClient, Health: healthChecker, Logger: logger}
-	run := &runner.Runner{Reconciler: rec, ServicesDir: cfg.Runner.ServicesPath, Interval: cfg.Runner.Interval, Logger: logger}
+	templates := importer.NewOCIImporter(cfg.Registry.Username, cfg.Registry.Password, cfg.PVE.StorageFor, cfg.Templates.Dirs)
+	templateCache := &importer.Cache{
+		Store:          store,
+		Dirs:           cfg.Templates.Dirs,
+		KeepPerService: cfg.Templates.GC.KeepPerService,
+		MinAge:         cfg.Templates.GC.MinAge,
+		Logger:         logger,
+	}
+	if templateReport {
+		report, err := templateCache.Prune(true)
+		if err != nil {
+			log.Fatalf("template report: %v", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("template report: %v", err)
+		}
+		return
+	}
+	rec := &reconciler.Reconciler{Registry: registryClient, PVE: pveClient, Health: healthChecker, Templates: templates, Analyzer: analysis.NewHTTPAnalyzer(), Store: store, History: store, Freeze: store, Frozen: cfg.Runner.Freeze, Blackouts: cfg.Blackouts, Logger: logger}
+	run := &runner.Runner{Reconciler: rec, ServicesDir: cfg.Runner.ServicesPath, Interval: cfg.Runner.Interval, Debounce: cfg.Runner.Debounce, Workers: cfg.Runner.Workers, DryRun: cfg.PVE.DryRun, DependencyTimeout: cfg.Runner.DependencyTimeout, MaxBackoff: cfg.Runner.MaxBackoff, Logger: logger}
+	run.Orphans = reconciler.OrphanPolicy{Action: cfg.Orphans.Policy, GracePeriod: cfg.Orphans.GracePeriod, AutoConfirm: cfg.Orphans.AutoConfirm}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if planOnly {
+		if err := printPlans(ctx, rec, cfg.Runner.ServicesPath, output); err != nil {
+			log.Fatalf("plan: %v", err)
+		}
+		return
+	}
+
+	if cfg.Templates.GC.Interval > 0 {
+		go templateCache.Run(ctx, cfg.Templates.GC.Interval, cfg.Templates.GC.DryRun)
+	}
+
 	if err := run.Start(ctx); err != nil && err != context.Canceled {
 		logger.Error("runner stopped", "error", err)
 	}
 }
+
+func printPlans(ctx context.Context, rec *reconciler.Reconciler, servicesDir, output string) error {
+	services, skipped, err := spec.LoadServiceSpecs(servicesDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range skipped {
+		fmt.Fprintf(os.Stderr, "skipping %v\n", f)
+	}
+	plans := make([]reconciler.Plan, 0, len(services))
+	for _, svc := range services {
+		plan, err := rec.Plan(ctx, svc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", svc.Metadata.Name, err)
+		}
+		plans = append(plans, plan)
+	}
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	case "text":
+		for _, plan := range plans {
+			fmt.Print(plan)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", output)
+	}
+}
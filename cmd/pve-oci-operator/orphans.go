@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+const orphansUsage = `usage:
+  pve-oci-operator [flags] orphans
+  pve-oci-operator [flags] orphans confirm <ctid>`
+
+// runOrphansCommand lists orphaned containers or confirms that one may be
+// destroyed. The running operator destroys a confirmed orphan on its next
+// reconcile once the grace period is over.
+func runOrphansCommand(args []string, store state.Store) error {
+	switch {
+	case len(args) == 0:
+		entries, err := store.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CTID\tSERVICE\tNODE\tORPHANED\tCONFIRMED")
+		for _, entry := range entries {
+			if entry.OrphanedAt.IsZero() {
+				continue
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\n", entry.CTID, entry.Service, entry.Node, entry.OrphanedAt.Local().Format(time.DateTime), entry.DestroyConfirmed)
+		}
+		return w.Flush()
+	case len(args) == 2 && args[0] == "confirm":
+		ctid, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid ctid %q", args[1])
+		}
+		var service string
+		err = store.Update(ctid, func(entry *state.Entry, found bool) error {
+			if !found || entry.OrphanedAt.IsZero() {
+				return fmt.Errorf("ct %d is not an orphan", ctid)
+			}
+			entry.DestroyConfirmed = true
+			service = entry.Service
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("confirmed destroying ct %d (%s)\n", ctid, service)
+		return nil
+	default:
+		return fmt.Errorf("%s", orphansUsage)
+	}
+}
@@ -5,6 +5,7 @@ go 1.24
 toolchain go1.24.10
 
 require (
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/google/go-containerregistry v0.20.6
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,270 @@
+package analysis
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+const defaultInterval = 30 * time.Second
+
+// Analyzer decides whether canaries are fit to continue a rollout.
+type Analyzer interface {
+	// Analyze watches canaries for bake and returns an error when the
+	// analysis configured for their service fails. Without canaries it only
+	// waits out bake.
+	Analyze(ctx context.Context, canaries []spec.ServiceSpec, bake time.Duration) error
+}
+
+type HTTPAnalyzer struct {
+	client *http.Client
+}
+
+func NewHTTPAnalyzer() *HTTPAnalyzer {
+	return &HTTPAnalyzer{client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Analyze samples every canary each interval until bake has passed, taking
+// at least one round of samples. Without canaries or an analysis URL it only
+// waits.
+func (a *HTTPAnalyzer) Analyze(ctx context.Context, canaries []spec.ServiceSpec, bake time.Duration) error {
+	if len(canaries) == 0 {
+		return sleep(ctx, bake)
+	}
+	cfg := canaries[0].Spec.Rollout.Canary.Analysis
+	if cfg.URL == "" {
+		return sleep(ctx, bake)
+	}
+	interval := defaultInterval
+	if cfg.IntervalSeconds > 0 {
+		interval = time.Duration(cfg.IntervalSeconds) * time.Second
+	}
+	deadline := time.Now().Add(bake)
+	failures := 0
+	for {
+		for _, canary := range canaries {
+			value, err := a.Sample(ctx, cfg, canary)
+			if err == nil {
+				err = check(cfg, value)
+			}
+			if err != nil {
+				failures++
+				if failures > cfg.FailureLimit {
+					return fmt.Errorf("analysis of ct %d failed: %w", canary.Spec.CTID, err)
+				}
+			}
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		if err := sleep(ctx, min(interval, remaining)); err != nil {
+			return err
+		}
+	}
+}
+
+// Sample fetches the analysis metric for one canary.
+func (a *HTTPAnalyzer) Sample(ctx context.Context, cfg spec.AnalysisSpec, canary spec.ServiceSpec) (float64, error) {
+	endpoint := canary.Substitute(cfg.URL)
+	if cfg.Query != "" {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/api/v1/query?query=" + url.QueryEscape(canary.Substitute(cfg.Query))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	if cfg.Query != "" {
+		return queryValue(resp.Body)
+	}
+	return metricValue(resp.Body, canary.Substitute(cfg.Metric))
+}
+
+func check(cfg spec.AnalysisSpec, value float64) error {
+	if cfg.Max != nil && value > *cfg.Max {
+		return fmt.Errorf("value %g above max %g", value, *cfg.Max)
+	}
+	if cfg.Min != nil && value < *cfg.Min {
+		return fmt.Errorf("value %g below min %g", value, *cfg.Min)
+	}
+	return nil
+}
+
+// queryValue reads the first sample of a Prometheus instant query response.
+func queryValue(r io.Reader) (float64, error) {
+	var resp struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return 0, fmt.Errorf("decode query response: %w", err)
+	}
+	if resp.Status != "success" {
+		return 0, fmt.Errorf("query failed: %s", resp.Error)
+	}
+	var sample []any
+	switch resp.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(resp.Data.Result, &sample); err != nil {
+			return 0, fmt.Errorf("decode scalar: %w", err)
+		}
+	case "vector":
+		var vector []struct {
+			Value []any `json:"value"`
+		}
+		if err := json.Unmarshal(resp.Data.Result, &vector); err != nil {
+			return 0, fmt.Errorf("decode vector: %w", err)
+		}
+		if len(vector) == 0 {
+			return 0, fmt.Errorf("query returned no samples")
+		}
+		sample = vector[0].Value
+	default:
+		return 0, fmt.Errorf("unsupported result type %q", resp.Data.ResultType)
+	}
+	if len(sample) != 2 {
+		return 0, fmt.Errorf("malformed sample %v", sample)
+	}
+	text, _ := sample[1].(string)
+	return strconv.ParseFloat(text, 64)
+}
+
+// metricValue sums the samples in Prometheus text format that match
+// selector, a metric name optionally followed by {label="value",...}.
+func metricValue(r io.Reader, selector string) (float64, error) {
+	name, want := parseSeries(selector)
+	var sum float64
+	found := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, ok := cutValue(line)
+		if !ok {
+			continue
+		}
+		seriesName, labels := parseSeries(series)
+		if seriesName != name || !matches(labels, want) {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse %s: %w", series, err)
+		}
+		sum += v
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("metric %s not found", selector)
+	}
+	return sum, nil
+}
+
+// cutValue splits a sample line into the series and its value, dropping an
+// optional timestamp.
+func cutValue(line string) (string, string, bool) {
+	series, rest, _ := strings.Cut(line, " ")
+	if end := strings.LastIndex(line, "}"); end >= 0 {
+		series, rest = line[:end+1], line[end+1:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", "", false
+	}
+	return series, fields[0], true
+}
+
+func parseSeries(series string) (string, map[string]string) {
+	name, rest, ok := strings.Cut(series, "{")
+	labels := map[string]string{}
+	if !ok {
+		return strings.TrimSpace(name), labels
+	}
+	rest = strings.TrimSuffix(strings.TrimSpace(rest), "}")
+	for _, pair := range splitLabels(rest) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(strings.TrimSpace(value)); err == nil {
+			value = unquoted
+		}
+		labels[strings.TrimSpace(key)] = value
+	}
+	return strings.TrimSpace(name), labels
+}
+
+// splitLabels splits a label list on the commas outside quoted values.
+func splitLabels(s string) []string {
+	var parts []string
+	var b strings.Builder
+	quoted, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			parts = append(parts, b.String())
+			b.Reset()
+			continue
+		}
+		b.WriteRune(r)
+	}
+	if strings.TrimSpace(b.String()) != "" {
+		parts = append(parts, b.String())
+	}
+	return parts
+}
+
+func matches(labels, want map[string]string) bool {
+	for key, value := range want {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,94 @@
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+const exposition = `# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200",path="/a,b"} 990
+http_requests_total{code="500",path="/a,b"} 7 1700000000000
+http_requests_total{code="500",path="/c"} 3
+up 1
+`
+
+func TestMetricValue(t *testing.T) {
+	cases := map[string]float64{
+		`http_requests_total`:              1000,
+		`http_requests_total{code="500"}`:  10,
+		`http_requests_total{path="/a,b"}`: 997,
+		`up`:                               1,
+	}
+	for selector, want := range cases {
+		got, err := metricValue(strings.NewReader(exposition), selector)
+		if err != nil || got != want {
+			t.Errorf("%s = %v, %v; want %v", selector, got, err, want)
+		}
+	}
+	if _, err := metricValue(strings.NewReader(exposition), `missing`); err == nil {
+		t.Errorf("expected error for missing metric")
+	}
+}
+
+func TestQueryValue(t *testing.T) {
+	vector := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1700000000,"0.02"]}]}}`
+	if got, err := queryValue(strings.NewReader(vector)); err != nil || got != 0.02 {
+		t.Fatalf("vector = %v, %v", got, err)
+	}
+	empty := `{"status":"success","data":{"resultType":"vector","result":[]}}`
+	if _, err := queryValue(strings.NewReader(empty)); err == nil {
+		t.Fatalf("expected error for empty result")
+	}
+}
+
+func TestAnalyzeFailsAboveThreshold(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"0.2"]}}`)
+	}))
+	defer srv.Close()
+
+	limit := 0.05
+	canary := spec.ServiceSpec{}
+	canary.Spec.CTID = 161
+	canary.Spec.Network.IP = "192.168.4.161/24"
+	canary.Spec.Rollout.Canary.Analysis = spec.AnalysisSpec{
+		URL:          srv.URL,
+		Query:        `job:errors:ratio{instance="{{ip}}"}`,
+		Max:          &limit,
+		FailureLimit: 1,
+	}
+	canary.Spec.Rollout.Canary.Analysis.IntervalSeconds = 1
+	analyzer := NewHTTPAnalyzer()
+	err := analyzer.Analyze(context.Background(), []spec.ServiceSpec{canary}, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "above max") {
+		t.Fatalf("expected threshold failure, got %v", err)
+	}
+	if len(queries) != 2 || queries[0] != `job:errors:ratio{instance="192.168.4.161"}` {
+		t.Fatalf("unexpected queries %q", queries)
+	}
+
+	limit = 0.5
+	if err := analyzer.Analyze(context.Background(), []spec.ServiceSpec{canary}, 0); err != nil {
+		t.Fatalf("expected analysis to pass, got %v", err)
+	}
+}
+
+func TestAnalyzeWithoutCanariesWaitsOutBake(t *testing.T) {
+	start := time.Now()
+	if err := NewHTTPAnalyzer().Analyze(context.Background(), nil, 50*time.Millisecond); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("analysis without canaries skipped the bake")
+	}
+}
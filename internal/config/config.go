@@ -1,11 +1,14 @@
 package config
 
 import (
+	"cmp"
 	"fmt"
 	"time"
 
 	"gopkg.in/yaml.v3"
 	"os"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
 )
 
 type RegistryConfig struct {
@@ -17,23 +20,116 @@ type RegistryConfig struct {
 type PVEConfig struct {
 	Mode       string `yaml:"mode"`
 	PctPath    string `yaml:"pctPath"`
+	VzdumpPath string `yaml:"vzdumpPath"`
 	Node       string `yaml:"node"`
 	StatePath  string `yaml:"statePath"`
+	// DryRun only logs plans and never applies them.
 	DryRun     bool   `yaml:"dryRun"`
 	APIToken   string `yaml:"apiToken"`
 	APIURL     string `yaml:"apiUrl"`
 	APITokenID string `yaml:"apiTokenId"`
+	// APIInsecure skips TLS verification for the self-signed certificate a
+	// stock Proxmox install ships with.
+	APIInsecure bool `yaml:"apiInsecure"`
+	// TaskTimeout bounds how long a single create/start/stop/destroy may run
+	// before the operator gives up waiting for it.
+	TaskTimeout time.Duration `yaml:"taskTimeout"`
+	// Storage is the cluster-wide default; Nodes can override it per node.
+	Storage StorageConfig         `yaml:"storage"`
+	Nodes   map[string]NodeConfig `yaml:"nodes"`
+}
+
+// StorageConfig names the Proxmox storages used when a spec does not pick
+// one: Rootfs holds container root disks and Template holds vztmpl archives.
+type StorageConfig struct {
+	Rootfs   string `yaml:"rootfs"`
+	Template string `yaml:"template"`
+}
+
+// StorageResolver returns the storage defaults for a node.
+type StorageResolver func(node string) StorageConfig
+
+type NodeConfig struct {
+	Storage StorageConfig `yaml:"storage"`
+}
+
+// StorageFor returns the storage defaults for node, falling back to the
+// cluster-wide settings for anything the node does not override.
+func (p PVEConfig) StorageFor(node string) StorageConfig {
+	storage := p.Storage
+	if override, ok := p.Nodes[node]; ok {
+		if override.Storage.Rootfs != "" {
+			storage.Rootfs = override.Storage.Rootfs
+		}
+		if override.Storage.Template != "" {
+			storage.Template = override.Storage.Template
+		}
+	}
+	return storage
 }
 
 type RunnerConfig struct {
 	ServicesPath string        `yaml:"servicesPath"`
 	Interval     time.Duration `yaml:"interval"`
+	// Debounce is how long spec files must stay untouched after an edit
+	// before the changed services are reconciled. It defaults to 1s.
+	Debounce time.Duration `yaml:"debounce"`
+	// DependencyTimeout bounds how long a rollout waits for the health
+	// checks of the services it depends on. It defaults to 2m.
+	DependencyTimeout time.Duration `yaml:"dependencyTimeout"`
+	// Freeze stops the operator from changing any container while drift is
+	// still reported, like the freeze command does until unfreeze.
+	Freeze bool `yaml:"freeze"`
+	// MaxBackoff caps the retry delay of a failing service. It defaults to
+	// 30m.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// Workers is how many services are reconciled at once and
+	// MaxNodeOperations how many container operations run on one node at a
+	// time. They default to 4 and 2.
+	Workers           int `yaml:"workers"`
+	MaxNodeOperations int `yaml:"maxNodeOperations"`
+}
+
+// TemplatesConfig controls where converted OCI images are written. Dirs maps
+// a template storage id to the local directory backing its vztmpl content.
+// Shared says those storages are shared (NFS, CephFS, ...), so a template
+// the operator writes is seen by every node; api mode requires it, because
+// the operator does not run on the nodes.
+type TemplatesConfig struct {
+	Dirs   map[string]string `yaml:"dirs"`
+	Shared bool              `yaml:"shared"`
+	GC     TemplateGCConfig  `yaml:"gc"`
+}
+
+// TemplateGCConfig controls pruning of converted templates. Interval 0
+// disables the periodic prune.
+type TemplateGCConfig struct {
+	Interval       time.Duration `yaml:"interval"`
+	KeepPerService int           `yaml:"keepPerService"`
+	MinAge         time.Duration `yaml:"minAge"`
+	DryRun         bool          `yaml:"dryRun"`
+}
+
+// OrphansConfig decides what happens to managed containers whose spec was
+// removed: keep (default), stop or destroy once they have been orphaned for
+// GracePeriod, which defaults to 1h so that a spec file briefly missing
+// during a rename or checkout costs nothing. Destroying waits for each
+// container to be confirmed unless AutoConfirm is set.
+type OrphansConfig struct {
+	Policy      string        `yaml:"policy"`
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+	AutoConfirm bool          `yaml:"autoConfirm"`
 }
 
 type Config struct {
-	Registry RegistryConfig `yaml:"registry"`
-	PVE      PVEConfig      `yaml:"pve"`
-	Runner   RunnerConfig   `yaml:"runner"`
+	Registry  RegistryConfig  `yaml:"registry"`
+	PVE       PVEConfig       `yaml:"pve"`
+	Runner    RunnerConfig    `yaml:"runner"`
+	Templates TemplatesConfig `yaml:"templates"`
+	Orphans   OrphansConfig   `yaml:"orphans"`
+	// Blackouts are periods in which no update or rollout starts, whatever
+	// the services' rollout windows allow.
+	Blackouts []spec.Blackout `yaml:"blackouts"`
 }
 
 func Load(path string) (Config, error) {
@@ -48,13 +144,47 @@ func Load(path string) (Config, error) {
 	return cfg, cfg.Validate()
 }
 
-func (c Config) Validate() error {
+func (c *Config) Validate() error {
 	if c.Runner.ServicesPath == "" {
 		return fmt.Errorf("runner.servicesPath is required")
 	}
 	if c.Runner.Interval == 0 {
 		c.Runner.Interval = 10 * time.Second
 	}
+	if c.Runner.DependencyTimeout == 0 {
+		c.Runner.DependencyTimeout = 2 * time.Minute
+	}
+	if c.Runner.Debounce == 0 {
+		c.Runner.Debounce = time.Second
+	}
+	if c.Runner.MaxBackoff == 0 {
+		c.Runner.MaxBackoff = 30 * time.Minute
+	}
+	if c.Runner.Workers < 0 || c.Runner.MaxNodeOperations < 0 {
+		return fmt.Errorf("runner.workers and runner.maxNodeOperations must be >= 0")
+	}
+	if c.Runner.Workers == 0 {
+		c.Runner.Workers = 4
+	}
+	if c.Runner.MaxNodeOperations == 0 {
+		c.Runner.MaxNodeOperations = 2
+	}
+	for i, b := range c.Blackouts {
+		if b.Start.IsZero() || !b.End.After(b.Start) {
+			return fmt.Errorf("blackouts[%d]: end must be after start", i)
+		}
+	}
+	switch c.Orphans.Policy {
+	case "", "keep", "stop", "destroy":
+	default:
+		return fmt.Errorf("orphans.policy must be keep, stop or destroy")
+	}
+	if c.Orphans.GracePeriod < 0 {
+		return fmt.Errorf("orphans.gracePeriod must be >= 0")
+	}
+	if c.Orphans.GracePeriod == 0 {
+		c.Orphans.GracePeriod = time.Hour
+	}
 	switch c.PVE.Mode {
 	case "cli", "api", "":
 		if c.PVE.Mode == "" {
@@ -66,5 +196,40 @@ func (c Config) Validate() error {
 	if c.PVE.Mode == "cli" && c.PVE.PctPath == "" {
 		c.PVE.PctPath = "pct"
 	}
+	if c.PVE.Mode == "cli" && c.PVE.VzdumpPath == "" {
+		c.PVE.VzdumpPath = "vzdump"
+	}
+	if c.PVE.Mode == "api" {
+		if c.PVE.APIURL == "" {
+			return fmt.Errorf("pve.apiUrl is required in api mode")
+		}
+		if c.PVE.APITokenID == "" || c.PVE.APIToken == "" {
+			return fmt.Errorf("pve.apiTokenId and pve.apiToken are required in api mode")
+		}
+		if err := c.validateSharedTemplates(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSharedTemplates checks that in api mode every node writes its
+// templates to shared storage the operator host has mounted.
+func (c *Config) validateSharedTemplates() error {
+	if !c.Templates.Shared {
+		return fmt.Errorf("api mode needs shared template storage: set templates.shared once every templates.dirs entry is shared storage mounted on the operator host")
+	}
+	storages := []string{c.PVE.Storage.Template}
+	for node := range c.PVE.Nodes {
+		storages = append(storages, c.PVE.StorageFor(node).Template)
+	}
+	for _, storage := range storages {
+		if storage == "" || storage == "local" {
+			return fmt.Errorf("api mode needs shared template storage: set pve.storage.template and its node overrides to a shared storage instead of %q", cmp.Or(storage, "local"))
+		}
+		if c.Templates.Dirs[storage] == "" {
+			return fmt.Errorf("templates.dirs has no directory for template storage %q", storage)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,225 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+const (
+	defaultKeepPerService = 3
+	defaultMinAge         = time.Hour
+)
+
+// Cache garbage-collects converted templates. A template survives while a
+// live container was created from it, or while it is among the KeepPerService
+// most recent templates of a service (so rollbacks stay cheap). Templates
+// younger than MinAge are never removed, which protects imports whose
+// container has not been recorded yet. A cached image config goes with the
+// last template of its digest.
+type Cache struct {
+	Store          state.Store
+	Dirs           map[string]string
+	KeepPerService int
+	MinAge         time.Duration
+	Logger         *slog.Logger
+}
+
+// PruneReport lists what a prune removed, or would remove when DryRun is set.
+type PruneReport struct {
+	DryRun     bool     `json:"dryRun"`
+	Kept       []string `json:"kept"`
+	Deleted    []string `json:"deleted"`
+	FreedBytes int64    `json:"freedBytes"`
+}
+
+// Prune deletes unreferenced templates from every configured template
+// directory. With dryRun it only reports what would be deleted.
+func (c *Cache) Prune(dryRun bool) (PruneReport, error) {
+	report := PruneReport{DryRun: dryRun}
+	keep, err := c.referenced()
+	if err != nil {
+		return report, err
+	}
+	minAge := c.MinAge
+	if minAge <= 0 {
+		minAge = defaultMinAge
+	}
+	for _, dir := range c.dirs() {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return report, fmt.Errorf("read template dir: %w", err)
+		}
+		// Cached image configs go once no template of their digest is
+		// left.
+		var configs []os.DirEntry
+		remaining := map[string]bool{}
+		for _, file := range files {
+			name := file.Name()
+			if !file.IsDir() && isImageConfig(name) {
+				configs = append(configs, file)
+				continue
+			}
+			leftover := strings.HasPrefix(name, ".import-") && strings.HasSuffix(name, ".tmp")
+			if file.IsDir() || !(leftover || isTemplate(name)) {
+				continue
+			}
+			full := filepath.Join(dir, name)
+			if keep[name] {
+				report.Kept = append(report.Kept, full)
+				remaining[name] = true
+				continue
+			}
+			deleted, err := pruneFile(&report, dir, file, minAge, dryRun)
+			if err != nil {
+				return report, err
+			}
+			remaining[name] = !deleted
+		}
+		for _, file := range configs {
+			prefix := strings.TrimSuffix(file.Name(), ".json") + "-"
+			used := false
+			for name, ok := range remaining {
+				used = used || ok && strings.HasPrefix(name, prefix)
+			}
+			if used {
+				report.Kept = append(report.Kept, filepath.Join(dir, file.Name()))
+				continue
+			}
+			if _, err := pruneFile(&report, dir, file, minAge, dryRun); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// pruneFile removes file from dir unless it is younger than minAge,
+// recording the outcome in report, and reports whether it was removed.
+func pruneFile(report *PruneReport, dir string, file os.DirEntry, minAge time.Duration, dryRun bool) (bool, error) {
+	full := filepath.Join(dir, file.Name())
+	info, err := file.Info()
+	if err != nil {
+		return false, fmt.Errorf("stat template: %w", err)
+	}
+	if time.Since(info.ModTime()) < minAge {
+		report.Kept = append(report.Kept, full)
+		return false, nil
+	}
+	if !dryRun {
+		if err := os.Remove(full); err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("remove template: %w", err)
+		}
+	}
+	report.Deleted = append(report.Deleted, full)
+	report.FreedBytes += info.Size()
+	return true, nil
+}
+
+// Run prunes every interval until ctx is done, logging each report.
+func (c *Cache) Run(ctx context.Context, interval time.Duration, dryRun bool) {
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := c.Prune(dryRun)
+		if err != nil {
+			c.Logger.Error("template gc failed", "error", err)
+			continue
+		}
+		c.Logger.Info("template gc", "dryRun", dryRun, "kept", len(report.Kept), "deleted", report.Deleted, "freedBytes", report.FreedBytes)
+	}
+}
+
+// referenced returns the template file names that must be kept.
+func (c *Cache) referenced() (map[string]bool, error) {
+	entries, err := c.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	limit := c.KeepPerService
+	if limit <= 0 {
+		limit = defaultKeepPerService
+	}
+	byService := map[string][]state.Entry{}
+	for _, entry := range entries {
+		key := entry.Service
+		if key == "" {
+			key = fmt.Sprintf("ct-%d", entry.CTID)
+		}
+		byService[key] = append(byService[key], entry)
+	}
+	keep := map[string]bool{}
+	for _, group := range byService {
+		sort.Slice(group, func(i, j int) bool { return group[i].Update.After(group[j].Update) })
+		kept := 0
+		for _, entry := range group {
+			if name := templateFile(entry.Template); name != "" && !keep[name] {
+				keep[name] = true
+				kept++
+			}
+		}
+		for _, entry := range group {
+			for _, previous := range entry.PreviousTemplates {
+				if kept >= limit {
+					break
+				}
+				if name := templateFile(previous); name != "" && !keep[name] {
+					keep[name] = true
+					kept++
+				}
+			}
+		}
+	}
+	return keep, nil
+}
+
+func (c *Cache) dirs() []string {
+	seen := map[string]bool{}
+	var dirs []string
+	for _, dir := range c.Dirs {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	if _, ok := c.Dirs[defaultTemplateStorage]; !ok && !seen[DefaultTemplateDir] {
+		dirs = append(dirs, DefaultTemplateDir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// templateFile extracts the file name from a storage:vztmpl/file volid.
+func templateFile(volid string) string {
+	if volid == "" {
+		return ""
+	}
+	return path.Base(volid)
+}
+
+func isTemplate(name string) bool {
+	return strings.HasPrefix(name, "oci-") && strings.HasSuffix(name, ".tar.gz")
+}
+
+func isImageConfig(name string) bool {
+	return strings.HasPrefix(name, "oci-") && strings.HasSuffix(name, ".json")
+}
@@ -0,0 +1,103 @@
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+func TestCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	entry := state.Entry{CTID: 160, Service: "composer"}
+	for _, tmpl := range []string{"oci-a.tar.gz", "oci-b.tar.gz", "oci-c.tar.gz", "oci-d.tar.gz"} {
+		entry.SetTemplate("local:vztmpl/" + tmpl)
+	}
+	if err := store.Save(entry); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"oci-a.tar.gz", "oci-b.tar.gz", "oci-c.tar.gz", "oci-d.tar.gz", "oci-orphan.tar.gz", ".import-1.tmp", "debian-12.tar.zst"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "oci-fresh.tar.gz"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cache := &Cache{Store: store, Dirs: map[string]string{"local": dir}, KeepPerService: 2}
+	report, err := cache.Prune(true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	want := map[string]bool{
+		filepath.Join(dir, ".import-1.tmp"):     true,
+		filepath.Join(dir, "oci-a.tar.gz"):      true,
+		filepath.Join(dir, "oci-b.tar.gz"):      true,
+		filepath.Join(dir, "oci-orphan.tar.gz"): true,
+	}
+	if len(report.Deleted) != len(want) {
+		t.Fatalf("unexpected deletions %v", report.Deleted)
+	}
+	for _, path := range report.Deleted {
+		if !want[path] {
+			t.Fatalf("unexpected deletion %s", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("dry run removed %s", path)
+		}
+	}
+
+	if _, err := cache.Prune(false); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	for _, name := range []string{"oci-c.tar.gz", "oci-d.tar.gz", "oci-fresh.tar.gz", "debian-12.tar.zst"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected %s to be kept: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "oci-a.tar.gz")); !os.IsNotExist(err) {
+		t.Fatalf("expected oci-a.tar.gz to be pruned")
+	}
+}
+
+func TestCachePrunesImageConfigsWithTheirTemplates(t *testing.T) {
+	dir := t.TempDir()
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if err := store.Save(state.Entry{CTID: 160, Service: "composer", Template: "local:vztmpl/oci-sha256-aa-1.tar.gz"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"oci-sha256-aa-1.tar.gz", "oci-sha256-aa.json", "oci-sha256-bb-1.tar.gz", "oci-sha256-bb.json"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	cache := &Cache{Store: store, Dirs: map[string]string{"local": dir}}
+	if _, err := cache.Prune(false); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	for name, kept := range map[string]bool{"oci-sha256-aa-1.tar.gz": true, "oci-sha256-aa.json": true, "oci-sha256-bb-1.tar.gz": false, "oci-sha256-bb.json": false} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Fatalf("%s: kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+}
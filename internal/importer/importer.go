@@ -0,0 +1,207 @@
+package importer
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/config"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// DefaultTemplateDir is where the stock "local" storage keeps vztmpl archives.
+const DefaultTemplateDir = "/var/lib/vz/template/cache"
+
+const defaultTemplateStorage = "local"
+
+// Importer turns an OCI image digest into an LXC template that pct create can
+// consume and returns the template's volume id.
+type Importer interface {
+	Import(ctx context.Context, svc spec.ServiceSpec, digest string) (string, error)
+}
+
+// OCIImporter pulls images from a registry, flattens their layers into a
+// rootfs tarball with a generated init and writes it into a vztmpl storage
+// directory. Templates are keyed by digest and init, so an image is only
+// converted once per storage and set of overrides, and the image config is
+// cached beside them so reusing a template needs no registry.
+type OCIImporter struct {
+	auth    authn.Authenticator
+	storage config.StorageResolver
+	dirs    map[string]string
+}
+
+// NewOCIImporter builds an importer. dirs maps a template storage id to the
+// local directory backing its vztmpl content; "local" defaults to
+// DefaultTemplateDir.
+func NewOCIImporter(username, password string, storage config.StorageResolver, dirs map[string]string) *OCIImporter {
+	var auth authn.Authenticator = authn.Anonymous
+	if username != "" || password != "" {
+		auth = &authn.Basic{Username: username, Password: password}
+	}
+	return &OCIImporter{auth: auth, storage: storage, dirs: dirs}
+}
+
+func (i *OCIImporter) Import(ctx context.Context, svc spec.ServiceSpec, digest string) (string, error) {
+	storage, dir, err := i.templateStorage(svc.Spec.Node)
+	if err != nil {
+		return "", err
+	}
+	refStr := fmt.Sprintf("%s@%s", svc.Spec.Image, digest)
+	ref, err := name.ParseReference(refStr)
+	if err != nil {
+		return "", fmt.Errorf("parse reference %s: %w", refStr, err)
+	}
+	var img v1.Image
+	pull := func() error {
+		if img != nil {
+			return nil
+		}
+		img, err = remote.Image(ref, remote.WithContext(ctx), remote.WithAuth(i.auth))
+		if err != nil {
+			return fmt.Errorf("pull %s: %w", refStr, err)
+		}
+		return nil
+	}
+	// The init depends on the image config, which is cached next to the
+	// templates so that a template that already exists is found without
+	// asking the registry.
+	configPath := filepath.Join(dir, configName(digest))
+	imageConfig, err := readImageConfig(configPath)
+	if err != nil {
+		if err := pull(); err != nil {
+			return "", err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return "", fmt.Errorf("read config of %s: %w", refStr, err)
+		}
+		imageConfig = cfg.Config
+		if err := writeImageConfig(configPath, imageConfig); err != nil {
+			return "", fmt.Errorf("cache config of %s: %w", refStr, err)
+		}
+	}
+	boot, err := BuildInit(imageConfig, svc)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", refStr, err)
+	}
+	file := TemplateName(digest, boot.Hash())
+	volid := fmt.Sprintf("%s:vztmpl/%s", storage, file)
+	path := filepath.Join(dir, file)
+	if _, err := os.Stat(path); err == nil {
+		return volid, nil
+	}
+	if err := pull(); err != nil {
+		return "", err
+	}
+	err = writeTemplate(path, func(w io.Writer) error {
+		// mutate.Extract applies the layers in order and honours whiteout
+		// and opaque-directory markers, leaving a single flattened
+		// filesystem.
+		rootfs := mutate.Extract(img)
+		defer rootfs.Close()
+		return injectInit(w, rootfs, boot)
+	})
+	if err != nil {
+		return "", fmt.Errorf("write template for %s: %w", refStr, err)
+	}
+	return volid, nil
+}
+
+// TemplateName is the vztmpl file name for an image digest combined with the
+// hash of the init generated for it.
+func TemplateName(digest, initHash string) string {
+	algo, hex, ok := strings.Cut(digest, ":")
+	if !ok {
+		algo, hex = "sha256", digest
+	}
+	return fmt.Sprintf("oci-%s-%s-%s.tar.gz", algo, hex, initHash)
+}
+
+// configName is the file caching the image config of digest.
+func configName(digest string) string {
+	return strings.TrimSuffix(TemplateName(digest, ""), "-.tar.gz") + ".json"
+}
+
+func readImageConfig(path string) (v1.Config, error) {
+	var cfg v1.Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, json.Unmarshal(data, &cfg)
+}
+
+func writeImageConfig(path string, cfg v1.Config) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (i *OCIImporter) templateStorage(node string) (string, string, error) {
+	storage := defaultTemplateStorage
+	if i.storage != nil {
+		if configured := i.storage(node).Template; configured != "" {
+			storage = configured
+		}
+	}
+	dir := i.dirs[storage]
+	if dir == "" && storage == defaultTemplateStorage {
+		dir = DefaultTemplateDir
+	}
+	if dir == "" {
+		return "", "", fmt.Errorf("no template directory configured for storage %q", storage)
+	}
+	return storage, dir, nil
+}
+
+// writeTemplate gzips the tar stream produced by write into path.
+func writeTemplate(path string, write func(io.Writer) error) error {
+	return writeFile(path, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		if err := write(gz); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+// writeFile writes path via a temporary file so a crashed import never
+// leaves a truncated file behind.
+func writeFile(path string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".import-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,167 @@
+package importer
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/config"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// pushImage stores img in an in-memory registry and returns the repository
+// and digest to import.
+func pushImage(t *testing.T, img v1.Image) (string, string) {
+	t.Helper()
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	repo := strings.TrimPrefix(srv.URL, "http://") + "/haasonsaas/composer"
+	ref, err := name.ParseReference(repo + ":main")
+	if err != nil {
+		t.Fatalf("parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("push image: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("digest: %v", err)
+	}
+	return repo, digest.String()
+}
+
+func layeredImage(t *testing.T, cfg v1.Config, layers ...map[string][]byte) v1.Image {
+	t.Helper()
+	img, err := mutate.Config(empty.Image, cfg)
+	if err != nil {
+		t.Fatalf("set config: %v", err)
+	}
+	for _, files := range layers {
+		layer, err := crane.Layer(files)
+		if err != nil {
+			t.Fatalf("build layer: %v", err)
+		}
+		img, err = mutate.AppendLayers(img, layer)
+		if err != nil {
+			t.Fatalf("append layer: %v", err)
+		}
+	}
+	return img
+}
+
+func readTemplate(t *testing.T, path string) map[string]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open template: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gunzip template: %v", err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("read template: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(data)
+	}
+}
+
+func TestImportFlattensLayers(t *testing.T) {
+	img := layeredImage(t, v1.Config{Entrypoint: []string{"/usr/bin/app"}},
+		map[string][]byte{"bin/sh": nil, "etc/app.conf": []byte("v1"), "tmp/stale": []byte("x"), "usr/bin/app": []byte("bin")},
+		map[string][]byte{"etc/app.conf": []byte("v2"), "tmp/.wh.stale": nil},
+	)
+	repo, digest := pushImage(t, img)
+	dir := t.TempDir()
+	storage := func(string) config.StorageConfig { return config.StorageConfig{Template: "shared"} }
+	imp := NewOCIImporter("", "", storage, map[string]string{"shared": dir})
+
+	svc := spec.ServiceSpec{}
+	svc.Spec.Node = "node1"
+	svc.Spec.Image = repo
+	volid, err := imp.Import(context.Background(), svc, digest)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	file := strings.TrimPrefix(volid, "shared:vztmpl/")
+	if file == volid || !strings.HasPrefix(file, "oci-"+strings.ReplaceAll(digest, ":", "-")) {
+		t.Fatalf("unexpected volid %q", volid)
+	}
+	files := readTemplate(t, filepath.Join(dir, file))
+	if files["etc/app.conf"] != "v2" {
+		t.Fatalf("expected upper layer to win, got %q", files["etc/app.conf"])
+	}
+	if _, ok := files["tmp/stale"]; ok {
+		t.Fatalf("whiteout was not applied")
+	}
+	if _, ok := files["usr/bin/app"]; !ok {
+		t.Fatalf("lower layer file missing")
+	}
+	if !strings.Contains(files["sbin/init"], "set -- '/usr/bin/app'") {
+		t.Fatalf("generated init missing, got %q", files["sbin/init"])
+	}
+
+	// Re-importing reuses the template; changing an override produces a
+	// new one.
+	again, err := imp.Import(context.Background(), svc, digest)
+	if err != nil || again != volid {
+		t.Fatalf("re-import = %q, %v; want %q", again, err, volid)
+	}
+	svc.Spec.Env = map[string]string{"MODE": "prod"}
+	changed, err := imp.Import(context.Background(), svc, digest)
+	if err != nil || changed == volid {
+		t.Fatalf("expected a new template for changed env, got %q, %v", changed, err)
+	}
+
+	// A cached import must reuse the template without talking to the
+	// registry again.
+	svc.Spec.Image = "invalid.example/unreachable"
+	if cached, err := imp.Import(context.Background(), svc, digest); err != nil || cached != changed {
+		t.Fatalf("cached import = %q, %v; want %q", cached, err, changed)
+	}
+}
+
+func TestImportRequiresShell(t *testing.T) {
+	img := layeredImage(t, v1.Config{Entrypoint: []string{"/app"}}, map[string][]byte{"app": []byte("bin")})
+	repo, digest := pushImage(t, img)
+	imp := NewOCIImporter("", "", nil, map[string]string{"local": t.TempDir()})
+	svc := spec.ServiceSpec{}
+	svc.Spec.Image = repo
+	if _, err := imp.Import(context.Background(), svc, digest); err == nil || !strings.Contains(err.Error(), "/bin/sh") {
+		t.Fatalf("expected missing shell error, got %v", err)
+	}
+}
+
+func TestImportRequiresTemplateDir(t *testing.T) {
+	storage := func(string) config.StorageConfig { return config.StorageConfig{Template: "nfs"} }
+	imp := NewOCIImporter("", "", storage, nil)
+	svc := spec.ServiceSpec{}
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	if _, err := imp.Import(context.Background(), svc, "sha256:abc"); err == nil {
+		t.Fatalf("expected error for storage without directory")
+	}
+}
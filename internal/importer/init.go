@@ -0,0 +1,225 @@
+package importer
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+const (
+	initPath = "sbin/init"
+	envPath  = "etc/pve-oci/environment"
+)
+
+// InitSpec is the process the generated /sbin/init execs once the container
+// boots, derived from the image config and the service's overrides.
+type InitSpec struct {
+	Command    []string
+	Env        []string
+	WorkingDir string
+	User       string
+}
+
+// BuildInit merges the image config with the spec the way Kubernetes does:
+// spec.command replaces the Entrypoint (and drops the image Cmd), spec.args
+// replaces Cmd, and spec.env entries override image variables by name.
+func BuildInit(cfg v1.Config, svc spec.ServiceSpec) (InitSpec, error) {
+	entrypoint, args := cfg.Entrypoint, cfg.Cmd
+	if len(svc.Spec.Command) > 0 {
+		entrypoint, args = svc.Spec.Command, nil
+	}
+	if len(svc.Spec.Args) > 0 {
+		args = svc.Spec.Args
+	}
+	command := append(slices.Clone(entrypoint), args...)
+	if len(command) == 0 {
+		return InitSpec{}, fmt.Errorf("image defines no entrypoint or cmd and spec.command is empty")
+	}
+	boot := InitSpec{Command: command, WorkingDir: cfg.WorkingDir, User: cfg.User}
+	if svc.Spec.WorkingDir != "" {
+		boot.WorkingDir = svc.Spec.WorkingDir
+	}
+	overrides := make([]string, 0, len(svc.Spec.Env))
+	for key := range svc.Spec.Env {
+		overrides = append(overrides, key)
+	}
+	sort.Strings(overrides)
+	for _, kv := range cfg.Env {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, ok := svc.Spec.Env[key]; !ok {
+			boot.Env = append(boot.Env, kv)
+		}
+	}
+	for _, key := range overrides {
+		boot.Env = append(boot.Env, key+"="+svc.Spec.Env[key])
+	}
+	return boot, nil
+}
+
+// Hash identifies the init so templates built with different overrides do
+// not collide.
+func (s InitSpec) Hash() string {
+	h := sha256.New()
+	for _, part := range [][]string{s.Command, s.Env, {s.WorkingDir, s.User}} {
+		for _, value := range part {
+			fmt.Fprintf(h, "%q,", value)
+		}
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// Script renders the POSIX shell init that loads the environment, changes
+// into the working directory, drops privileges and execs the command.
+func (s InitSpec) Script() string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("# Generated by pve-oci-operator from the image config; do not edit.\n")
+	b.WriteString("set -a\n. /" + envPath + "\nset +a\n")
+	if s.WorkingDir != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", shellQuote(s.WorkingDir))
+	}
+	b.WriteString("set --")
+	for _, arg := range s.Command {
+		b.WriteString(" " + shellQuote(arg))
+	}
+	b.WriteString("\n")
+	if s.User != "" && s.User != "root" && s.User != "0" && s.User != "0:0" {
+		user := shellQuote(s.User)
+		b.WriteString("if command -v su-exec >/dev/null 2>&1; then exec su-exec " + user + " \"$@\"; fi\n")
+		b.WriteString("if command -v gosu >/dev/null 2>&1; then exec gosu " + user + " \"$@\"; fi\n")
+		if uid, gid, ok := strings.Cut(s.User, ":"); ok {
+			fmt.Fprintf(&b, "if command -v setpriv >/dev/null 2>&1; then exec setpriv --reuid=%s --regid=%s --clear-groups \"$@\"; fi\n", shellQuote(uid), shellQuote(gid))
+		}
+		fmt.Fprintf(&b, "echo %s >&2\nexit 1\n", shellQuote("pve-oci-init: cannot switch to user "+s.User+": no su-exec, gosu or setpriv"))
+		return b.String()
+	}
+	b.WriteString("exec \"$@\"\n")
+	return b.String()
+}
+
+// Environment renders the variables as a shell-sourceable file.
+func (s InitSpec) Environment() string {
+	var b strings.Builder
+	for _, kv := range s.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		fmt.Fprintf(&b, "%s=%s\n", key, shellQuote(value))
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// injectInit copies the flattened rootfs tar from r to w, replacing any
+// existing init with the generated one. Images that merge /sbin into
+// /usr/sbin get the init written through the symlink target, replacing the
+// init found there.
+func injectInit(w io.Writer, r io.Reader, boot InitSpec) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	seen := map[string]bool{}
+	links := map[string]string{}
+	// Other files named init are held back until the /sbin symlink, which
+	// may come later in the stream, tells whether one is replaced.
+	type heldFile struct {
+		hdr     *tar.Header
+		content []byte
+	}
+	var held []heldFile
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		seen[name] = true
+		if hdr.Typeflag == tar.TypeSymlink {
+			links[name] = hdr.Linkname
+		}
+		if name == initPath || name == envPath {
+			continue
+		}
+		if path.Base(name) == "init" && hdr.Typeflag != tar.TypeDir {
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			held = append(held, heldFile{hdr, content})
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	if !seen["bin/sh"] && !seen["usr/bin/sh"] {
+		return fmt.Errorf("image has no /bin/sh to run the generated init")
+	}
+	target := initPath
+	if link, ok := links["sbin"]; ok {
+		target = path.Join(strings.TrimPrefix(path.Clean(path.Join("/", link)), "/"), "init")
+	}
+	for _, file := range held {
+		if cleanName(file.hdr.Name) == target {
+			continue
+		}
+		if err := tw.WriteHeader(file.hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.content); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	files := []struct {
+		name    string
+		mode    int64
+		content string
+	}{
+		{envPath, 0o644, boot.Environment()},
+		{target, 0o755, boot.Script()},
+	}
+	for _, file := range files {
+		var missing []string
+		for dir := path.Dir(file.name); dir != "." && !seen[dir]; dir = path.Dir(dir) {
+			missing = append(missing, dir)
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			seen[missing[i]] = true
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: missing[i] + "/", Mode: 0o755, ModTime: now}); err != nil {
+				return err
+			}
+		}
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: file.name, Mode: file.mode, Size: int64(len(file.content)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, file.content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func cleanName(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+}
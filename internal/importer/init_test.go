@@ -0,0 +1,113 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+func TestBuildInitMergesOverrides(t *testing.T) {
+	cfg := v1.Config{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		Env:        []string{"PATH=/usr/bin:/bin", "MODE=dev"},
+		WorkingDir: "/srv",
+		User:       "101:101",
+	}
+	svc := spec.ServiceSpec{}
+	svc.Spec.Args = []string{"nginx", "-T"}
+	svc.Spec.Env = map[string]string{"MODE": "prod", "LISTEN": ":8080"}
+	svc.Spec.WorkingDir = "/app"
+
+	got, err := BuildInit(cfg, svc)
+	if err != nil {
+		t.Fatalf("BuildInit: %v", err)
+	}
+	want := InitSpec{
+		Command:    []string{"/docker-entrypoint.sh", "nginx", "-T"},
+		Env:        []string{"PATH=/usr/bin:/bin", "LISTEN=:8080", "MODE=prod"},
+		WorkingDir: "/app",
+		User:       "101:101",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("BuildInit = %+v, want %+v", got, want)
+	}
+
+	svc.Spec.Command = []string{"/bin/sh", "-c"}
+	svc.Spec.Args = nil
+	got, err = BuildInit(cfg, svc)
+	if err != nil {
+		t.Fatalf("BuildInit: %v", err)
+	}
+	if !reflect.DeepEqual(got.Command, []string{"/bin/sh", "-c"}) {
+		t.Fatalf("command override should drop image cmd, got %v", got.Command)
+	}
+
+	if _, err := BuildInit(v1.Config{}, spec.ServiceSpec{}); err == nil {
+		t.Fatalf("expected error without any command")
+	}
+}
+
+func TestInitScript(t *testing.T) {
+	script := InitSpec{Command: []string{"/app", "it's"}, WorkingDir: "/srv", User: "app"}.Script()
+	for _, want := range []string{"cd '/srv' || exit 1", `set -- '/app' 'it'\''s'`, "exec su-exec 'app'"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	if env := (InitSpec{Env: []string{"GREETING=hello world"}}).Environment(); env != "GREETING='hello world'\n" {
+		t.Errorf("unexpected environment %q", env)
+	}
+}
+
+func TestInjectInitReplacesMergedUsrInit(t *testing.T) {
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	entries := []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755},
+		{Typeflag: tar.TypeDir, Name: "usr/sbin/", Mode: 0o755},
+		{Typeflag: tar.TypeSymlink, Name: "usr/sbin/init", Linkname: "../lib/systemd/systemd"},
+		{Typeflag: tar.TypeDir, Name: "etc/init/", Mode: 0o755},
+		{Typeflag: tar.TypeSymlink, Name: "bin/sh", Linkname: "dash"},
+		// The link comes after the init it redirects to.
+		{Typeflag: tar.TypeSymlink, Name: "sbin", Linkname: "usr/sbin"},
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := injectInit(&out, &in, InitSpec{Command: []string{"/app"}}); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	count := map[string]int{}
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[cleanName(hdr.Name)]++
+		if cleanName(hdr.Name) == "usr/sbin/init" && hdr.Typeflag != tar.TypeReg {
+			t.Fatalf("image init kept: %+v", hdr)
+		}
+	}
+	if count["usr/sbin/init"] != 1 || count["sbin/init"] != 0 || count["etc/init"] != 1 {
+		t.Fatalf("unexpected entries %v", count)
+	}
+}
@@ -0,0 +1,260 @@
+package pve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/config"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+// APIClient drives containers through the Proxmox VE REST API so the operator
+// can run off-host and manage every node of a cluster.
+type APIClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+	store   state.Store
+
+	taskTimeout  time.Duration
+	pollInterval time.Duration
+	storage      config.StorageResolver
+}
+
+// NewAPIClient builds a client for the API rooted at baseURL (for example
+// https://pve.example:8006). tokenID has the form user@realm!name and secret
+// is the token UUID.
+func NewAPIClient(baseURL, tokenID, secret string, httpClient *http.Client, store state.Store) *APIClient {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &APIClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   fmt.Sprintf("PVEAPIToken=%s=%s", tokenID, secret),
+		http:    httpClient,
+		store:   store,
+	}
+}
+
+// WithTaskTimeout bounds how long the client waits for a Proxmox task to
+// finish.
+func (c *APIClient) WithTaskTimeout(timeout time.Duration) *APIClient {
+	c.taskTimeout = timeout
+	return c
+}
+
+// WithStorage sets the per-node storage defaults used for specs that do not
+// name a rootfs storage.
+func (c *APIClient) WithStorage(storage config.StorageResolver) *APIClient {
+	c.storage = storage
+	return c
+}
+
+// APIError is returned for non-2xx responses from the Proxmox API.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("pve api %s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+func (c *APIClient) GetContainer(ctx context.Context, node string, ctid int) (ActualState, error) {
+	actual := ActualState{CTID: ctid, Node: node}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := c.do(ctx, http.MethodGet, lxcPath(node, ctid)+"/status/current", nil, &status); err != nil {
+		if isNotFound(err) {
+			return actual, nil
+		}
+		return actual, err
+	}
+	actual.Exists = true
+	actual.Status = status.Status
+	cfg, err := c.config(ctx, node, ctid)
+	if err != nil {
+		return actual, err
+	}
+	if applyConfig(&actual, cfg) {
+		return actual, nil
+	}
+	return actual, digestFromStore(c.store, &actual)
+}
+
+// config fetches the container configuration, flattening the mixed JSON
+// value types to the strings pct config would print.
+func (c *APIClient) config(ctx context.Context, node string, ctid int) (map[string]string, error) {
+	var raw map[string]any
+	if err := c.do(ctx, http.MethodGet, lxcPath(node, ctid)+"/config", nil, &raw); err != nil {
+		return nil, err
+	}
+	cfg := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			cfg[key] = v
+		case float64:
+			cfg[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+		default:
+			cfg[key] = fmt.Sprint(v)
+		}
+	}
+	return cfg, nil
+}
+
+func (c *APIClient) CreateContainer(ctx context.Context, svc spec.ServiceSpec, digest, template string) error {
+	form := url.Values{}
+	form.Set("vmid", strconv.Itoa(svc.Spec.CTID))
+	form.Set("ostemplate", ostemplate(svc, digest, template))
+	for _, opt := range createOptions(svc, digest, template, c.storageFor(svc.Spec.Node)) {
+		form.Set(opt.key, opt.value)
+	}
+	if err := c.task(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/lxc", url.PathEscape(svc.Spec.Node)), form); err != nil {
+		return err
+	}
+	return recordCreate(c.store, svc, digest, template, "stopped")
+}
+
+func (c *APIClient) StopContainer(ctx context.Context, node string, ctid int) error {
+	return c.task(ctx, http.MethodPost, lxcPath(node, ctid)+"/status/stop", url.Values{})
+}
+
+func (c *APIClient) StartContainer(ctx context.Context, node string, ctid int) error {
+	return c.task(ctx, http.MethodPost, lxcPath(node, ctid)+"/status/start", url.Values{})
+}
+
+func (c *APIClient) DestroyContainer(ctx context.Context, node string, ctid int) error {
+	return c.task(ctx, http.MethodDelete, lxcPath(node, ctid), nil)
+}
+
+func (c *APIClient) storageFor(node string) config.StorageConfig {
+	if c.storage == nil {
+		return config.StorageConfig{}
+	}
+	return c.storage(node)
+}
+
+func (c *APIClient) UpdateContainer(ctx context.Context, svc spec.ServiceSpec, digest string, changes Changes) error {
+	form := url.Values{}
+	form.Set("description", markersFor(svc, digest).Description())
+	var deletes []string
+	for _, change := range changes {
+		if change.To == "" {
+			deletes = append(deletes, change.Key)
+			continue
+		}
+		form.Set(change.Key, change.To)
+	}
+	if len(deletes) > 0 {
+		form.Set("delete", strings.Join(deletes, ","))
+	}
+	return c.do(ctx, http.MethodPut, lxcPath(svc.Spec.Node, svc.Spec.CTID)+"/config", form, nil)
+}
+
+// task issues a request that starts a Proxmox worker task and waits for the
+// task to finish.
+func (c *APIClient) task(ctx context.Context, method, path string, form url.Values) error {
+	var upid string
+	if err := c.do(ctx, method, path, form, &upid); err != nil {
+		return err
+	}
+	if upid == "" {
+		return nil
+	}
+	return c.waitTask(ctx, upid)
+}
+
+// do issues a request against /api2/json and decodes the "data" member of the
+// response envelope into out when out is non-nil.
+func (c *APIClient) do(ctx context.Context, method, path string, form url.Values, out any) error {
+	endpoint := c.baseURL + "/api2/json" + path
+	var body io.Reader
+	if form != nil && method != http.MethodGet && method != http.MethodDelete {
+		body = strings.NewReader(form.Encode())
+	} else if form != nil && len(form) > 0 {
+		endpoint += "?" + form.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("pve api %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("pve api %s %s: read body: %w", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &APIError{Method: method, Path: path, StatusCode: resp.StatusCode, Message: errorMessage(resp, data)}
+	}
+	if out == nil {
+		return nil
+	}
+	envelope := struct {
+		Data any `json:"data"`
+	}{Data: out}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("pve api %s %s: decode response: %w", method, path, err)
+	}
+	return nil
+}
+
+// errorMessage extracts the most useful description from a failed response.
+// Proxmox puts the reason in the status line and parameter problems in an
+// "errors" object.
+func errorMessage(resp *http.Response, data []byte) string {
+	msg := strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	var envelope struct {
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &envelope); err == nil {
+		if envelope.Message != "" {
+			msg = strings.TrimSpace(envelope.Message)
+		}
+		keys := make([]string, 0, len(envelope.Errors))
+		for key := range envelope.Errors {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			msg += fmt.Sprintf("; %s: %s", key, strings.TrimSpace(envelope.Errors[key]))
+		}
+	}
+	return msg
+}
+
+func isNotFound(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusNotFound || strings.Contains(apiErr.Message, "does not exist")
+}
+
+func lxcPath(node string, ctid int) string {
+	return fmt.Sprintf("/nodes/%s/lxc/%d", url.PathEscape(node), ctid)
+}
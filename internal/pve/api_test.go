@@ -0,0 +1,378 @@
+package pve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+// fakeAPI is a minimal in-memory stand-in for /api2/json/nodes/{node}/lxc.
+type fakeAPI struct {
+	mu         sync.Mutex
+	containers map[int]map[string]string
+	status     map[int]string
+	requests   []string
+	tasks      map[string]*fakeTask
+	snapshots  map[int][]string
+	backups    []url.Values
+	// failNext makes the next started task finish with this exit status.
+	failNext string
+}
+
+type fakeTask struct {
+	polls      int
+	exitStatus string
+	log        []string
+}
+
+func newFakeAPI(t *testing.T) (*fakeAPI, *httptest.Server) {
+	t.Helper()
+	f := &fakeAPI{containers: map[int]map[string]string{}, status: map[int]string{}, tasks: map[string]*fakeTask{}, snapshots: map[int][]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "PVEAPIToken=root@pam!op=secret" {
+		http.Error(w, "authentication failure", http.StatusUnauthorized)
+		return
+	}
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api2/json/"), "/")
+	if len(parts) == 5 && parts[2] == "tasks" {
+		f.serveTask(w, r, parts[3], parts[4])
+		return
+	}
+	if r.URL.Path == "/api2/json/cluster/resources" {
+		var resources []map[string]any
+		for ctid, cfg := range f.containers {
+			resources = append(resources, map[string]any{"type": "lxc", "node": "node1", "vmid": ctid, "tags": cfg["tags"]})
+		}
+		writeData(w, resources)
+		return
+	}
+	if len(parts) == 3 && parts[2] == "vzdump" && r.Method == http.MethodPost {
+		_ = r.ParseForm()
+		f.backups = append(f.backups, r.PostForm)
+		f.startTask(w, parts[1], "dump")
+		return
+	}
+	if len(parts) < 3 || parts[0] != "nodes" || parts[2] != "lxc" {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 3 && r.Method == http.MethodPost {
+		_ = r.ParseForm()
+		ctid, _ := strconv.Atoi(r.PostForm.Get("vmid"))
+		cfg := map[string]string{}
+		for key := range r.PostForm {
+			cfg[key] = r.PostForm.Get(key)
+		}
+		f.containers[ctid] = cfg
+		f.status[ctid] = "stopped"
+		f.startTask(w, parts[1], "create")
+		return
+	}
+	ctid, _ := strconv.Atoi(parts[3])
+	if _, ok := f.containers[ctid]; !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, `{"data":null,"message":"Configuration file 'nodes/%s/lxc/%d.conf' does not exist\n"}`, parts[1], ctid)
+		return
+	}
+	switch {
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		delete(f.containers, ctid)
+		delete(f.status, ctid)
+		f.startTask(w, parts[1], "destroy")
+	case len(parts) == 5 && parts[4] == "config" && r.Method == http.MethodGet:
+		writeData(w, f.containers[ctid])
+	case len(parts) == 6 && parts[5] == "current":
+		writeData(w, map[string]string{"status": f.status[ctid]})
+	case len(parts) == 6 && parts[5] == "start":
+		f.status[ctid] = "running"
+		f.startTask(w, parts[1], "start")
+	case len(parts) == 6 && parts[5] == "stop":
+		f.status[ctid] = "stopped"
+		f.startTask(w, parts[1], "stop")
+	case len(parts) == 5 && parts[4] == "snapshot" && r.Method == http.MethodGet:
+		list := []map[string]any{{"name": "current", "description": "You are here!"}}
+		for i, name := range f.snapshots[ctid] {
+			list = append(list, map[string]any{"name": name, "snaptime": 1700000000 + i})
+		}
+		writeData(w, list)
+	case len(parts) == 5 && parts[4] == "snapshot" && r.Method == http.MethodPost:
+		_ = r.ParseForm()
+		f.snapshots[ctid] = append(f.snapshots[ctid], r.PostForm.Get("snapname"))
+		f.startTask(w, parts[1], "snapshot")
+	case len(parts) == 6 && parts[4] == "snapshot" && r.Method == http.MethodDelete:
+		f.snapshots[ctid] = slices.DeleteFunc(f.snapshots[ctid], func(name string) bool { return name == parts[5] })
+		f.startTask(w, parts[1], "delsnapshot")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startTask answers with a UPID whose status reports "running" once before
+// stopping, so clients have to poll.
+func (f *fakeAPI) startTask(w http.ResponseWriter, node, kind string) {
+	upid := fmt.Sprintf("UPID:%s:0000:0000:0000:vz%s:%d:root@pam:", node, kind, len(f.tasks))
+	task := &fakeTask{exitStatus: "OK", log: []string{kind + " started"}}
+	if f.failNext != "" {
+		task.exitStatus = f.failNext
+		task.log = append(task.log, "error: "+f.failNext)
+		f.failNext = ""
+	}
+	f.tasks[upid] = task
+	writeData(w, upid)
+}
+
+func (f *fakeAPI) serveTask(w http.ResponseWriter, r *http.Request, upid, what string) {
+	task, ok := f.tasks[upid]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch what {
+	case "status":
+		task.polls++
+		if task.polls < 2 {
+			writeData(w, map[string]string{"status": "running"})
+			return
+		}
+		writeData(w, map[string]string{"status": "stopped", "exitstatus": task.exitStatus})
+	case "log":
+		var lines []map[string]any
+		for i, text := range task.log {
+			lines = append(lines, map[string]any{"n": i + 1, "t": text})
+		}
+		writeData(w, lines)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeData(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func newTestAPIClient(t *testing.T, srv *httptest.Server) *APIClient {
+	t.Helper()
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	client := NewAPIClient(srv.URL, "root@pam!op", "secret", srv.Client(), store)
+	client.pollInterval = time.Millisecond
+	return client
+}
+
+func TestAPIClientLifecycle(t *testing.T) {
+	fake, srv := newFakeAPI(t)
+	client := newTestAPIClient(t, srv)
+	ctx := context.Background()
+
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Resources.Cores = 2
+	svc.Spec.Resources.MemoryMB = 1024
+
+	actual, err := client.GetContainer(ctx, "node1", 160)
+	if err != nil {
+		t.Fatalf("get missing: %v", err)
+	}
+	if actual.Exists {
+		t.Fatalf("expected container to be absent")
+	}
+	if err := client.CreateContainer(ctx, svc, "sha256:abc", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if got := fake.containers[160]["cores"]; got != "2" {
+		t.Fatalf("expected cores=2, got %q", got)
+	}
+	if err := client.StartContainer(ctx, "node1", 160); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	actual, err = client.GetContainer(ctx, "node1", 160)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !actual.Exists || actual.Status != "running" || actual.CurrentDigest != "sha256:abc" {
+		t.Fatalf("unexpected state %+v", actual)
+	}
+	if err := client.StopContainer(ctx, "node1", 160); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := client.DestroyContainer(ctx, "node1", 160); err != nil {
+		t.Fatalf("destroy: %v", err)
+	}
+	if _, ok := fake.containers[160]; ok {
+		t.Fatalf("expected container to be destroyed")
+	}
+}
+
+func TestAPIClientReportsErrors(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	client := NewAPIClient(srv.URL, "root@pam!op", "wrong", srv.Client(), nil)
+	_, err := client.GetContainer(context.Background(), "node1", 160)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+}
+
+func TestAPIClientWaitsForTasks(t *testing.T) {
+	fake, srv := newFakeAPI(t)
+	client := newTestAPIClient(t, srv)
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	if err := client.CreateContainer(context.Background(), svc, "sha256:abc", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for upid, task := range fake.tasks {
+		if task.polls < 2 {
+			t.Fatalf("task %s was not polled to completion", upid)
+		}
+	}
+
+	fake.failNext = "command 'lxc-start' failed: exit code 1"
+	err := client.StartContainer(context.Background(), "node1", 160)
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) {
+		t.Fatalf("expected TaskError, got %v", err)
+	}
+	if len(taskErr.Log) == 0 || !strings.Contains(err.Error(), "lxc-start") {
+		t.Fatalf("expected task log in error, got %v", err)
+	}
+}
+
+func TestAPIClientTaskHonorsDeadline(t *testing.T) {
+	fake, srv := newFakeAPI(t)
+	client := newTestAPIClient(t, srv)
+	client.pollInterval = time.Hour
+	fake.containers[160] = map[string]string{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := client.StartContainer(ctx, "node1", 160)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestUPIDNode(t *testing.T) {
+	node, err := UPIDNode("UPID:hephaestus-2:0012F3A1:04A1B2C3:6650A1B2:vzcreate:160:root@pam:")
+	if err != nil || node != "hephaestus-2" {
+		t.Fatalf("unexpected node %q err %v", node, err)
+	}
+	if _, err := UPIDNode("not-a-upid"); err == nil {
+		t.Fatalf("expected error for malformed upid")
+	}
+}
+
+func TestAPIClientReadsMarkersFromContainer(t *testing.T) {
+	fake, srv := newFakeAPI(t)
+	client := newTestAPIClient(t, srv)
+	ctx := context.Background()
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	if err := client.CreateContainer(ctx, svc, "sha256:abc", ""); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if fake.containers[160]["tags"] != ManagedBy {
+		t.Fatalf("expected managed-by tag, got %q", fake.containers[160]["tags"])
+	}
+
+	// A client with an empty state store must still see the deployment.
+	fresh := newTestAPIClient(t, srv)
+	actual, err := fresh.GetContainer(ctx, "node1", 160)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !actual.Managed || actual.CurrentDigest != "sha256:abc" || actual.Service != "composer" || actual.SpecHash != svc.Hash() {
+		t.Fatalf("markers not read back: %+v", actual)
+	}
+	if actual.Image != "ghcr.io/haasonsaas/composer:main" {
+		t.Fatalf("unexpected image %q", actual.Image)
+	}
+
+	fake.containers[170] = map[string]string{"hostname": "unmanaged", "tags": "web"}
+	managed, err := fresh.ListManaged(ctx)
+	if err != nil || len(managed) != 1 || managed[0].CTID != 160 || managed[0].Node != "node1" {
+		t.Fatalf("list managed = %+v, %v", managed, err)
+	}
+}
+
+func TestAPIClientFallsBackToStore(t *testing.T) {
+	fake, srv := newFakeAPI(t)
+	client := newTestAPIClient(t, srv)
+	fake.containers[160] = map[string]string{"hostname": "legacy"}
+	if err := client.store.Save(state.Entry{CTID: 160, Digest: "sha256:old"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	actual, err := client.GetContainer(context.Background(), "node1", 160)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if actual.Managed || actual.CurrentDigest != "sha256:old" {
+		t.Fatalf("expected store fallback, got %+v", actual)
+	}
+}
+
+func TestAPIClientSnapshotsAndBackups(t *testing.T) {
+	fake, srv := newFakeAPI(t)
+	client := newTestAPIClient(t, srv)
+	ctx := context.Background()
+	fake.containers[160] = map[string]string{"hostname": "composer"}
+
+	for _, name := range []string{"pveoci-1", "pveoci-2"} {
+		if err := client.Snapshot(ctx, "node1", 160, name); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+	}
+	if err := client.DeleteSnapshot(ctx, "node1", 160, "pveoci-1"); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+	snapshots, err := client.ListSnapshots(ctx, "node1", 160)
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != "pveoci-2" {
+		t.Fatalf("list snapshots = %+v, %v", snapshots, err)
+	}
+
+	backup := spec.BackupSpec{Storage: "pbs", Mode: "stop", KeepLast: 3}
+	if err := client.Backup(ctx, "node1", 160, backup); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	got := fake.backups[0]
+	if got.Get("vmid") != "160" || got.Get("storage") != "pbs" || got.Get("mode") != "stop" ||
+		got.Get("compress") != "zstd" || got.Get("prune-backups") != "keep-last=3" {
+		t.Fatalf("unexpected vzdump parameters %v", got)
+	}
+
+	fake.failNext = "job errors"
+	if err := client.Backup(ctx, "node1", 160, backup); err == nil {
+		t.Fatalf("expected failed vzdump task to be reported")
+	}
+}
@@ -0,0 +1,53 @@
+package pve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// backupOptions maps a backup spec to vzdump parameters.
+func backupOptions(backup spec.BackupSpec) []option {
+	opts := []option{
+		{"storage", backup.Storage},
+		{"mode", backup.EffectiveMode()},
+		{"compress", backup.EffectiveCompress()},
+		{"notes-template", "{{guestname}} before rollout by " + ManagedBy},
+	}
+	if backup.KeepLast > 0 {
+		opts = append(opts, option{"prune-backups", fmt.Sprintf("keep-last=%d", backup.KeepLast)})
+	}
+	return opts
+}
+
+func (c *CLIClient) Backup(ctx context.Context, _ string, ctid int, backup spec.BackupSpec) error {
+	path := c.vzdumpPath
+	if path == "" {
+		path = "vzdump"
+	}
+	args := []string{strconv.Itoa(ctid)}
+	for _, opt := range backupOptions(backup) {
+		args = append(args, "--"+opt.key, opt.value)
+	}
+	ctx, cancel := withTaskTimeout(ctx, c.taskTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("vzdump %v: %w: %s", args, err, out)
+	}
+	return nil
+}
+
+func (c *APIClient) Backup(ctx context.Context, node string, ctid int, backup spec.BackupSpec) error {
+	form := url.Values{}
+	form.Set("vmid", strconv.Itoa(ctid))
+	for _, opt := range backupOptions(backup) {
+		form.Set(opt.key, opt.value)
+	}
+	return c.task(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/vzdump", url.PathEscape(node)), form)
+}
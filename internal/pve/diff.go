@@ -0,0 +1,230 @@
+package pve
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/config"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// Action says how a config change can be applied to an existing container.
+type Action string
+
+const (
+	// ActionHotplug changes take effect on the running container.
+	ActionHotplug Action = "hotplug"
+	// ActionRestart changes are written with pct set and take effect on the
+	// next start.
+	ActionRestart Action = "restart"
+	// ActionRecreate changes need a new container.
+	ActionRecreate Action = "recreate"
+)
+
+// Change is a single config key that differs between spec and container. An
+// empty To deletes the key.
+type Change struct {
+	Key    string `json:"key"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Action Action `json:"action"`
+}
+
+// Changes is the set of differences between a spec and a live container.
+type Changes []Change
+
+// Requires reports whether any change needs action.
+func (cs Changes) Requires(action Action) bool {
+	for _, c := range cs {
+		if c.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Except returns the changes that do not need action.
+func (cs Changes) Except(action Action) Changes {
+	var rest Changes
+	for _, c := range cs {
+		if c.Action != action {
+			rest = append(rest, c)
+		}
+	}
+	return rest
+}
+
+// Keys lists the changed config keys.
+func (cs Changes) Keys() []string {
+	keys := make([]string, len(cs))
+	for i, c := range cs {
+		keys[i] = c.Key
+	}
+	return keys
+}
+
+var indexedKey = regexp.MustCompile(`^(net|mp)\d+$`)
+
+// unmanagedKeys are create options the diff leaves alone: markers are
+// rewritten on every update and the rest only matter at create time.
+var unmanagedKeys = map[string]bool{
+	"description": true,
+	"tags":        true,
+	"ostype":      true,
+	"storage":     true,
+}
+
+// flagDefaults are the values Proxmox assumes for boolean properties that are
+// absent from a netN/mpN/features string.
+var flagDefaults = map[string]string{
+	"nesting":   "0",
+	"keyctl":    "0",
+	"fuse":      "0",
+	"ro":        "0",
+	"shared":    "0",
+	"firewall":  "0",
+	"backup":    "0",
+	"replicate": "1",
+}
+
+// Diff compares the settings the spec controls with the live container
+// config. Keys the spec does not set are ignored, except for extra netN/mpN
+// entries which the spec implicitly removes. Rootfs is only compared when
+// the spec names a storage or size explicitly.
+func Diff(svc spec.ServiceSpec, actual ActualState) Changes {
+	desired := map[string]string{}
+	for _, opt := range createOptions(svc, "", "", config.StorageConfig{}) {
+		if !unmanagedKeys[opt.key] {
+			desired[opt.key] = opt.value
+		}
+	}
+	// Without a size the rootfs is created at the Proxmox default, so only
+	// its storage is compared; a pct resize afterwards is not drift.
+	if svc.Spec.Resources.RootfsSizeGB <= 0 && volumeStorage(actual.Config["rootfs"]) == svc.Spec.Resources.RootfsStorage {
+		delete(desired, "rootfs")
+	}
+	var changes Changes
+	for key, want := range desired {
+		have := actual.Config[key]
+		if equivalent(key, want, have) {
+			continue
+		}
+		changes = append(changes, Change{Key: key, From: have, To: want, Action: actionFor(key, want, have)})
+	}
+	for key, have := range actual.Config {
+		if _, ok := desired[key]; !ok && indexedKey.MatchString(key) {
+			changes = append(changes, Change{Key: key, From: have, Action: actionFor(key, "", have)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+func actionFor(key, want, have string) Action {
+	switch {
+	case key == "cores" || key == "memory" || key == "swap" || strings.HasPrefix(key, "net"):
+		return ActionHotplug
+	case key == "rootfs":
+		return ActionRecreate
+	case strings.HasPrefix(key, "mp"):
+		// Changing where a volume-backed mount point lives means new data.
+		if want != "" && have != "" && volumeStorage(want) != volumeStorage(have) {
+			return ActionRecreate
+		}
+		return ActionRestart
+	default:
+		return ActionRestart
+	}
+}
+
+// equivalent compares a desired value with the live one. Property strings are
+// compared on the properties the spec sets; volume sources like "local-lvm:8"
+// match the allocated "local-lvm:vm-160-disk-1,size=8G".
+func equivalent(key, want, have string) bool {
+	switch {
+	case key == "rootfs" || strings.HasPrefix(key, "mp"):
+		return equivalentVolume(want, have)
+	case strings.HasPrefix(key, "net") || key == "features":
+		return equivalentProperties(parseProperties(want), parseProperties(have))
+	default:
+		return want == have
+	}
+}
+
+func equivalentVolume(want, have string) bool {
+	if have == "" {
+		return false
+	}
+	wantSource, wantProps := splitVolume(want)
+	haveSource, haveProps := splitVolume(have)
+	if storage, size, ok := allocation(wantSource); ok {
+		if volumeStorage(haveSource) != storage || strings.TrimSuffix(haveProps["size"], "G") != size {
+			return false
+		}
+	} else if wantSource != haveSource {
+		return false
+	}
+	return equivalentProperties(wantProps, haveProps)
+}
+
+func equivalentProperties(want, have map[string]string) bool {
+	for key, value := range want {
+		if key == "size" {
+			continue
+		}
+		if !strings.EqualFold(value, valueOrDefault(have, key)) {
+			return false
+		}
+	}
+	for key, def := range flagDefaults {
+		if _, ok := want[key]; !ok {
+			if v, ok := have[key]; ok && v != def {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func valueOrDefault(props map[string]string, key string) string {
+	if v, ok := props[key]; ok {
+		return v
+	}
+	return flagDefaults[key]
+}
+
+// splitVolume separates the volume source from its properties.
+func splitVolume(value string) (string, map[string]string) {
+	source, rest, _ := strings.Cut(value, ",")
+	return source, parseProperties(rest)
+}
+
+// allocation recognises the "storage:sizeGB" form used to allocate a new
+// volume.
+func allocation(source string) (string, string, bool) {
+	storage, size, ok := strings.Cut(source, ":")
+	if !ok || size == "" || strings.Trim(size, "0123456789") != "" {
+		return "", "", false
+	}
+	return storage, size, true
+}
+
+func volumeStorage(value string) string {
+	source, _, _ := strings.Cut(value, ",")
+	if strings.HasPrefix(source, "/") {
+		return ""
+	}
+	storage, _, _ := strings.Cut(source, ":")
+	return storage
+}
+
+func parseProperties(value string) map[string]string {
+	props := map[string]string{}
+	for _, part := range strings.Split(value, ",") {
+		if key, v, ok := strings.Cut(part, "="); ok {
+			props[strings.TrimSpace(key)] = strings.TrimSpace(v)
+		}
+	}
+	return props
+}
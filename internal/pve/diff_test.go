@@ -0,0 +1,62 @@
+package pve
+
+import (
+	"testing"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+func TestDiff(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Resources = spec.ResourceSpec{Cores: 4, MemoryMB: 2048, RootfsStorage: "local-lvm", RootfsSizeGB: 8}
+	svc.Spec.Network = spec.NetworkSpec{Bridge: "vmbr0", IP: "192.168.4.160/24", GW: "192.168.4.1"}
+	svc.Spec.Mounts = []spec.MountSpec{
+		{Host: "/srv/data", Guest: "/data"},
+		{Volume: "local-lvm:vm-160-disk-1", Guest: "/cache"},
+	}
+	live := map[string]string{
+		"hostname": "composer",
+		"cores":    "4",
+		"memory":   "2048",
+		"rootfs":   "local-lvm:vm-160-disk-0,size=8G",
+		"net0":     "name=eth0,bridge=vmbr0,gw=192.168.4.1,hwaddr=BC:24:11:00:00:01,ip=192.168.4.160/24,type=veth",
+		"mp0":      "/srv/data,mp=/data",
+		"mp1":      "local-lvm:vm-160-disk-1,mp=/cache,size=4G",
+	}
+	if changes := Diff(svc, ActualState{Config: live}); len(changes) != 0 {
+		t.Fatalf("expected no changes, got %+v", changes)
+	}
+
+	live["memory"] = "1024"
+	live["mp0"] = "/srv/data,mp=/data,ro=1"
+	live["net1"] = "name=eth1,bridge=vmbr1"
+	live["rootfs"] = "local-lvm:vm-160-disk-0,size=4G"
+	changes := Diff(svc, ActualState{Config: live})
+	want := map[string]Action{"memory": ActionHotplug, "mp0": ActionRestart, "net1": ActionHotplug, "rootfs": ActionRecreate}
+	if len(changes) != len(want) {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	for _, change := range changes {
+		if want[change.Key] != change.Action {
+			t.Errorf("%s: action %s, want %s", change.Key, change.Action, want[change.Key])
+		}
+	}
+	if !changes.Requires(ActionRecreate) {
+		t.Fatalf("rootfs change must require recreate")
+	}
+}
+
+func TestDiffIgnoresRootfsSizeWhenUnset(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Spec.Resources.RootfsStorage = "local-lvm"
+	// Resized with pct resize after a create at the default size.
+	live := map[string]string{"rootfs": "local-lvm:vm-160-disk-0,size=12G"}
+	if changes := Diff(svc, ActualState{Config: live}); len(changes) != 0 {
+		t.Fatalf("expected a resized rootfs to match, got %+v", changes)
+	}
+	live["rootfs"] = "tank:subvol-160-disk-0,size=4G"
+	if changes := Diff(svc, ActualState{Config: live}); !changes.Requires(ActionRecreate) {
+		t.Fatalf("expected a moved rootfs to need a new container, got %+v", changes)
+	}
+}
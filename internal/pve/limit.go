@@ -0,0 +1,134 @@
+package pve
+
+import (
+	"context"
+	"sync"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// NodeLimiter wraps a Client so that at most limit operations that change
+// containers run on one node at a time, keeping parallel reconciles from
+// piling tasks onto a node where they contend for its locks and storage.
+// Reads are not limited.
+type NodeLimiter struct {
+	Client
+	limit int
+
+	mu    sync.Mutex
+	nodes map[string]chan struct{}
+}
+
+// NewNodeLimiter limits client to limit concurrent operations per node. A
+// limit below one is treated as one.
+func NewNodeLimiter(client Client, limit int) *NodeLimiter {
+	return &NodeLimiter{Client: client, limit: max(limit, 1), nodes: make(map[string]chan struct{})}
+}
+
+// acquire waits for a free slot on node and returns the function that frees
+// it again.
+func (l *NodeLimiter) acquire(ctx context.Context, node string) (func(), error) {
+	l.mu.Lock()
+	slots, ok := l.nodes[node]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.nodes[node] = slots
+	}
+	l.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *NodeLimiter) CreateContainer(ctx context.Context, svc spec.ServiceSpec, digest, template string) error {
+	release, err := l.acquire(ctx, svc.Spec.Node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.CreateContainer(ctx, svc, digest, template)
+}
+
+func (l *NodeLimiter) StopContainer(ctx context.Context, node string, ctid int) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.StopContainer(ctx, node, ctid)
+}
+
+func (l *NodeLimiter) StartContainer(ctx context.Context, node string, ctid int) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.StartContainer(ctx, node, ctid)
+}
+
+func (l *NodeLimiter) DestroyContainer(ctx context.Context, node string, ctid int) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.DestroyContainer(ctx, node, ctid)
+}
+
+func (l *NodeLimiter) UpdateContainer(ctx context.Context, svc spec.ServiceSpec, digest string, changes Changes) error {
+	release, err := l.acquire(ctx, svc.Spec.Node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.UpdateContainer(ctx, svc, digest, changes)
+}
+
+func (l *NodeLimiter) Snapshot(ctx context.Context, node string, ctid int, name string) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.Snapshot(ctx, node, ctid, name)
+}
+
+func (l *NodeLimiter) RollbackSnapshot(ctx context.Context, node string, ctid int, name string) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.RollbackSnapshot(ctx, node, ctid, name)
+}
+
+func (l *NodeLimiter) DeleteSnapshot(ctx context.Context, node string, ctid int, name string) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.DeleteSnapshot(ctx, node, ctid, name)
+}
+
+func (l *NodeLimiter) CloneContainer(ctx context.Context, node string, ctid, newID int, snapshot string) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.CloneContainer(ctx, node, ctid, newID, snapshot)
+}
+
+func (l *NodeLimiter) Backup(ctx context.Context, node string, ctid int, backup spec.BackupSpec) error {
+	release, err := l.acquire(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Client.Backup(ctx, node, ctid, backup)
+}
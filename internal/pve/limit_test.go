@@ -0,0 +1,68 @@
+package pve
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowClient counts how many stops run at once per node.
+type slowClient struct {
+	Client
+	mu      sync.Mutex
+	running map[string]int
+	peak    map[string]int
+}
+
+func (c *slowClient) StopContainer(ctx context.Context, node string, ctid int) error {
+	c.mu.Lock()
+	c.running[node]++
+	c.peak[node] = max(c.peak[node], c.running[node])
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.mu.Lock()
+	c.running[node]--
+	c.mu.Unlock()
+	return nil
+}
+
+func TestNodeLimiterBoundsOperationsPerNode(t *testing.T) {
+	slow := &slowClient{running: map[string]int{}, peak: map[string]int{}}
+	limited := NewNodeLimiter(slow, 2)
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for i := range 12 {
+		node := "pve1"
+		if i%2 == 1 {
+			node = "pve2"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := limited.StopContainer(context.Background(), node, 100+i); err != nil {
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
+		t.Fatalf("stop failed")
+	}
+	for node, peak := range slow.peak {
+		if peak > 2 {
+			t.Fatalf("%s ran %d operations at once, want at most 2", node, peak)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release, _ := limited.acquire(ctx, "pve1")
+	release2, _ := limited.acquire(ctx, "pve1")
+	cancel()
+	if err := limited.StopContainer(ctx, "pve1", 100); err == nil {
+		t.Fatalf("expected a cancelled wait for a full node to fail")
+	}
+	release()
+	release2()
+}
@@ -0,0 +1,84 @@
+package pve
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ListManaged returns every container on the host that carries the
+// operator's markers.
+func (c *CLIClient) ListManaged(ctx context.Context) ([]ActualState, error) {
+	out, err := c.run(ctx, "list")
+	if err != nil {
+		return nil, err
+	}
+	var managed []ActualState
+	for _, ctid := range parseList(out) {
+		actual, err := c.GetContainer(ctx, "", ctid)
+		if err != nil {
+			return nil, err
+		}
+		if actual.Exists && actual.Managed {
+			managed = append(managed, actual)
+		}
+	}
+	return managed, nil
+}
+
+// ListManaged returns every container in the cluster tagged as managed by
+// the operator.
+func (c *APIClient) ListManaged(ctx context.Context) ([]ActualState, error) {
+	var resources []struct {
+		Type string `json:"type"`
+		Node string `json:"node"`
+		VMID int    `json:"vmid"`
+		Tags string `json:"tags"`
+	}
+	query := url.Values{}
+	query.Set("type", "vm")
+	if err := c.do(ctx, http.MethodGet, "/cluster/resources", query, &resources); err != nil {
+		return nil, err
+	}
+	var managed []ActualState
+	for _, res := range resources {
+		if res.Type != "lxc" || !hasTag(res.Tags, ManagedBy) {
+			continue
+		}
+		actual, err := c.GetContainer(ctx, res.Node, res.VMID)
+		if err != nil {
+			return nil, err
+		}
+		if actual.Exists && actual.Managed {
+			managed = append(managed, actual)
+		}
+	}
+	return managed, nil
+}
+
+// parseList reads the CTIDs from the table printed by pct list:
+//
+//	VMID       Status     Lock         Name
+//	160        running                 composer
+func parseList(out string) []int {
+	var ctids []int
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if ctid, err := strconv.Atoi(fields[0]); err == nil {
+			ctids = append(ctids, ctid)
+		}
+	}
+	return ctids
+}
+
+// hasTag reports whether the Proxmox tag list, separated by semicolons or
+// commas, contains tag.
+func hasTag(tags, tag string) bool {
+	return slices.Contains(strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == ',' || r == ' ' }), tag)
+}
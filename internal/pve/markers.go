@@ -0,0 +1,84 @@
+package pve
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// ManagedBy marks containers created by this operator, both as a tag and in
+// the description.
+const ManagedBy = "pve-oci-operator"
+
+// Markers is what the operator records about a deployment on the container
+// itself, so the container stays the source of truth when local state is
+// lost or the operator moves hosts.
+type Markers struct {
+	Service  string
+	Image    string
+	Digest   string
+	SpecHash string
+	InitHash string
+}
+
+func markersFor(svc spec.ServiceSpec, digest string) Markers {
+	return Markers{
+		Service:  svc.Metadata.Name,
+		Image:    svc.Spec.Image + ":" + svc.Spec.Tag,
+		Digest:   digest,
+		SpecHash: svc.Hash(),
+		InitHash: svc.InitHash(),
+	}
+}
+
+// Description renders the markers as the container description. It is kept
+// on a single line so pct config prints it as one "description:" entry.
+func (m Markers) Description() string {
+	return fmt.Sprintf("managed-by=%s service=%s image=%s digest=%s spec-hash=%s init-hash=%s", ManagedBy, m.Service, m.Image, m.Digest, m.SpecHash, m.InitHash)
+}
+
+// parseMarkers reads markers back from a description. ok is false unless the
+// description carries the managed-by marker.
+func parseMarkers(description string) (Markers, bool) {
+	var m Markers
+	managed := false
+	for _, field := range strings.Fields(description) {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "managed-by":
+			managed = value == ManagedBy
+		case "service":
+			m.Service = value
+		case "image":
+			m.Image = value
+		case "digest":
+			m.Digest = value
+		case "spec-hash":
+			m.SpecHash = value
+		case "init-hash":
+			m.InitHash = value
+		}
+	}
+	return m, managed
+}
+
+// applyConfig fills the marker-derived fields of actual from the live
+// container config and reports whether the container carried markers.
+func applyConfig(actual *ActualState, cfg map[string]string) bool {
+	actual.Config = cfg
+	markers, ok := parseMarkers(cfg["description"])
+	if !ok {
+		return false
+	}
+	actual.Managed = true
+	actual.Service = markers.Service
+	actual.Image = markers.Image
+	actual.CurrentDigest = markers.Digest
+	actual.SpecHash = markers.SpecHash
+	actual.InitHash = markers.InitHash
+	return true
+}
@@ -0,0 +1,165 @@
+package pve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/config"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+const (
+	// defaultStorage and defaultRootfsSizeGB mirror what pct create uses when
+	// neither --rootfs nor --storage is given.
+	defaultStorage      = "local"
+	defaultRootfsSizeGB = 4
+)
+
+// option is a single pct/API container setting. Options are kept ordered so
+// the generated pct command line is stable across runs.
+type option struct {
+	key   string
+	value string
+}
+
+func createOptions(svc spec.ServiceSpec, digest, template string, storage config.StorageConfig) []option {
+	opts := []option{
+		{"hostname", svc.Hostname()},
+		{"description", markersFor(svc, digest).Description()},
+		{"tags", ManagedBy},
+	}
+	if template != "" {
+		// Flattened OCI images carry no distribution Proxmox could set up.
+		opts = append(opts, option{"ostype", "unmanaged"})
+	}
+	if svc.Spec.Resources.Cores > 0 {
+		opts = append(opts, option{"cores", strconv.Itoa(svc.Spec.Resources.Cores)})
+	}
+	if svc.Spec.Resources.MemoryMB > 0 {
+		opts = append(opts, option{"memory", strconv.Itoa(svc.Spec.Resources.MemoryMB)})
+	}
+	if features := featuresOption(svc.Spec.Features); features != "" {
+		opts = append(opts, option{"features", features})
+	}
+	if rootfs := rootfsOption(svc.Spec.Resources, storage); rootfs != "" {
+		opts = append(opts, option{"rootfs", rootfs})
+	} else if storage.Rootfs != "" {
+		opts = append(opts, option{"storage", storage.Rootfs})
+	}
+	for i, iface := range svc.Spec.Network.EffectiveInterfaces() {
+		opts = append(opts, option{fmt.Sprintf("net%d", i), netInterface(iface)})
+	}
+	if len(svc.Spec.Network.Nameservers) > 0 {
+		opts = append(opts, option{"nameserver", strings.Join(svc.Spec.Network.Nameservers, " ")})
+	}
+	if svc.Spec.Network.SearchDomain != "" {
+		opts = append(opts, option{"searchdomain", svc.Spec.Network.SearchDomain})
+	}
+	for i, mount := range svc.Spec.Mounts {
+		opts = append(opts, option{fmt.Sprintf("mp%d", i), mountPoint(mount)})
+	}
+	return opts
+}
+
+// featuresOption renders the features property string, e.g.
+// "nesting=1,mount=nfs;cifs".
+func featuresOption(f spec.FeatureSpec) string {
+	var parts []string
+	for _, flag := range []struct {
+		name string
+		on   bool
+	}{{"nesting", f.Nesting}, {"keyctl", f.Keyctl}, {"fuse", f.Fuse}} {
+		if flag.on {
+			parts = append(parts, flag.name+"=1")
+		}
+	}
+	if len(f.Mount) > 0 {
+		parts = append(parts, "mount="+strings.Join(f.Mount, ";"))
+	}
+	return strings.Join(parts, ",")
+}
+
+// rootfsOption renders the rootfs volume as "storage:sizeGB". It is empty when
+// the spec leaves the size to Proxmox; the storage is then passed through
+// --storage instead.
+func rootfsOption(res spec.ResourceSpec, defaults config.StorageConfig) string {
+	if res.RootfsSizeGB <= 0 {
+		if res.RootfsStorage != "" {
+			return res.RootfsStorage + ":" + strconv.Itoa(defaultRootfsSizeGB)
+		}
+		return ""
+	}
+	storage := res.RootfsStorage
+	if storage == "" {
+		storage = defaults.Rootfs
+	}
+	if storage == "" {
+		storage = defaultStorage
+	}
+	return fmt.Sprintf("%s:%d", storage, res.RootfsSizeGB)
+}
+
+// netInterface renders an InterfaceSpec in the netN property string format,
+// e.g. "name=eth0,bridge=vmbr0,tag=20,ip=dhcp,ip6=auto".
+func netInterface(iface spec.InterfaceSpec) string {
+	parts := []string{"name=" + iface.Name, "bridge=" + iface.Bridge}
+	if iface.VLAN > 0 {
+		parts = append(parts, fmt.Sprintf("tag=%d", iface.VLAN))
+	}
+	if iface.MTU > 0 {
+		parts = append(parts, fmt.Sprintf("mtu=%d", iface.MTU))
+	}
+	if iface.HWAddr != "" {
+		parts = append(parts, "hwaddr="+strings.ToUpper(iface.HWAddr))
+	}
+	if iface.Firewall {
+		parts = append(parts, "firewall=1")
+	}
+	if iface.RateMBps > 0 {
+		parts = append(parts, "rate="+strconv.FormatFloat(iface.RateMBps, 'f', -1, 64))
+	}
+	for _, kv := range [][2]string{{"ip", iface.IP}, {"gw", iface.GW}, {"ip6", iface.IP6}, {"gw6", iface.GW6}} {
+		if kv[1] != "" {
+			parts = append(parts, kv[0]+"="+kv[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// mountPoint renders a MountSpec in the mpN property string format, e.g.
+// "/srv/data,mp=/data,ro=1" or "tank:subvol-900-data,mp=/data,backup=1".
+func mountPoint(m spec.MountSpec) string {
+	source := m.Host
+	if source == "" {
+		source = m.Volume
+	}
+	parts := []string{source, "mp=" + m.Guest}
+	for _, opt := range m.OptionList() {
+		switch opt {
+		case "ro":
+			parts = append(parts, "ro=1")
+		case "backup":
+			parts = append(parts, "backup=1")
+		case "nobackup":
+			parts = append(parts, "backup=0")
+		case "replicate":
+			parts = append(parts, "replicate=1")
+		case "noreplicate":
+			parts = append(parts, "replicate=0")
+		case "shared":
+			parts = append(parts, "shared=1")
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ostemplate returns the template volume to create from. template is the
+// volid produced by the image importer; without one the image reference is
+// passed through as-is.
+func ostemplate(svc spec.ServiceSpec, digest, template string) string {
+	if template != "" {
+		return template
+	}
+	return fmt.Sprintf("%s@%s", svc.Spec.Image, digest)
+}
@@ -0,0 +1,124 @@
+package pve
+
+import (
+	"testing"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/config"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+func TestMountPoint(t *testing.T) {
+	cases := []struct {
+		mount spec.MountSpec
+		want  string
+	}{
+		{spec.MountSpec{Host: "/srv/data", Guest: "/data", Options: "rw"}, "/srv/data,mp=/data"},
+		{spec.MountSpec{Host: "/srv/data", Guest: "/data", Options: "ro,nobackup"}, "/srv/data,mp=/data,ro=1,backup=0"},
+		{spec.MountSpec{Volume: "tank:subvol-160-data", Guest: "/data", Options: "backup,noreplicate"}, "tank:subvol-160-data,mp=/data,backup=1,replicate=0"},
+	}
+	for _, tc := range cases {
+		if got := mountPoint(tc.mount); got != tc.want {
+			t.Errorf("mountPoint(%+v) = %q, want %q", tc.mount, got, tc.want)
+		}
+	}
+}
+
+func TestCreateOptionsNumbersMounts(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Mounts = []spec.MountSpec{
+		{Host: "/srv/a", Guest: "/a"},
+		{Host: "/srv/b", Guest: "/b"},
+	}
+	found := map[string]string{}
+	for _, opt := range createOptions(svc, "", "", config.StorageConfig{}) {
+		found[opt.key] = opt.value
+	}
+	if found["mp0"] != "/srv/a,mp=/a" || found["mp1"] != "/srv/b,mp=/b" {
+		t.Fatalf("unexpected mount options %v", found)
+	}
+}
+
+func TestNetInterfaces(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Network = spec.NetworkSpec{
+		Interfaces: []spec.InterfaceSpec{
+			{Bridge: "vmbr0", IP: "192.168.4.160/24", GW: "192.168.4.1", IP6: "auto"},
+			{Name: "storage", Bridge: "vmbr1", VLAN: 20, MTU: 9000, Firewall: true, RateMBps: 12.5, IP: "dhcp", HWAddr: "bc:24:11:aa:bb:cc"},
+		},
+		Nameservers:  []string{"192.168.4.1", "1.1.1.1"},
+		SearchDomain: "lan",
+	}
+	found := map[string]string{}
+	for _, opt := range createOptions(svc, "", "", config.StorageConfig{}) {
+		found[opt.key] = opt.value
+	}
+	want := map[string]string{
+		"net0":         "name=eth0,bridge=vmbr0,ip=192.168.4.160/24,gw=192.168.4.1,ip6=auto",
+		"net1":         "name=storage,bridge=vmbr1,tag=20,mtu=9000,hwaddr=BC:24:11:AA:BB:CC,firewall=1,rate=12.5,ip=dhcp",
+		"nameserver":   "192.168.4.1 1.1.1.1",
+		"searchdomain": "lan",
+	}
+	for key, value := range want {
+		if found[key] != value {
+			t.Errorf("%s = %q, want %q", key, found[key], value)
+		}
+	}
+}
+
+func TestLegacyNetworkBecomesNet0(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Spec.Network = spec.NetworkSpec{Bridge: "vmbr0", IP: "192.168.4.160/24", GW: "192.168.4.1"}
+	for _, opt := range createOptions(svc, "", "", config.StorageConfig{}) {
+		if opt.key == "net0" {
+			if opt.value != "name=eth0,bridge=vmbr0,ip=192.168.4.160/24,gw=192.168.4.1" {
+				t.Fatalf("unexpected net0 %q", opt.value)
+			}
+			return
+		}
+	}
+	t.Fatalf("net0 missing")
+}
+
+func TestRootfsOption(t *testing.T) {
+	defaults := config.StorageConfig{Rootfs: "tank"}
+	cases := []struct {
+		res  spec.ResourceSpec
+		want string
+	}{
+		{spec.ResourceSpec{}, ""},
+		{spec.ResourceSpec{RootfsSizeGB: 16}, "tank:16"},
+		{spec.ResourceSpec{RootfsStorage: "local-lvm", RootfsSizeGB: 16}, "local-lvm:16"},
+		{spec.ResourceSpec{RootfsStorage: "local-lvm"}, "local-lvm:4"},
+	}
+	for _, tc := range cases {
+		if got := rootfsOption(tc.res, defaults); got != tc.want {
+			t.Errorf("rootfsOption(%+v) = %q, want %q", tc.res, got, tc.want)
+		}
+	}
+	if got := rootfsOption(spec.ResourceSpec{RootfsSizeGB: 8}, config.StorageConfig{}); got != "local:8" {
+		t.Errorf("expected fallback to local storage, got %q", got)
+	}
+}
+
+func TestCreateOptionsUsesNodeDefaultStorage(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	for _, opt := range createOptions(svc, "", "", config.StorageConfig{Rootfs: "tank"}) {
+		if opt.key == "storage" && opt.value == "tank" {
+			return
+		}
+	}
+	t.Fatalf("expected --storage tank")
+}
+
+func TestMarkersRoundTrip(t *testing.T) {
+	m := Markers{Service: "composer", Image: "ghcr.io/haasonsaas/composer:main", Digest: "sha256:abc", SpecHash: "0123456789abcdef", InitHash: "fedcba9876543210"}
+	got, ok := parseMarkers(m.Description())
+	if !ok || got != m {
+		t.Fatalf("round trip = %+v, %v; want %+v", got, ok, m)
+	}
+	if _, ok := parseMarkers("hand-made container digest=sha256:abc"); ok {
+		t.Fatalf("description without managed-by must not count as managed")
+	}
+}
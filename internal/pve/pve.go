@@ -6,35 +6,87 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/haasonsaas/pve-oci-operator/internal/config"
 	"github.com/haasonsaas/pve-oci-operator/internal/spec"
 	"github.com/haasonsaas/pve-oci-operator/internal/state"
 )
 
 type Client interface {
 	GetContainer(ctx context.Context, node string, ctid int) (ActualState, error)
-	CreateContainer(ctx context.Context, svc spec.ServiceSpec, digest string) error
+	CreateContainer(ctx context.Context, svc spec.ServiceSpec, digest, template string) error
 	StopContainer(ctx context.Context, node string, ctid int) error
 	StartContainer(ctx context.Context, node string, ctid int) error
 	DestroyContainer(ctx context.Context, node string, ctid int) error
+	// UpdateContainer applies changes to an existing container and refreshes
+	// its markers for svc and digest.
+	UpdateContainer(ctx context.Context, svc spec.ServiceSpec, digest string, changes Changes) error
+	Snapshot(ctx context.Context, node string, ctid int, name string) error
+	RollbackSnapshot(ctx context.Context, node string, ctid int, name string) error
+	DeleteSnapshot(ctx context.Context, node string, ctid int, name string) error
+	ListSnapshots(ctx context.Context, node string, ctid int) ([]Snapshot, error)
+	// CloneContainer makes a full copy of ctid as newID, from snapshot when
+	// it is set and from the current state otherwise.
+	CloneContainer(ctx context.Context, node string, ctid, newID int, snapshot string) error
+	// Backup runs vzdump for the container and returns once the archive is
+	// written.
+	Backup(ctx context.Context, node string, ctid int, backup spec.BackupSpec) error
+	// ListManaged returns the containers that carry the operator's markers.
+	ListManaged(ctx context.Context) ([]ActualState, error)
 }
 
+// ActualState is what the operator observes about a container. The
+// deployment fields come from the markers written into the container's
+// description, falling back to the local state store for containers that
+// predate them.
 type ActualState struct {
 	Exists        bool
 	CTID          int
 	Node          string
 	CurrentDigest string
 	Status        string
+	Managed       bool
+	Service       string
+	Image         string
+	SpecHash      string
+	InitHash      string
+	// Config is the live container configuration as key/value strings.
+	Config map[string]string
 }
 
 type CLIClient struct {
-	pctPath string
-	store   state.Store
-	dryRun  bool
+	pctPath    string
+	vzdumpPath string
+	store      state.Store
+
+	taskTimeout  time.Duration
+	pollInterval time.Duration
+	storage      config.StorageResolver
+}
+
+func NewCLIClient(pctPath string, store state.Store) *CLIClient {
+	return &CLIClient{pctPath: pctPath, store: store}
+}
+
+// WithTaskTimeout bounds how long the client waits for a container to settle
+// after a pct command returns.
+func (c *CLIClient) WithTaskTimeout(timeout time.Duration) *CLIClient {
+	c.taskTimeout = timeout
+	return c
+}
+
+// WithStorage sets the per-node storage defaults used for specs that do not
+// name a rootfs storage.
+func (c *CLIClient) WithStorage(storage config.StorageResolver) *CLIClient {
+	c.storage = storage
+	return c
 }
 
-func NewCLIClient(pctPath string, store state.Store, dryRun bool) *CLIClient {
-	return &CLIClient{pctPath: pctPath, store: store, dryRun: dryRun}
+// WithVzdumpPath sets the vzdump binary used for backups.
+func (c *CLIClient) WithVzdumpPath(path string) *CLIClient {
+	c.vzdumpPath = path
+	return c
 }
 
 func (c *CLIClient) GetContainer(ctx context.Context, node string, ctid int) (ActualState, error) {
@@ -48,72 +100,115 @@ func (c *CLIClient) GetContainer(ctx context.Context, node string, ctid int) (Ac
 	}
 	actual.Exists = true
 	actual.Status = parseStatus(out)
-	entry, ok, err := c.store.Load(ctid)
+	out, err = c.run(ctx, "config", strconv.Itoa(ctid))
 	if err != nil {
 		return actual, err
 	}
-	if ok {
-		actual.CurrentDigest = entry.Digest
+	if applyConfig(&actual, parseConfig(out)) {
+		return actual, nil
 	}
-	return actual, nil
+	return actual, digestFromStore(c.store, &actual)
 }
 
-func (c *CLIClient) CreateContainer(ctx context.Context, svc spec.ServiceSpec, digest string) error {
-	if c.dryRun {
-		return c.store.Save(state.Entry{CTID: svc.Spec.CTID, Digest: digest, Status: "running", Node: svc.Spec.Node})
-	}
-	args := []string{
-		"create",
-		strconv.Itoa(svc.Spec.CTID),
-		fmt.Sprintf("%s@%s", svc.Spec.Image, digest),
-		"--hostname", svc.Metadata.Name,
-		"--cores", strconv.Itoa(svc.Spec.Resources.Cores),
-		"--memory", strconv.Itoa(svc.Spec.Resources.MemoryMB),
-	}
-	if svc.Spec.Network.Bridge != "" {
-		args = append(args, "--net0", fmt.Sprintf("name=%s,ip=%s,gw=%s", svc.Spec.Network.Bridge, svc.Spec.Network.IP, svc.Spec.Network.GW))
+func (c *CLIClient) CreateContainer(ctx context.Context, svc spec.ServiceSpec, digest, template string) error {
+	args := []string{"create", strconv.Itoa(svc.Spec.CTID), ostemplate(svc, digest, template)}
+	for _, opt := range createOptions(svc, digest, template, c.storageFor(svc.Spec.Node)) {
+		args = append(args, "--"+opt.key, opt.value)
 	}
 	if err := c.exec(ctx, args...); err != nil {
 		return err
 	}
-	return c.store.Save(state.Entry{CTID: svc.Spec.CTID, Digest: digest, Status: "stopped", Node: svc.Spec.Node})
+	if err := c.waitUnlocked(ctx, svc.Spec.CTID); err != nil {
+		return err
+	}
+	return recordCreate(c.store, svc, digest, template, "stopped")
 }
 
 func (c *CLIClient) StopContainer(ctx context.Context, _ string, ctid int) error {
-	if c.dryRun {
-		entry, ok, err := c.store.Load(ctid)
-		if err != nil {
-			return err
-		}
-		if ok {
-			entry.Status = "stopped"
-			return c.store.Save(entry)
-		}
-		return nil
+	if err := c.exec(ctx, "stop", strconv.Itoa(ctid)); err != nil {
+		return err
 	}
-	return c.exec(ctx, "stop", strconv.Itoa(ctid))
+	return c.waitStatus(ctx, ctid, "stopped")
 }
 
 func (c *CLIClient) StartContainer(ctx context.Context, _ string, ctid int) error {
-	if c.dryRun {
-		entry, ok, err := c.store.Load(ctid)
+	if err := c.exec(ctx, "start", strconv.Itoa(ctid)); err != nil {
+		return err
+	}
+	return c.waitStatus(ctx, ctid, "running")
+}
+
+func (c *CLIClient) DestroyContainer(ctx context.Context, _ string, ctid int) error {
+	if err := c.exec(ctx, "destroy", strconv.Itoa(ctid)); err != nil {
+		return err
+	}
+	return c.waitStatus(ctx, ctid, "")
+}
+
+func (c *CLIClient) UpdateContainer(ctx context.Context, svc spec.ServiceSpec, digest string, changes Changes) error {
+	args := []string{"set", strconv.Itoa(svc.Spec.CTID), "--description", markersFor(svc, digest).Description()}
+	var deletes []string
+	for _, change := range changes {
+		if change.To == "" {
+			deletes = append(deletes, change.Key)
+			continue
+		}
+		args = append(args, "--"+change.Key, change.To)
+	}
+	if len(deletes) > 0 {
+		args = append(args, "--delete", strings.Join(deletes, ","))
+	}
+	return c.exec(ctx, args...)
+}
+
+// waitStatus polls pct status until the container reports want. An empty want
+// waits for the container to disappear.
+func (c *CLIClient) waitStatus(ctx context.Context, ctid int, want string) error {
+	ctx, cancel := withTaskTimeout(ctx, c.taskTimeout)
+	defer cancel()
+	var last string
+	err := poll(ctx, c.pollInterval, func() (bool, error) {
+		out, err := c.run(ctx, "status", strconv.Itoa(ctid))
 		if err != nil {
-			return err
+			if want == "" && strings.Contains(err.Error(), "does not exist") {
+				return true, nil
+			}
+			return false, err
 		}
-		if ok {
-			entry.Status = "running"
-			return c.store.Save(entry)
+		last = parseStatus(out)
+		return last == want, nil
+	})
+	if err != nil {
+		return fmt.Errorf("wait for ct %d to become %q (last %q): %w", ctid, want, last, err)
+	}
+	return nil
+}
+
+// waitUnlocked polls pct config until no lock (create, backup, ...) is held
+// on the container any more.
+func (c *CLIClient) waitUnlocked(ctx context.Context, ctid int) error {
+	ctx, cancel := withTaskTimeout(ctx, c.taskTimeout)
+	defer cancel()
+	var lock string
+	err := poll(ctx, c.pollInterval, func() (bool, error) {
+		out, err := c.run(ctx, "config", strconv.Itoa(ctid))
+		if err != nil {
+			return false, err
 		}
-		return nil
+		lock = parseConfig(out)["lock"]
+		return lock == "", nil
+	})
+	if err != nil {
+		return fmt.Errorf("wait for ct %d to be unlocked (lock %q): %w", ctid, lock, err)
 	}
-	return c.exec(ctx, "start", strconv.Itoa(ctid))
+	return nil
 }
 
-func (c *CLIClient) DestroyContainer(ctx context.Context, _ string, ctid int) error {
-	if c.dryRun {
-		return c.store.Remove(ctid)
+func (c *CLIClient) storageFor(node string) config.StorageConfig {
+	if c.storage == nil {
+		return config.StorageConfig{}
 	}
-	return c.exec(ctx, "destroy", strconv.Itoa(ctid))
+	return c.storage(node)
 }
 
 func (c *CLIClient) exec(ctx context.Context, args ...string) error {
@@ -130,6 +225,45 @@ func (c *CLIClient) run(ctx context.Context, args ...string) (string, error) {
 	return string(out), nil
 }
 
+// digestFromStore fills CurrentDigest from the local store for containers
+// without markers.
+func digestFromStore(store state.Store, actual *ActualState) error {
+	entry, ok, err := store.Load(actual.CTID)
+	if err != nil {
+		return err
+	}
+	if ok {
+		actual.CurrentDigest = entry.Digest
+	}
+	return nil
+}
+
+// recordCreate saves the state of a freshly created container, keeping the
+// template history of the CTID it replaces.
+func recordCreate(store state.Store, svc spec.ServiceSpec, digest, template, status string) error {
+	return store.Update(svc.Spec.CTID, func(entry *state.Entry, _ bool) error {
+		entry.Service = svc.Metadata.Name
+		entry.Digest = digest
+		entry.Status = status
+		entry.Node = svc.Spec.Node
+		entry.SetTemplate(template)
+		return nil
+	})
+}
+
+// parseConfig reads the "key: value" lines printed by pct config.
+func parseConfig(out string) map[string]string {
+	cfg := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		cfg[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return cfg
+}
+
 func parseStatus(out string) string {
 	parts := strings.Split(strings.TrimSpace(out), ":")
 	if len(parts) == 2 {
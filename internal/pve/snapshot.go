@@ -0,0 +1,167 @@
+package pve
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+// Snapshot is a container snapshot. The implicit "current" entry Proxmox
+// lists is left out.
+type Snapshot struct {
+	Name        string
+	Description string
+	Time        time.Time
+}
+
+const snapshotTimeLayout = "2006-01-02 15:04:05"
+
+func (c *CLIClient) Snapshot(ctx context.Context, _ string, ctid int, name string) error {
+	if err := c.exec(ctx, "snapshot", strconv.Itoa(ctid), name, "--description", "taken by "+ManagedBy); err != nil {
+		return err
+	}
+	return c.waitUnlocked(ctx, ctid)
+}
+
+func (c *CLIClient) RollbackSnapshot(ctx context.Context, _ string, ctid int, name string) error {
+	if err := c.exec(ctx, "rollback", strconv.Itoa(ctid), name); err != nil {
+		return err
+	}
+	return c.waitUnlocked(ctx, ctid)
+}
+
+func (c *CLIClient) DeleteSnapshot(ctx context.Context, _ string, ctid int, name string) error {
+	if err := c.exec(ctx, "delsnapshot", strconv.Itoa(ctid), name); err != nil {
+		return err
+	}
+	return c.waitUnlocked(ctx, ctid)
+}
+
+func (c *CLIClient) ListSnapshots(ctx context.Context, _ string, ctid int) ([]Snapshot, error) {
+	out, err := c.run(ctx, "listsnapshot", strconv.Itoa(ctid))
+	if err != nil {
+		return nil, err
+	}
+	return parseSnapshots(out), nil
+}
+
+func (c *CLIClient) CloneContainer(ctx context.Context, _ string, ctid, newID int, snapshot string) error {
+	args := []string{"clone", strconv.Itoa(ctid), strconv.Itoa(newID), "--full", "1"}
+	if snapshot != "" {
+		args = append(args, "--snapname", snapshot)
+	}
+	if err := c.exec(ctx, args...); err != nil {
+		return err
+	}
+	if err := c.waitUnlocked(ctx, newID); err != nil {
+		return err
+	}
+	return recordClone(c.store, ctid, newID)
+}
+
+func (c *APIClient) Snapshot(ctx context.Context, node string, ctid int, name string) error {
+	form := url.Values{}
+	form.Set("snapname", name)
+	form.Set("description", "taken by "+ManagedBy)
+	return c.task(ctx, http.MethodPost, lxcPath(node, ctid)+"/snapshot", form)
+}
+
+func (c *APIClient) RollbackSnapshot(ctx context.Context, node string, ctid int, name string) error {
+	return c.task(ctx, http.MethodPost, snapshotPath(node, ctid, name)+"/rollback", url.Values{})
+}
+
+func (c *APIClient) DeleteSnapshot(ctx context.Context, node string, ctid int, name string) error {
+	return c.task(ctx, http.MethodDelete, snapshotPath(node, ctid, name), nil)
+}
+
+func (c *APIClient) ListSnapshots(ctx context.Context, node string, ctid int) ([]Snapshot, error) {
+	var raw []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		SnapTime    int64  `json:"snaptime"`
+	}
+	if err := c.do(ctx, http.MethodGet, lxcPath(node, ctid)+"/snapshot", nil, &raw); err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, s := range raw {
+		if s.Name == "current" {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Name: s.Name, Description: s.Description, Time: time.Unix(s.SnapTime, 0)})
+	}
+	sortSnapshots(snapshots)
+	return snapshots, nil
+}
+
+func (c *APIClient) CloneContainer(ctx context.Context, node string, ctid, newID int, snapshot string) error {
+	form := url.Values{}
+	form.Set("newid", strconv.Itoa(newID))
+	form.Set("full", "1")
+	if snapshot != "" {
+		form.Set("snapname", snapshot)
+	}
+	if err := c.task(ctx, http.MethodPost, lxcPath(node, ctid)+"/clone", form); err != nil {
+		return err
+	}
+	return recordClone(c.store, ctid, newID)
+}
+
+func snapshotPath(node string, ctid int, name string) string {
+	return lxcPath(node, ctid) + "/snapshot/" + url.PathEscape(name)
+}
+
+// parseSnapshots reads the tree printed by pct listsnapshot:
+//
+//	`-> pveoci-20240101-120000 2024-01-01 12:00:00     taken by pve-oci-operator
+//	    `-> current                                    You are here!
+func parseSnapshots(out string) []Snapshot {
+	var snapshots []Snapshot
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimLeft(line, " `->|")
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "current" {
+			continue
+		}
+		snap := Snapshot{Name: fields[0]}
+		rest := fields[1:]
+		if len(rest) >= 2 {
+			if t, err := time.ParseInLocation(snapshotTimeLayout, rest[0]+" "+rest[1], time.Local); err == nil {
+				snap.Time = t
+				rest = rest[2:]
+			}
+		}
+		snap.Description = strings.Join(rest, " ")
+		snapshots = append(snapshots, snap)
+	}
+	sortSnapshots(snapshots)
+	return snapshots
+}
+
+// sortSnapshots orders snapshots oldest first.
+func sortSnapshots(snapshots []Snapshot) {
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+}
+
+// recordClone copies the deployment state of ctid to newID, keeping the
+// template history newID already has.
+func recordClone(store state.Store, ctid, newID int) error {
+	src, ok, err := store.Load(ctid)
+	if err != nil || !ok {
+		return err
+	}
+	return store.Update(newID, func(dst *state.Entry, _ bool) error {
+		dst.Service = src.Service
+		dst.Digest = src.Digest
+		dst.Status = "stopped"
+		dst.Node = src.Node
+		dst.SetTemplate(src.Template)
+		return nil
+	})
+}
@@ -0,0 +1,19 @@
+package pve
+
+import "testing"
+
+func TestParseSnapshots(t *testing.T) {
+	out := "`-> manual                  2024-03-02 08:00:00     before upgrade\n" +
+		"    `-> pveoci-20240101-120000 2024-01-01 12:00:00     taken by pve-oci-operator\n" +
+		"        `-> current                                    You are here!\n"
+	snapshots := parseSnapshots(out)
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots, got %+v", snapshots)
+	}
+	if snapshots[0].Name != "pveoci-20240101-120000" || snapshots[1].Name != "manual" {
+		t.Fatalf("expected oldest first, got %+v", snapshots)
+	}
+	if snapshots[1].Description != "before upgrade" || snapshots[1].Time.Hour() != 8 {
+		t.Fatalf("unexpected snapshot %+v", snapshots[1])
+	}
+}
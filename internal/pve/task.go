@@ -0,0 +1,149 @@
+package pve
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTaskTimeout  = 10 * time.Minute
+	defaultPollInterval = time.Second
+	taskLogTail         = 20
+)
+
+// TaskError reports a Proxmox task that finished with a non-OK exit status.
+// Log carries the tail of the task log so the cause ends up in our logs.
+type TaskError struct {
+	UPID       string
+	ExitStatus string
+	Log        []string
+}
+
+func (e *TaskError) Error() string {
+	msg := fmt.Sprintf("task %s failed: %s", e.UPID, e.ExitStatus)
+	if len(e.Log) > 0 {
+		msg += ": " + strings.Join(e.Log, "; ")
+	}
+	return msg
+}
+
+type taskStatus struct {
+	Status     string `json:"status"`
+	ExitStatus string `json:"exitstatus"`
+}
+
+type taskLogLine struct {
+	N int    `json:"n"`
+	T string `json:"t"`
+}
+
+// UPIDNode returns the node a task runs on. UPIDs look like
+// UPID:node:pid:pstart:starttime:type:id:user:.
+func UPIDNode(upid string) (string, error) {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 3 || parts[0] != "UPID" || parts[1] == "" {
+		return "", fmt.Errorf("malformed task id %q", upid)
+	}
+	return parts[1], nil
+}
+
+// taskOK reports whether a finished task's exit status means success.
+// Proxmox uses "OK" and "WARNINGS: n" for tasks that completed.
+func taskOK(exitStatus string) bool {
+	return exitStatus == "OK" || strings.HasPrefix(exitStatus, "WARNINGS")
+}
+
+// withTaskTimeout bounds ctx by timeout unless the caller already set a
+// tighter deadline.
+func withTaskTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultTaskTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// poll calls done every interval until it reports completion, returns an
+// error, or ctx ends.
+func poll(ctx context.Context, interval time.Duration, done func() (bool, error)) error {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitTask blocks until the task identified by upid has stopped and returns
+// a *TaskError when it did not finish successfully.
+func (c *APIClient) waitTask(ctx context.Context, upid string) error {
+	node, err := UPIDNode(upid)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTaskTimeout(ctx, c.taskTimeout)
+	defer cancel()
+	path := fmt.Sprintf("/nodes/%s/tasks/%s", url.PathEscape(node), url.PathEscape(upid))
+	var status taskStatus
+	err = poll(ctx, c.pollInterval, func() (bool, error) {
+		if err := c.do(ctx, http.MethodGet, path+"/status", nil, &status); err != nil {
+			return false, err
+		}
+		return status.Status == "stopped", nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			// ctx is done, so fetch the log with a fresh short deadline.
+			logCtx, logCancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer logCancel()
+			lines := c.taskLog(logCtx, path)
+			if len(lines) > 0 {
+				return fmt.Errorf("wait for task %s: %w: %s", upid, err, strings.Join(lines, "; "))
+			}
+		}
+		return fmt.Errorf("wait for task %s: %w", upid, err)
+	}
+	if taskOK(status.ExitStatus) {
+		return nil
+	}
+	return &TaskError{UPID: upid, ExitStatus: status.ExitStatus, Log: c.taskLog(ctx, path)}
+}
+
+// taskLog returns the last lines of a task log; failures to fetch it are not
+// interesting enough to mask the task error itself.
+func (c *APIClient) taskLog(ctx context.Context, path string) []string {
+	var lines []taskLogLine
+	query := url.Values{"start": {"0"}, "limit": {"500"}}
+	if err := c.do(ctx, http.MethodGet, path+"/log", query, &lines); err != nil {
+		return nil
+	}
+	var out []string
+	for _, line := range lines {
+		if text := strings.TrimSpace(line.T); text != "" && text != "TASK OK" {
+			out = append(out, text)
+		}
+	}
+	if len(out) > taskLogTail {
+		out = out[len(out)-taskLogTail:]
+	}
+	return out
+}
@@ -0,0 +1,264 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/pve"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+func isBlueGreen(svc spec.ServiceSpec) bool {
+	return strings.EqualFold(svc.Spec.Rollout.Strategy, "bluegreen")
+}
+
+// activeSlot points svc at the member of its blue/green pool that currently
+// serves the service: a running container of the service if there is one,
+// otherwise any existing one, otherwise spec.ctid. Ties go to pool order.
+func (r *Reconciler) activeSlot(ctx context.Context, svc spec.ServiceSpec) (spec.ServiceSpec, error) {
+	var existing []int
+	for _, ctid := range svc.Spec.Rollout.BlueGreen.CTIDs {
+		actual, err := r.PVE.GetContainer(ctx, svc.Spec.Node, ctid)
+		if err != nil {
+			return svc, err
+		}
+		if !actual.Exists {
+			continue
+		}
+		if err := poolMember(ctid, actual); err != nil {
+			return svc, err
+		}
+		if actual.Service != svc.Metadata.Name {
+			continue
+		}
+		if actual.Status == "running" {
+			svc.Spec.CTID = ctid
+			return svc, nil
+		}
+		existing = append(existing, ctid)
+	}
+	if len(existing) > 0 {
+		svc.Spec.CTID = existing[0]
+	}
+	return svc, nil
+}
+
+// standbySlot picks the pool member the next version is deployed into,
+// preferring one that does not exist yet.
+func (r *Reconciler) standbySlot(ctx context.Context, svc spec.ServiceSpec) (pve.ActualState, error) {
+	var fallback *pve.ActualState
+	for _, ctid := range svc.Spec.Rollout.BlueGreen.CTIDs {
+		if ctid == svc.Spec.CTID {
+			continue
+		}
+		actual, err := r.PVE.GetContainer(ctx, svc.Spec.Node, ctid)
+		if err != nil {
+			return actual, err
+		}
+		if !actual.Exists {
+			return actual, nil
+		}
+		if err := poolMember(ctid, actual); err != nil {
+			return actual, err
+		}
+		if actual.Service != svc.Metadata.Name {
+			continue
+		}
+		if fallback == nil {
+			fallback = &actual
+		}
+	}
+	if fallback == nil {
+		return pve.ActualState{}, fmt.Errorf("no free standby ctid in %v", svc.Spec.Rollout.BlueGreen.CTIDs)
+	}
+	return *fallback, nil
+}
+
+// poolMember refuses a container in the blue/green pool that the operator
+// did not create, since taking it for a slot would stop or destroy it.
+func poolMember(ctid int, actual pve.ActualState) error {
+	if actual.Managed {
+		return nil
+	}
+	return classified(ClassInvalidSpec, fmt.Errorf("ct %d in spec.rollout.blueGreen.ctids holds a container the operator does not manage", ctid))
+}
+
+// previewSpec is svc as deployed into the standby slot before the switch.
+// Its health check runs against PreviewURL or, failing that, the regular
+// health URL moved to the preview address, so that the active container
+// cannot answer it.
+func previewSpec(svc spec.ServiceSpec, ctid int) spec.ServiceSpec {
+	bg := svc.Spec.Rollout.BlueGreen
+	svc.Spec.CTID = ctid
+	if bg.PreviewIP != "" {
+		active := svc.Spec.Network.IP
+		if len(svc.Spec.Network.Interfaces) > 0 {
+			active = svc.Spec.Network.Interfaces[0].IP
+			svc.Spec.Network.Interfaces = slices.Clone(svc.Spec.Network.Interfaces)
+			svc.Spec.Network.Interfaces[0].IP = bg.PreviewIP
+		} else {
+			svc.Spec.Network.IP = bg.PreviewIP
+		}
+		if activeHost, _, ok := strings.Cut(active, "/"); ok {
+			previewHost, _, _ := strings.Cut(bg.PreviewIP, "/")
+			svc.Spec.Health.URL = strings.ReplaceAll(svc.Spec.Health.URL, activeHost, previewHost)
+		}
+	}
+	if bg.PreviewURL != "" {
+		svc.Spec.Health.URL = svc.Substitute(bg.PreviewURL)
+	}
+	return svc
+}
+
+// blueGreen deploys digest into a standby CTID and moves the service over
+// once it is healthy. The old container is only stopped until the switch has
+// passed its health check, so switching back is a start away.
+func (r *Reconciler) blueGreen(ctx context.Context, svc spec.ServiceSpec, _ pve.ActualState, digest string) error {
+	standby, err := r.standbySlot(ctx, svc)
+	if err != nil {
+		return err
+	}
+	preview := previewSpec(svc, standby.CTID)
+	if standby.Exists {
+		r.Logger.Warn("replacing leftover standby container", "service", svc.Metadata.Name, "ctid", standby.CTID)
+		if err := r.discard(ctx, preview, standby.Status); err != nil {
+			return err
+		}
+	}
+	r.Logger.Info("deploying standby", "service", svc.Metadata.Name, "ctid", standby.CTID, "digest", digest)
+	if err := r.deployFresh(ctx, preview, digest); err != nil {
+		// The active container was never touched.
+		return errors.Join(err, r.discard(ctx, preview, ""))
+	}
+	next := svc
+	next.Spec.CTID = standby.CTID
+	r.Logger.Info("switching over", "service", svc.Metadata.Name, "from", svc.Spec.CTID, "to", next.Spec.CTID)
+	if err := r.switchOver(ctx, svc, next, digest); err != nil {
+		// The old container may already have handed over its address, so
+		// it is brought back either way. Without autoRollback the failed
+		// standby is only stopped, to be looked at.
+		keep := !svc.Spec.Rollout.AutoRollback
+		r.Logger.Error("switch failed, switching back", "service", svc.Metadata.Name, "ctid", svc.Spec.CTID, "keepStandby", keep, "error", err)
+		return rolledBack(err, r.switchBack(ctx, svc, next, keep))
+	}
+	if err := r.backup(ctx, svc); err != nil {
+		return err
+	}
+	return r.discard(ctx, svc, "")
+}
+
+// switchOver moves the service identity from the active container to next:
+// the old container releases the service address, next takes it over and
+// the switch command is told about the new container.
+func (r *Reconciler) switchOver(ctx context.Context, active, next spec.ServiceSpec, digest string) error {
+	if active.Spec.Rollout.BlueGreen.PreviewIP != "" {
+		if err := r.PVE.StopContainer(ctx, active.Spec.Node, active.Spec.CTID); err != nil {
+			return err
+		}
+	}
+	// Writing next's markers (and address) makes it the deployed spec.
+	actual, err := r.PVE.GetContainer(ctx, next.Spec.Node, next.Spec.CTID)
+	if err != nil {
+		return err
+	}
+	changes := pve.Diff(next, actual)
+	if err := r.PVE.UpdateContainer(ctx, next, digest, changes); err != nil {
+		return err
+	}
+	if changes.Requires(pve.ActionRestart) {
+		if err := r.restart(ctx, next); err != nil {
+			return err
+		}
+	}
+	if err := r.runSwitchCommand(ctx, next, active.Spec.CTID); err != nil {
+		return err
+	}
+	if err := r.waitHealthy(ctx, next); err != nil {
+		return err
+	}
+	if active.Spec.Rollout.BlueGreen.PreviewIP == "" {
+		return r.PVE.StopContainer(ctx, active.Spec.Node, active.Spec.CTID)
+	}
+	return nil
+}
+
+// switchBack returns the service to the previous container and throws the
+// failed one away, or with keep only stops it.
+func (r *Reconciler) switchBack(ctx context.Context, previous, failed spec.ServiceSpec, keep bool) error {
+	if !keep {
+		if err := r.discard(ctx, failed, ""); err != nil {
+			return err
+		}
+	} else if err := r.stopRunning(ctx, failed); err != nil {
+		return err
+	}
+	actual, err := r.PVE.GetContainer(ctx, previous.Spec.Node, previous.Spec.CTID)
+	if err != nil {
+		return err
+	}
+	if actual.Status != "running" {
+		if err := r.PVE.StartContainer(ctx, previous.Spec.Node, previous.Spec.CTID); err != nil {
+			return err
+		}
+	}
+	if err := r.runSwitchCommand(ctx, previous, failed.Spec.CTID); err != nil {
+		return err
+	}
+	return r.waitHealthy(ctx, previous)
+}
+
+// stopRunning stops the container of svc if it runs.
+func (r *Reconciler) stopRunning(ctx context.Context, svc spec.ServiceSpec) error {
+	actual, err := r.PVE.GetContainer(ctx, svc.Spec.Node, svc.Spec.CTID)
+	if err != nil || actual.Status != "running" {
+		return err
+	}
+	return r.PVE.StopContainer(ctx, svc.Spec.Node, svc.Spec.CTID)
+}
+
+// discard stops (when status says it runs) and destroys the container of
+// svc. An empty status means unknown.
+func (r *Reconciler) discard(ctx context.Context, svc spec.ServiceSpec, status string) error {
+	if status == "" {
+		actual, err := r.PVE.GetContainer(ctx, svc.Spec.Node, svc.Spec.CTID)
+		if err != nil {
+			return err
+		}
+		if !actual.Exists {
+			return nil
+		}
+		status = actual.Status
+	}
+	if status == "running" {
+		if err := r.PVE.StopContainer(ctx, svc.Spec.Node, svc.Spec.CTID); err != nil {
+			return err
+		}
+	}
+	return r.PVE.DestroyContainer(ctx, svc.Spec.Node, svc.Spec.CTID)
+}
+
+// runSwitchCommand tells the outside world (a proxy, DNS, ...) which
+// container now serves the service.
+func (r *Reconciler) runSwitchCommand(ctx context.Context, svc spec.ServiceSpec, previous int) error {
+	command := svc.Spec.Rollout.BlueGreen.SwitchCommand
+	if len(command) == 0 {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"PVE_OCI_SERVICE="+svc.Metadata.Name,
+		"PVE_OCI_NODE="+svc.Spec.Node,
+		"PVE_OCI_CTID="+strconv.Itoa(svc.Spec.CTID),
+		"PVE_OCI_PREVIOUS_CTID="+strconv.Itoa(previous),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("switch command %v: %w: %s", command, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// canary moves outdated replicas to digest following the canary steps;
+// current are the replicas already running digest. After each step every
+// replica on digest bakes while the analysis watches it; a failed
+// replacement or analysis halts the rollout and, with autoRollback, returns
+// every touched replica to its previous digest.
+func (r *Reconciler) canary(ctx context.Context, outdated []replica, current []spec.ServiceSpec, digest string) error {
+	svc := outdated[0].svc
+	total := len(current) + len(outdated)
+	updated := len(current)
+	next := 0
+	fail := func(err error) error {
+		if !svc.Spec.Rollout.AutoRollback {
+			return err
+		}
+		r.Logger.Error("canary failed, rolling back", "service", svc.Metadata.Name, "error", err)
+		return rolledBack(err, r.rollBackReplicas(ctx, outdated[:next]))
+	}
+	advance := func() error {
+		rep := outdated[next]
+		next++
+		updated++
+		if err := r.recreate(ctx, rep.svc, rep.actual, digest); err != nil {
+			return fail(fmt.Errorf("replace ct %d: %w", rep.svc.Spec.CTID, err))
+		}
+		return nil
+	}
+	for i, step := range svc.Spec.Rollout.Canary.Steps {
+		for next < len(outdated) && updated < step.Target(total) {
+			if err := advance(); err != nil {
+				return err
+			}
+		}
+		canaries := slices.Clone(current)
+		for _, rep := range outdated[:next] {
+			canaries = append(canaries, rep.svc)
+		}
+		r.Logger.Info("canary step", "service", svc.Metadata.Name, "step", i+1, "updated", updated, "replicas", total, "pause", step.Pause())
+		if err := r.analyze(ctx, canaries, step.Pause()); err != nil {
+			return fail(err)
+		}
+	}
+	for next < len(outdated) {
+		if err := advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyze bakes the canaries, judged by the Analyzer when one is set. A
+// failed analysis counts as unhealthy. Without canaries it only waits out
+// bake.
+func (r *Reconciler) analyze(ctx context.Context, canaries []spec.ServiceSpec, bake time.Duration) error {
+	if r.Analyzer != nil && len(canaries) > 0 {
+		return classified(ClassUnhealthy, r.Analyzer.Analyze(ctx, canaries, bake))
+	}
+	timer := time.NewTimer(bake)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,73 @@
+package reconciler
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrorClass groups reconcile failures by how they should be retried.
+type ErrorClass string
+
+const (
+	// ClassTransient covers registry, network and other failures that may
+	// go away on their own.
+	ClassTransient ErrorClass = "transient"
+	// ClassLocked means Proxmox held a lock on the container, for example
+	// during a backup.
+	ClassLocked ErrorClass = "locked"
+	// ClassInvalidSpec means the spec cannot be acted on as written.
+	ClassInvalidSpec ErrorClass = "invalid-spec"
+	// ClassUnhealthy means a container failed its health check.
+	ClassUnhealthy ErrorClass = "unhealthy"
+	// ClassRolledBack means a failed rollout was undone. The next plan holds
+	// the digest it tried until the digest or the spec changes.
+	ClassRolledBack ErrorClass = "rolled-back"
+	// ClassRollbackFailed means undoing a failed rollout failed as well, so
+	// the service is in an unknown state.
+	ClassRollbackFailed ErrorClass = "rollback-failed"
+)
+
+// Permanent reports whether retrying without a spec change is pointless.
+func (c ErrorClass) Permanent() bool {
+	return c == ClassInvalidSpec || c == ClassRollbackFailed
+}
+
+// Error is a reconcile failure with its class.
+type Error struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func classified(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Class: class, Err: err}
+}
+
+// Classify returns the class of err. Errors the reconciler did not classify
+// are transient unless Proxmox reported a lock.
+func Classify(err error) ErrorClass {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "locked") || strings.Contains(msg, "can't lock") {
+		return ClassLocked
+	}
+	return ClassTransient
+}
+
+// rolledBack joins a rollout failure with the result of undoing it. When the
+// undo fails too the error is classed as a failed rollback.
+func rolledBack(err, undoErr error) error {
+	if undoErr == nil {
+		return &Error{Class: ClassRolledBack, Err: err}
+	}
+	return &Error{Class: ClassRollbackFailed, Err: errors.Join(err, undoErr)}
+}
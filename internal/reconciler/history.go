@@ -0,0 +1,93 @@
+package reconciler
+
+import (
+	"fmt"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+// pin returns the rollback pin holding svc, or a zero Pin when there is none
+// or the spec changed since it was set.
+func (r *Reconciler) pin(svc spec.ServiceSpec) (state.Pin, error) {
+	if r.History == nil {
+		return state.Pin{}, nil
+	}
+	history, err := r.History.LoadHistory(svc.Metadata.Name)
+	if err != nil {
+		return state.Pin{}, err
+	}
+	if history.Pin == nil || history.Pin.SpecHash != svc.Hash() {
+		return state.Pin{}, nil
+	}
+	return *history.Pin, nil
+}
+
+// rolledBackReason says why changing svc to digest waits: its latest
+// revision tried the same digest and spec and was rolled back. It returns ""
+// once the digest or the spec moved on.
+func (r *Reconciler) rolledBackReason(svc spec.ServiceSpec, digest string) (string, error) {
+	if r.History == nil {
+		return "", nil
+	}
+	history, err := r.History.LoadHistory(svc.Metadata.Name)
+	if err != nil || len(history.Revisions) == 0 {
+		return "", err
+	}
+	last := history.Revisions[len(history.Revisions)-1]
+	if !last.RolledBack || last.Digest != digest || last.SpecHash != svc.Hash() {
+		return "", nil
+	}
+	return fmt.Sprintf("revision %d was rolled back; waiting for a new digest or spec change", last.ID), nil
+}
+
+// recordRevision adds the outcome of a plan that changed containers to the
+// service's history and clears a pin the spec has moved past.
+func (r *Reconciler) recordRevision(plan Plan, applyErr error) error {
+	if r.History == nil {
+		return nil
+	}
+	trigger := plan.trigger()
+	return r.History.UpdateHistory(plan.Service, func(history *state.History) error {
+		if history.Pin != nil && history.Pin.SpecHash != plan.svc.Hash() {
+			r.Logger.Info("spec changed, clearing rollback pin", "service", plan.Service, "revision", history.Pin.Revision)
+			history.Pin = nil
+		}
+		if trigger == "" {
+			return nil
+		}
+		rev := state.Revision{
+			Digest:   plan.Digest,
+			Tag:      plan.svc.Spec.Tag,
+			SpecHash: plan.svc.Hash(),
+			Time:     r.clock().UTC(),
+			Outcome:  "succeeded",
+			Trigger:  trigger,
+		}
+		if applyErr != nil {
+			rev.Outcome, rev.Error = "failed", applyErr.Error()
+			rev.RolledBack = Classify(applyErr) == ClassRolledBack
+		}
+		rev = history.Add(rev)
+		r.Logger.Info("recorded revision", "service", plan.Service, "revision", rev.ID, "outcome", rev.Outcome)
+		return nil
+	})
+}
+
+// trigger says why applying the plan deploys or changes a container, and is
+// empty when it only starts or stops containers or does nothing.
+func (p Plan) trigger() string {
+	if !p.Changed() {
+		return ""
+	}
+	for _, a := range p.Actions {
+		switch a.Kind {
+		case ActionDeploy, ActionUpdate, ActionRollout:
+			if p.Pinned != 0 {
+				return fmt.Sprintf("rollback to revision %d", p.Pinned)
+			}
+			return a.Reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/pve"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+// OrphanPolicy decides what happens to managed containers that no spec
+// claims any more.
+type OrphanPolicy struct {
+	// Action is keep (the default), stop or destroy. Stop and destroy only
+	// act once the container has been orphaned for GracePeriod, which
+	// destroy requires to be positive.
+	Action      string
+	GracePeriod time.Duration
+	// AutoConfirm destroys orphans without waiting for an operator to
+	// confirm each one.
+	AutoConfirm bool
+}
+
+// Orphans returns the managed containers, found by their markers or in the
+// state store, whose CTID no spec in services claims.
+func (r *Reconciler) Orphans(ctx context.Context, services []spec.ServiceSpec) ([]pve.ActualState, error) {
+	claimed := claimedCTIDs(services)
+	managed, err := r.PVE.ListManaged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool, len(managed))
+	var orphans []pve.ActualState
+	for _, actual := range managed {
+		seen[actual.CTID] = true
+		if !claimed[actual.CTID] {
+			orphans = append(orphans, actual)
+		}
+	}
+	if r.Store != nil {
+		entries, err := r.Store.List()
+		if err != nil {
+			return nil, err
+		}
+		// Containers that predate the markers are only known to the store.
+		for _, entry := range entries {
+			if entry.Service == "" || seen[entry.CTID] || claimed[entry.CTID] {
+				continue
+			}
+			actual, err := r.PVE.GetContainer(ctx, entry.Node, entry.CTID)
+			if err != nil {
+				return nil, err
+			}
+			if actual.Exists {
+				if actual.Service == "" {
+					actual.Service = entry.Service
+				}
+				orphans = append(orphans, actual)
+			}
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].CTID < orphans[j].CTID })
+	return orphans, nil
+}
+
+// HandleOrphans applies policy to every orphaned container and forgets the
+// orphan mark of containers a spec claims again. While rollouts are frozen
+// orphans are only recorded and reported.
+func (r *Reconciler) HandleOrphans(ctx context.Context, services []spec.ServiceSpec, policy OrphanPolicy) error {
+	if r.Store == nil {
+		return nil
+	}
+	if policy.Action == "destroy" && policy.GracePeriod <= 0 {
+		return errors.New("orphan policy destroy needs a positive grace period")
+	}
+	if r.Logger == nil {
+		r.Logger = slog.Default()
+	}
+	claimed := claimedCTIDs(services)
+	entries, err := r.Store.List()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if claimed[entry.CTID] && !entry.OrphanedAt.IsZero() {
+			r.Logger.Info("container is claimed by a spec again", "ctid", entry.CTID, "service", entry.Service)
+			err := r.Store.Update(entry.CTID, func(entry *state.Entry, _ bool) error {
+				entry.OrphanedAt, entry.DestroyConfirmed = time.Time{}, false
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	orphans, err := r.Orphans(ctx, services)
+	if err != nil {
+		return err
+	}
+	frozen, err := r.freezeReason()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, actual := range orphans {
+		errs = append(errs, r.handleOrphan(ctx, actual, policy, frozen))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Reconciler) handleOrphan(ctx context.Context, actual pve.ActualState, policy OrphanPolicy, frozen string) error {
+	action := policy.Action
+	if action == "" {
+		action = "keep"
+	}
+	var entry state.Entry
+	err := r.Store.Update(actual.CTID, func(e *state.Entry, found bool) error {
+		if !found {
+			*e = state.Entry{CTID: actual.CTID, Service: actual.Service, Node: actual.Node, Digest: actual.CurrentDigest, Status: actual.Status}
+		}
+		if e.OrphanedAt.IsZero() {
+			r.Logger.Warn("managed container has no spec", "ctid", actual.CTID, "service", actual.Service, "policy", action, "gracePeriod", policy.GracePeriod)
+			e.OrphanedAt = r.clock().UTC()
+		}
+		entry = *e
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if actual.Node == "" {
+		actual.Node = entry.Node
+	}
+	if action == "keep" || r.clock().Sub(entry.OrphanedAt) < policy.GracePeriod {
+		return nil
+	}
+	if frozen != "" {
+		r.Logger.Info("orphaned container held", "ctid", actual.CTID, "service", actual.Service, "policy", action, "held", frozen)
+		return nil
+	}
+	if r.LockCTID != nil {
+		unlock := r.LockCTID(actual.CTID)
+		defer unlock()
+		// A spec may have taken the container over while it was locked.
+		current, err := r.PVE.GetContainer(ctx, actual.Node, actual.CTID)
+		if err != nil {
+			return err
+		}
+		if !current.Exists || (current.Service != "" && current.Service != actual.Service) {
+			r.Logger.Info("orphaned container changed while waiting for its lock", "ctid", actual.CTID, "service", actual.Service)
+			return nil
+		}
+		actual.Status, actual.Config = current.Status, current.Config
+	}
+	if actual.Status == "running" {
+		r.Logger.Warn("stopping orphaned container", "ctid", actual.CTID, "service", actual.Service)
+		if err := r.PVE.StopContainer(ctx, actual.Node, actual.CTID); err != nil {
+			return err
+		}
+		if action == "destroy" && !entry.DestroyConfirmed && !policy.AutoConfirm {
+			r.Logger.Warn("orphaned container awaits confirmation before it is destroyed", "ctid", actual.CTID, "service", actual.Service)
+		}
+	}
+	if action != "destroy" || (!entry.DestroyConfirmed && !policy.AutoConfirm) {
+		return nil
+	}
+	if actual.Config["protection"] == "1" {
+		r.Logger.Debug("orphaned container is protected, not destroying", "ctid", actual.CTID)
+		return nil
+	}
+	r.Logger.Warn("destroying orphaned container", "ctid", actual.CTID, "service", actual.Service, "orphanedAt", entry.OrphanedAt)
+	if err := r.PVE.DestroyContainer(ctx, actual.Node, actual.CTID); err != nil {
+		return err
+	}
+	return r.Store.Remove(actual.CTID)
+}
+
+// claimedCTIDs collects the CTIDs claimed by any of services.
+func claimedCTIDs(services []spec.ServiceSpec) map[int]bool {
+	claimed := make(map[int]bool)
+	for _, svc := range services {
+		for _, ctid := range svc.ClaimedCTIDs() {
+			claimed[ctid] = true
+		}
+	}
+	return claimed
+}
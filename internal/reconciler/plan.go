@@ -0,0 +1,361 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/pve"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// ActionKind says what a planned action does to a container.
+type ActionKind string
+
+const (
+	// ActionNoop leaves an up-to-date container alone.
+	ActionNoop ActionKind = "noop"
+	// ActionDeploy creates a missing container.
+	ActionDeploy ActionKind = "deploy"
+	// ActionUpdate applies config changes to the existing container.
+	ActionUpdate ActionKind = "update"
+	// ActionRollout replaces the container using the rollout strategy.
+	ActionRollout ActionKind = "rollout"
+	// ActionReportDrift records drift without changing the container.
+	ActionReportDrift ActionKind = "report-drift"
+	// ActionStart starts a stopped container.
+	ActionStart ActionKind = "start"
+	// ActionStop stops the container of a suspended service.
+	ActionStop ActionKind = "stop"
+)
+
+// Action is the planned change for one container of a service.
+type Action struct {
+	Kind     ActionKind  `json:"kind"`
+	CTID     int         `json:"ctid"`
+	Reason   string      `json:"reason"`
+	From     string      `json:"from,omitempty"`
+	To       string      `json:"to,omitempty"`
+	Strategy string      `json:"strategy,omitempty"`
+	Changes  pve.Changes `json:"changes,omitempty"`
+	// Drift lists differences made outside the operator.
+	Drift pve.Changes `json:"drift,omitempty"`
+	// Held says why the action waits, such as a pause or a closed rollout
+	// window. Apply skips held actions.
+	Held string `json:"held,omitempty"`
+
+	svc    spec.ServiceSpec
+	actual pve.ActualState
+	// trackDrift records Drift (possibly empty) in the state store.
+	trackDrift bool
+}
+
+// Plan is what reconciling a service would do. Building a plan only reads
+// from the registry and Proxmox; Apply carries it out.
+type Plan struct {
+	Service  string `json:"service"`
+	Digest   string `json:"digest"`
+	Replicas int    `json:"replicas"`
+	// Pinned is the revision a manual rollback holds the service at.
+	Pinned int `json:"pinned,omitempty"`
+	// Paused says why every action is held back and Deferred why updates
+	// and rollouts wait for later, if they do.
+	Paused   string   `json:"paused,omitempty"`
+	Deferred string   `json:"deferred,omitempty"`
+	Actions  []Action `json:"actions"`
+
+	svc spec.ServiceSpec
+}
+
+// Changed reports whether applying the plan touches any container.
+func (p Plan) Changed() bool {
+	for _, a := range p.Actions {
+		if a.changes() && a.Held == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// changes reports whether the action touches the container.
+func (a Action) changes() bool {
+	return a.Kind != ActionNoop && a.Kind != ActionReportDrift
+}
+
+// String renders the plan for humans.
+func (p Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s):\n", p.Service, p.Digest)
+	if p.Pinned != 0 {
+		fmt.Fprintf(&b, "  pinned to revision %d\n", p.Pinned)
+	}
+	for _, a := range p.Actions {
+		fmt.Fprintf(&b, "  ct %d: %s", a.CTID, a.Kind)
+		if a.Strategy != "" {
+			fmt.Fprintf(&b, " (%s)", a.Strategy)
+		}
+		if a.From != a.To {
+			from := a.From
+			if from == "" {
+				from = "none"
+			}
+			fmt.Fprintf(&b, " %s -> %s", from, a.To)
+		}
+		fmt.Fprintf(&b, ": %s", a.Reason)
+		if a.Held != "" {
+			fmt.Fprintf(&b, " [held: %s]", a.Held)
+		}
+		b.WriteString("\n")
+		changes := a.Changes
+		if len(changes) == 0 {
+			changes = a.Drift
+		}
+		for _, c := range changes {
+			fmt.Fprintf(&b, "      %s: %q -> %q (%s)\n", c.Key, c.From, c.To, c.Action)
+		}
+	}
+	return b.String()
+}
+
+// Plan works out what Reconcile would do for svc without changing anything.
+func (r *Reconciler) Plan(ctx context.Context, svc spec.ServiceSpec) (Plan, error) {
+	pin, err := r.pin(svc)
+	if err != nil {
+		return Plan{}, err
+	}
+	digest := pin.Digest
+	if pin.Revision == 0 {
+		if digest, err = r.resolveDigest(ctx, svc); err != nil {
+			return Plan{}, err
+		}
+	}
+	replicas, err := svc.Expand()
+	if err != nil {
+		return Plan{}, classified(ClassInvalidSpec, err)
+	}
+	if len(replicas) == 1 && isBlueGreen(svc) {
+		if replicas[0], err = r.activeSlot(ctx, replicas[0]); err != nil {
+			return Plan{}, err
+		}
+	}
+	plan := Plan{Service: svc.Metadata.Name, Digest: digest, Replicas: len(replicas), Pinned: pin.Revision, svc: svc}
+	if plan.Paused, err = r.pauseReason(svc); err != nil {
+		return Plan{}, err
+	}
+	for _, rep := range replicas {
+		actual, err := r.PVE.GetContainer(ctx, rep.Spec.Node, rep.Spec.CTID)
+		if err != nil {
+			return Plan{}, err
+		}
+		if svc.Suspended() {
+			plan.Actions = append(plan.Actions, suspendAction(rep, actual))
+			continue
+		}
+		plan.Actions = append(plan.Actions, planAction(rep, actual, digest))
+	}
+	rolledBack, err := r.rolledBackReason(svc, digest)
+	if err != nil {
+		return Plan{}, err
+	}
+	deferred := r.deferReason(svc)
+	for i := range plan.Actions {
+		a := &plan.Actions[i]
+		switch {
+		case !a.changes():
+		case plan.Paused != "":
+			a.Held = plan.Paused
+		case rolledBack != "" && (a.Kind == ActionUpdate || a.Kind == ActionRollout):
+			a.Held = rolledBack
+		case deferred != "" && (a.Kind == ActionUpdate || a.Kind == ActionRollout):
+			a.Held, plan.Deferred = deferred, deferred
+		}
+	}
+	return plan, nil
+}
+
+// pauseReason says why svc must not be changed, or returns "" when it may.
+func (r *Reconciler) pauseReason(svc spec.ServiceSpec) (string, error) {
+	if svc.Paused() {
+		return "service is paused", nil
+	}
+	return r.freezeReason()
+}
+
+// freezeReason says why no container may be changed, or returns "" when
+// rollouts are not frozen.
+func (r *Reconciler) freezeReason() (string, error) {
+	if r.Frozen {
+		return "rollouts are frozen in config", nil
+	}
+	if r.Freeze == nil {
+		return "", nil
+	}
+	freeze, ok, err := r.Freeze.LoadFreeze()
+	if err != nil || !ok {
+		return "", err
+	}
+	if freeze.Reason == "" {
+		return "rollouts are frozen", nil
+	}
+	return "rollouts are frozen: " + freeze.Reason, nil
+}
+
+func suspendAction(svc spec.ServiceSpec, actual pve.ActualState) Action {
+	a := Action{CTID: svc.Spec.CTID, From: actual.CurrentDigest, To: actual.CurrentDigest, svc: svc, actual: actual}
+	if actual.Exists && actual.Status != "stopped" {
+		a.Kind, a.Reason = ActionStop, "service is suspended"
+		return a
+	}
+	a.Kind, a.Reason = ActionNoop, "suspended"
+	return a
+}
+
+func planAction(svc spec.ServiceSpec, actual pve.ActualState, digest string) Action {
+	a := planChanges(svc, actual, digest)
+	if actual.Status == "stopped" && (a.Kind == ActionNoop || a.Kind == ActionReportDrift) {
+		a.Kind, a.Reason = ActionStart, "container is stopped"
+	}
+	return a
+}
+
+func planChanges(svc spec.ServiceSpec, actual pve.ActualState, digest string) Action {
+	a := Action{CTID: svc.Spec.CTID, From: actual.CurrentDigest, To: digest, svc: svc, actual: actual}
+	switch {
+	case !actual.Exists:
+		a.Kind, a.Reason, a.From = ActionDeploy, "container does not exist", ""
+		return a
+	case actual.CurrentDigest != digest:
+		return a.rollout("image digest changed")
+	}
+	changes := pve.Diff(svc, actual)
+	if actual.Managed && actual.SpecHash == svc.Hash() {
+		// The spec is what was deployed, so any difference was made behind
+		// the operator's back.
+		return a.drift(changes)
+	}
+	if actual.InitHash != "" && actual.InitHash != svc.InitHash() {
+		return a.rollout("container init changed")
+	}
+	a.Reason, a.Changes = "spec changed", changes
+	if changes.Requires(pve.ActionRecreate) {
+		return a.rollout("config change needs a new container")
+	}
+	a.Kind = ActionUpdate
+	return a
+}
+
+// drift plans for changes made outside the operator according to the
+// service's drift policy. Correcting never replaces the container: drift that
+// needs a new one would destroy whatever was changed by hand, so it is only
+// reported.
+func (a Action) drift(changes pve.Changes) Action {
+	policy := a.svc.Spec.EffectiveDriftPolicy()
+	a.trackDrift = policy != "ignore"
+	if len(changes) == 0 || policy == "ignore" {
+		a.Kind, a.Reason = ActionNoop, "up to date"
+		return a
+	}
+	a.Drift = changes
+	if policy == "report" {
+		a.Kind, a.Reason = ActionReportDrift, "configuration drift detected"
+		return a
+	}
+	inPlace := changes.Except(pve.ActionRecreate)
+	if len(inPlace) == 0 {
+		a.Kind, a.Reason = ActionReportDrift, "configuration drift needs a new container, not corrected"
+		return a
+	}
+	a.Kind, a.Reason, a.Changes = ActionUpdate, "correcting configuration drift", inPlace
+	if len(inPlace) < len(changes) {
+		var skipped []string
+		for _, c := range changes {
+			if c.Action == pve.ActionRecreate {
+				skipped = append(skipped, c.Key)
+			}
+		}
+		a.Reason += fmt.Sprintf("; %s need a new container, not corrected", strings.Join(skipped, ", "))
+	}
+	return a
+}
+
+func (a Action) rollout(reason string) Action {
+	a.Kind, a.Reason, a.Strategy = ActionRollout, reason, a.svc.Spec.Rollout.Strategy
+	return a
+}
+
+// Apply carries out plan and records the outcome in the service's history.
+func (r *Reconciler) Apply(ctx context.Context, plan Plan) error {
+	if r.Logger == nil {
+		r.Logger = slog.Default()
+	}
+	err := r.apply(ctx, plan)
+	return errors.Join(err, r.recordRevision(plan, err))
+}
+
+// apply runs deploys and in-place updates first, one container at a time;
+// rollouts then run together so the strategy can batch replicas.
+func (r *Reconciler) apply(ctx context.Context, plan Plan) error {
+	var rollouts []replica
+	// current holds the replicas that run plan.Digest once the rollouts
+	// start, so that a canary analysis watches them too.
+	var current []spec.ServiceSpec
+	for _, a := range plan.Actions {
+		if a.trackDrift {
+			if err := r.recordDrift(a.svc, a.Drift); err != nil {
+				return err
+			}
+		}
+		if len(a.Drift) > 0 {
+			r.Logger.Warn("drift detected", "service", plan.Service, "ctid", a.CTID, "policy", a.svc.Spec.EffectiveDriftPolicy(), "changes", a.Drift)
+		}
+		if err := r.recordPending(a); err != nil {
+			return err
+		}
+		if a.Held != "" {
+			r.Logger.Info("pending rollout", "service", plan.Service, "ctid", a.CTID, "action", a.Kind, "reason", a.Reason, "held", a.Held)
+			continue
+		}
+		if a.Kind != ActionRollout && a.Kind != ActionStop {
+			current = append(current, a.svc)
+		}
+		switch a.Kind {
+		case ActionNoop:
+			r.Logger.Info("up to date", "service", plan.Service, "ctid", a.CTID, "digest", plan.Digest)
+		case ActionStart:
+			r.Logger.Info("starting", "service", plan.Service, "ctid", a.CTID, "reason", a.Reason)
+			if err := r.PVE.StartContainer(ctx, a.svc.Spec.Node, a.CTID); err != nil {
+				return err
+			}
+			if err := r.waitHealthy(ctx, a.svc); err != nil {
+				return err
+			}
+		case ActionStop:
+			r.Logger.Info("stopping", "service", plan.Service, "ctid", a.CTID, "reason", a.Reason)
+			if err := r.PVE.StopContainer(ctx, a.svc.Spec.Node, a.CTID); err != nil {
+				return err
+			}
+		case ActionDeploy:
+			r.Logger.Info("deploying", "service", plan.Service, "ctid", a.CTID, "digest", plan.Digest)
+			if err := r.deployFresh(ctx, a.svc, plan.Digest); err != nil {
+				return err
+			}
+		case ActionUpdate:
+			r.Logger.Info("updating in place", "service", plan.Service, "ctid", a.CTID, "reason", a.Reason, "keys", a.Changes.Keys())
+			if err := r.updateInPlace(ctx, a.svc, plan.Digest, a.Changes); err != nil {
+				return err
+			}
+		case ActionRollout:
+			r.Logger.Info("rollout required", "service", plan.Service, "ctid", a.CTID, "reason", a.Reason, "from", a.From, "to", a.To)
+			rollouts = append(rollouts, replica{svc: a.svc, actual: a.actual})
+		}
+	}
+	if len(rollouts) == 0 {
+		return nil
+	}
+	if plan.Replicas > 1 {
+		return r.rolloutReplicas(ctx, rollouts, current, plan.Digest)
+	}
+	return r.rollout(ctx, rollouts[0].svc, rollouts[0].actual, plan.Digest)
+}
@@ -2,78 +2,198 @@ package reconciler
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
+	"time"
 
+	"github.com/haasonsaas/pve-oci-operator/internal/analysis"
 	"github.com/haasonsaas/pve-oci-operator/internal/health"
+	"github.com/haasonsaas/pve-oci-operator/internal/importer"
 	"github.com/haasonsaas/pve-oci-operator/internal/pve"
 	"github.com/haasonsaas/pve-oci-operator/internal/registry"
 	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
 )
 
 type Reconciler struct {
 	Registry registry.Client
 	PVE      pve.Client
 	Health   health.Checker
+	// Templates converts images into LXC templates. When nil the image
+	// reference is handed to pct create unchanged.
+	Templates importer.Importer
+	// Analyzer judges canaries. When nil a canary step only waits out its
+	// pause.
+	Analyzer analysis.Analyzer
+	// Store receives status such as detected drift. It is optional.
+	Store state.Store
+	// History records each rollout and holds rollback pins. It is optional.
+	History state.HistoryStore
+	// Freeze holds the freeze set with the freeze command and Frozen the one
+	// from config. Either stops every service from being changed.
+	Freeze state.FreezeStore
+	Frozen bool
+	// Blackouts are periods in which no update or rollout starts.
+	Blackouts []spec.Blackout
+	// LockCTID, when set, is held while an orphaned container is stopped or
+	// destroyed, so that no reconcile of a service changes it at the same
+	// time. It returns the function that releases the CTID.
+	LockCTID func(ctid int) func()
 	Logger   *slog.Logger
+
+	// now is replaced in tests.
+	now func() time.Time
 }
 
-func (r *Reconciler) Reconcile(ctx context.Context, svc spec.ServiceSpec) error {
-	if r.Logger == nil {
-		r.Logger = slog.Default()
-	}
-	digest, err := r.resolveDigest(ctx, svc)
-	if err != nil {
-		return err
+// clock returns the current time, from now when a test replaced it.
+func (r *Reconciler) clock() time.Time {
+	if r.now != nil {
+		return r.now()
 	}
-	actual, err := r.PVE.GetContainer(ctx, svc.Spec.Node, svc.Spec.CTID)
+	return time.Now()
+}
+
+// Reconcile plans the service and applies the plan.
+func (r *Reconciler) Reconcile(ctx context.Context, svc spec.ServiceSpec) error {
+	plan, err := r.Plan(ctx, svc)
 	if err != nil {
 		return err
 	}
-	if !actual.Exists {
-		r.Logger.Info("deploying", "service", svc.Metadata.Name, "digest", digest)
-		return r.deployFresh(ctx, svc, digest)
-	}
-	if actual.CurrentDigest == digest {
-		r.Logger.Info("up to date", "service", svc.Metadata.Name, "digest", digest)
-		return nil
-	}
-	r.Logger.Info("rollout required", "service", svc.Metadata.Name, "from", actual.CurrentDigest, "to", digest)
+	return r.Apply(ctx, plan)
+}
+
+func (r *Reconciler) rollout(ctx context.Context, svc spec.ServiceSpec, actual pve.ActualState, digest string) error {
 	switch strings.ToLower(svc.Spec.Rollout.Strategy) {
 	case "recreate":
 		return r.recreate(ctx, svc, actual, digest)
 	case "bluegreen":
 		return r.blueGreen(ctx, svc, actual, digest)
+	case "rolling":
+		// A single replica rolls like recreate; batching happens in
+		// reconcileReplicas.
+		return r.recreate(ctx, svc, actual, digest)
+	case "canary":
+		return r.canary(ctx, []replica{{svc: svc, actual: actual}}, nil, digest)
 	default:
-		return fmt.Errorf("unknown rollout strategy %q", svc.Spec.Rollout.Strategy)
+		return classified(ClassInvalidSpec, fmt.Errorf("unknown rollout strategy %q", svc.Spec.Rollout.Strategy))
 	}
 }
 
+// recordDrift stores the current drift in the state entry so it can be
+// inspected without reading logs.
+func (r *Reconciler) recordDrift(svc spec.ServiceSpec, changes pve.Changes) error {
+	if r.Store == nil || svc.Spec.EffectiveDriftPolicy() == "ignore" {
+		return nil
+	}
+	var drift []string
+	for _, c := range changes {
+		drift = append(drift, fmt.Sprintf("%s: %q -> %q", c.Key, c.From, c.To))
+	}
+	return r.Store.Update(svc.Spec.CTID, func(entry *state.Entry, found bool) error {
+		if !found && drift != nil {
+			*entry = state.Entry{CTID: svc.Spec.CTID, Service: svc.Metadata.Name, Node: svc.Spec.Node}
+		}
+		entry.Drift = drift
+		return nil
+	})
+}
+
+// updateInPlace applies changes with pct set and refreshes the markers,
+// restarting the container when a change only takes effect on start.
+func (r *Reconciler) updateInPlace(ctx context.Context, svc spec.ServiceSpec, digest string, changes pve.Changes) error {
+	restart := changes.Requires(pve.ActionRestart)
+	var snapshot string
+	if restart && svc.Spec.Rollout.Snapshot.Enabled {
+		snapshot = snapshotName(r.clock())
+		if err := r.PVE.Snapshot(ctx, svc.Spec.Node, svc.Spec.CTID, snapshot); err != nil {
+			return fmt.Errorf("snapshot before update: %w", err)
+		}
+	}
+	if err := r.PVE.UpdateContainer(ctx, svc, digest, changes); err != nil {
+		return err
+	}
+	if !restart {
+		return nil
+	}
+	if err := r.restart(ctx, svc); err != nil {
+		if snapshot != "" && svc.Spec.Rollout.AutoRollback {
+			r.Logger.Error("update failed, rolling back to snapshot", "service", svc.Metadata.Name, "snapshot", snapshot, "error", err)
+			return rolledBack(err, r.rollbackSnapshot(ctx, svc, snapshot))
+		}
+		return err
+	}
+	if snapshot != "" {
+		return r.pruneSnapshots(ctx, svc)
+	}
+	return nil
+}
+
+func (r *Reconciler) restart(ctx context.Context, svc spec.ServiceSpec) error {
+	if err := r.PVE.StopContainer(ctx, svc.Spec.Node, svc.Spec.CTID); err != nil {
+		return err
+	}
+	if err := r.PVE.StartContainer(ctx, svc.Spec.Node, svc.Spec.CTID); err != nil {
+		return err
+	}
+	return r.waitHealthy(ctx, svc)
+}
+
+// waitHealthy waits for svc to pass its health check, classing a failure as
+// unhealthy.
+func (r *Reconciler) waitHealthy(ctx context.Context, svc spec.ServiceSpec) error {
+	return classified(ClassUnhealthy, r.Health.Wait(ctx, svc))
+}
+
 func (r *Reconciler) resolveDigest(ctx context.Context, svc spec.ServiceSpec) (string, error) {
 	policy := strings.ToLower(svc.Spec.PullPolicy)
 	if strings.HasPrefix(svc.Spec.Tag, "sha256:") || policy == "never" {
 		return svc.Spec.Tag, nil
 	}
 	if policy == "digest" || policy == "" || policy == "tag" {
-		return r.Registry.ResolveDigest(ctx, svc.Spec.Image, svc.Spec.Tag)
+		digest, err := r.Registry.ResolveDigest(ctx, svc.Spec.Image, svc.Spec.Tag)
+		if err != nil {
+			return "", classified(ClassTransient, fmt.Errorf("resolve %s:%s: %w", svc.Spec.Image, svc.Spec.Tag, err))
+		}
+		return digest, nil
 	}
-	return "", fmt.Errorf("unsupported pullPolicy %s", svc.Spec.PullPolicy)
+	return "", classified(ClassInvalidSpec, fmt.Errorf("unsupported pullPolicy %s", svc.Spec.PullPolicy))
 }
 
 func (r *Reconciler) deployFresh(ctx context.Context, svc spec.ServiceSpec, digest string) error {
-	if err := r.PVE.CreateContainer(ctx, svc, digest); err != nil {
+	var template string
+	if r.Templates != nil {
+		var err error
+		template, err = r.Templates.Import(ctx, svc, digest)
+		if err != nil {
+			return fmt.Errorf("import %s@%s: %w", svc.Spec.Image, digest, err)
+		}
+	}
+	if err := r.PVE.CreateContainer(ctx, svc, digest, template); err != nil {
 		return err
 	}
 	if err := r.PVE.StartContainer(ctx, svc.Spec.Node, svc.Spec.CTID); err != nil {
 		return err
 	}
-	return r.Health.Wait(ctx, svc)
+	return r.waitHealthy(ctx, svc)
 }
 
 func (r *Reconciler) recreate(ctx context.Context, svc spec.ServiceSpec, actual pve.ActualState, digest string) error {
 	prevDigest := actual.CurrentDigest
+	if err := r.backup(ctx, svc); err != nil {
+		return err
+	}
+	// The stash is cloned while the old container still runs, so the copy
+	// adds no downtime.
+	stash := stashes(svc)
+	if svc.Spec.Rollout.Snapshot.Enabled && !stash {
+		r.Logger.Info("not stashing, a clone would copy the volume mounts", "service", svc.Metadata.Name, "ctid", svc.Spec.CTID)
+	}
+	if stash {
+		if err := r.stash(ctx, svc); err != nil {
+			return err
+		}
+	}
 	if err := r.PVE.StopContainer(ctx, svc.Spec.Node, svc.Spec.CTID); err != nil {
 		return err
 	}
@@ -81,15 +201,27 @@ func (r *Reconciler) recreate(ctx context.Context, svc spec.ServiceSpec, actual
 		return err
 	}
 	if err := r.deployFresh(ctx, svc, digest); err != nil {
-		if svc.Spec.Rollout.AutoRollback && prevDigest != "" {
+		switch {
+		case svc.Spec.Rollout.AutoRollback && stash:
+			r.Logger.Error("rollout failed, restoring previous container", "service", svc.Metadata.Name, "stash", svc.Spec.Rollout.Snapshot.StashCTID, "error", err)
+			return rolledBack(err, r.restoreStash(ctx, svc))
+		case svc.Spec.Rollout.AutoRollback && prevDigest != "":
 			r.Logger.Error("rollout failed, attempting rollback", "service", svc.Metadata.Name, "error", err)
-			return errors.Join(err, r.rollback(ctx, svc, prevDigest))
+			return rolledBack(err, r.rollback(ctx, svc, prevDigest))
+		case stash:
+			r.Logger.Error("rollout failed, previous container kept", "service", svc.Metadata.Name, "stash", svc.Spec.Rollout.Snapshot.StashCTID, "error", err)
 		}
 		return err
 	}
+	if stash {
+		return r.dropStash(ctx, svc)
+	}
 	return nil
 }
 
+// rollback rebuilds the container of svc from digest. The container it
+// destroys runs the failed rollout, whose state the backup taken before the
+// rollout already holds.
 func (r *Reconciler) rollback(ctx context.Context, svc spec.ServiceSpec, digest string) error {
 	if err := r.PVE.DestroyContainer(ctx, svc.Spec.Node, svc.Spec.CTID); err != nil {
 		return err
@@ -97,6 +229,46 @@ func (r *Reconciler) rollback(ctx context.Context, svc spec.ServiceSpec, digest
 	return r.deployFresh(ctx, svc, digest)
 }
 
-func (r *Reconciler) blueGreen(ctx context.Context, _ spec.ServiceSpec, _ pve.ActualState, _ string) error {
-	return fmt.Errorf("blueGreen rollout not implemented yet")
+// backup runs vzdump for the service's container when spec.backup asks for
+// it. A failed backup aborts the destructive operation that follows.
+func (r *Reconciler) backup(ctx context.Context, svc spec.ServiceSpec) error {
+	if !svc.Spec.Backup.Enabled() {
+		return nil
+	}
+	actual, err := r.PVE.GetContainer(ctx, svc.Spec.Node, svc.Spec.CTID)
+	if err != nil || !actual.Exists {
+		return err
+	}
+	r.Logger.Info("backing up", "service", svc.Metadata.Name, "ctid", svc.Spec.CTID, "storage", svc.Spec.Backup.Storage, "mode", svc.Spec.Backup.EffectiveMode())
+	if err := r.PVE.Backup(ctx, svc.Spec.Node, svc.Spec.CTID, svc.Spec.Backup); err != nil {
+		return fmt.Errorf("backup ct %d before rollout: %w", svc.Spec.CTID, err)
+	}
+	return nil
+}
+
+// Ready reports whether every container of svc is running and passes its
+// health check. The caller bounds how long the health check may take.
+func (r *Reconciler) Ready(ctx context.Context, svc spec.ServiceSpec) error {
+	replicas, err := svc.Expand()
+	if err != nil {
+		return err
+	}
+	if len(replicas) == 1 && isBlueGreen(svc) {
+		if replicas[0], err = r.activeSlot(ctx, replicas[0]); err != nil {
+			return err
+		}
+	}
+	for _, rep := range replicas {
+		actual, err := r.PVE.GetContainer(ctx, rep.Spec.Node, rep.Spec.CTID)
+		if err != nil {
+			return err
+		}
+		if !actual.Exists || actual.Status != "running" {
+			return fmt.Errorf("ct %d is not running", rep.Spec.CTID)
+		}
+		if err := r.waitHealthy(ctx, rep); err != nil {
+			return fmt.Errorf("ct %d: %w", rep.Spec.CTID, err)
+		}
+	}
+	return nil
 }
@@ -2,10 +2,17 @@ package reconciler
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/haasonsaas/pve-oci-operator/internal/pve"
 	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
 )
 
 type fakeRegistry struct {
@@ -17,39 +24,182 @@ func (f *fakeRegistry) ResolveDigest(context.Context, string, string) (string, e
 }
 
 type fakePVE struct {
-	actual pve.ActualState
-	op     []string
+	mu      sync.Mutex
+	actual  pve.ActualState
+	op      []string
+	created []spec.ServiceSpec
+	changes pve.Changes
+	// others holds containers besides the service's own, keyed by CTID.
+	others    map[int]pve.ActualState
+	snapshots []pve.Snapshot
+	backupErr error
 }
 
-func (f *fakePVE) GetContainer(context.Context, string, int) (pve.ActualState, error) {
+func (f *fakePVE) GetContainer(_ context.Context, _ string, ctid int) (pve.ActualState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if other, ok := f.others[ctid]; ok {
+		return other, nil
+	}
+	if f.actual.CTID != 0 && f.actual.CTID != ctid {
+		return pve.ActualState{CTID: ctid}, nil
+	}
 	return f.actual, nil
 }
 
-func (f *fakePVE) CreateContainer(context.Context, spec.ServiceSpec, string) error {
+// other reports whether ctid is a container besides the service's own.
+func (f *fakePVE) other(ctid int) bool {
+	return f.actual.CTID != 0 && ctid != f.actual.CTID
+}
+
+func (f *fakePVE) CreateContainer(_ context.Context, svc spec.ServiceSpec, digest, _ string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created = append(f.created, svc)
+	if ctid := svc.Spec.CTID; f.other(ctid) {
+		f.op = append(f.op, fmt.Sprintf("create %d", ctid))
+		if f.others == nil {
+			f.others = map[int]pve.ActualState{}
+		}
+		f.others[ctid] = pve.ActualState{Exists: true, CTID: ctid, Managed: true, Service: svc.Metadata.Name, Status: "stopped", CurrentDigest: digest,
+			Config: map[string]string{"hostname": svc.Metadata.Name, "net0": "name=eth0,bridge=vmbr0,ip=" + svc.Spec.Network.IP}}
+		return nil
+	}
 	f.op = append(f.op, "create")
 	f.actual.Exists = true
 	return nil
 }
 
-func (f *fakePVE) StopContainer(context.Context, string, int) error {
-	f.op = append(f.op, "stop")
+func (f *fakePVE) setStatus(op string, ctid int, status string) {
+	if other, ok := f.others[ctid]; ok {
+		f.op = append(f.op, fmt.Sprintf("%s %d", op, ctid))
+		other.Status = status
+		f.others[ctid] = other
+		return
+	}
+	f.op = append(f.op, op)
+	f.actual.Status = status
+}
+
+func (f *fakePVE) StopContainer(_ context.Context, _ string, ctid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setStatus("stop", ctid, "stopped")
 	return nil
 }
 
-func (f *fakePVE) StartContainer(context.Context, string, int) error {
-	f.op = append(f.op, "start")
+func (f *fakePVE) StartContainer(_ context.Context, _ string, ctid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setStatus("start", ctid, "running")
 	return nil
 }
 
-func (f *fakePVE) DestroyContainer(context.Context, string, int) error {
+func (f *fakePVE) DestroyContainer(_ context.Context, _ string, ctid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.others[ctid]; ok {
+		f.op = append(f.op, fmt.Sprintf("destroy %d", ctid))
+		delete(f.others, ctid)
+		return nil
+	}
 	f.op = append(f.op, "destroy")
 	return nil
 }
 
+func (f *fakePVE) UpdateContainer(_ context.Context, svc spec.ServiceSpec, _ string, changes pve.Changes) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.other(svc.Spec.CTID) {
+		f.op = append(f.op, fmt.Sprintf("update %d", svc.Spec.CTID))
+	} else {
+		f.op = append(f.op, "update")
+	}
+	f.changes = changes
+	return nil
+}
+
+func (f *fakePVE) Snapshot(_ context.Context, _ string, _ int, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.op = append(f.op, "snapshot")
+	f.snapshots = append(f.snapshots, pve.Snapshot{Name: name})
+	return nil
+}
+
+func (f *fakePVE) RollbackSnapshot(_ context.Context, _ string, _ int, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.op = append(f.op, "rollback "+name)
+	return nil
+}
+
+func (f *fakePVE) DeleteSnapshot(_ context.Context, _ string, _ int, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.op = append(f.op, "delsnapshot "+name)
+	return nil
+}
+
+func (f *fakePVE) ListSnapshots(context.Context, string, int) ([]pve.Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshots, nil
+}
+
+func (f *fakePVE) CloneContainer(_ context.Context, _ string, ctid, newID int, snapshot string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if snapshot != "" {
+		f.op = append(f.op, fmt.Sprintf("clone %d %d from %s", ctid, newID, snapshot))
+	} else {
+		f.op = append(f.op, fmt.Sprintf("clone %d %d", ctid, newID))
+	}
+	if f.others == nil {
+		f.others = map[int]pve.ActualState{}
+	}
+	if newID != f.actual.CTID {
+		f.others[newID] = pve.ActualState{Exists: true, CTID: newID, Service: f.actual.Service}
+	}
+	return nil
+}
+
+func (f *fakePVE) Backup(context.Context, string, int, spec.BackupSpec) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.op = append(f.op, "backup")
+	return f.backupErr
+}
+
+func (f *fakePVE) ListManaged(context.Context) ([]pve.ActualState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var managed []pve.ActualState
+	for _, other := range f.others {
+		if other.Managed {
+			managed = append(managed, other)
+		}
+	}
+	return managed, nil
+}
+
 type fakeHealth struct{}
 
 func (fakeHealth) Wait(context.Context, spec.ServiceSpec) error { return nil }
 
+// failingHealth fails the first fails checks.
+type failingHealth struct {
+	fails int
+}
+
+func (h *failingHealth) Wait(context.Context, spec.ServiceSpec) error {
+	if h.fails > 0 {
+		h.fails--
+		return errors.New("unhealthy")
+	}
+	return nil
+}
+
 func TestReconcilerDeploysFreshService(t *testing.T) {
 	svc := spec.ServiceSpec{}
 	svc.Metadata.Name = "composer"
@@ -92,3 +242,1062 @@ func TestReconcilerRollsOutWhenDigestChanges(t *testing.T) {
 		t.Fatalf("expected operations")
 	}
 }
+
+func TestReconcilerRecreateKeepsMounts(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Mounts = []spec.MountSpec{
+		{Volume: "tank:subvol-900-composer-data", Guest: "/srv/composer", Options: "backup"},
+		{Host: "/srv/devdata/composer", Guest: "/srv/cache"},
+	}
+	old := pve.ActualState{Exists: true, CTID: 160, CurrentDigest: "sha256:old", Config: map[string]string{
+		"mp0": "tank:subvol-900-composer-data,mp=/srv/composer,backup=1,size=8G",
+		"mp1": "/srv/devdata/composer,mp=/srv/cache",
+	}}
+
+	fpve := &fakePVE{actual: old}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "stop,destroy,create,start" {
+		t.Fatalf("expected recreate, got %s", got)
+	}
+	// The replacement must attach exactly the volume and directory the old
+	// container used, so their data is still there.
+	for _, c := range pve.Diff(fpve.created[0], old) {
+		if strings.HasPrefix(c.Key, "mp") {
+			t.Fatalf("recreated container changes mount %s: %q -> %q", c.Key, c.From, c.To)
+		}
+	}
+
+	for _, mount := range []spec.MountSpec{
+		{Storage: "local-lvm", Guest: "/srv/composer"},
+		{Volume: "tank:subvol-160-data", Guest: "/srv/composer"},
+	} {
+		svc.Spec.Mounts = []spec.MountSpec{mount}
+		if err := svc.Validate(); err == nil {
+			t.Fatalf("expected %+v, which dies with the container, to be rejected", mount)
+		}
+	}
+}
+
+func TestReconcilerUpdatesResourcesInPlace(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Resources.Cores = 4
+	svc.Spec.Resources.MemoryMB = 4096
+
+	fpve := &fakePVE{actual: pve.ActualState{
+		Exists: true, Managed: true, CurrentDigest: "sha256:same", SpecHash: "stale", InitHash: svc.InitHash(),
+		Config: map[string]string{"hostname": "composer", "cores": "2", "memory": "4096"},
+	}}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:same"}, PVE: fpve, Health: fakeHealth{}}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if strings.Join(fpve.op, ",") != "update" {
+		t.Fatalf("expected a single in-place update, got %v", fpve.op)
+	}
+	if len(fpve.changes) != 1 || fpve.changes[0].Key != "cores" || fpve.changes[0].To != "4" {
+		t.Fatalf("unexpected changes %+v", fpve.changes)
+	}
+}
+
+func TestReconcilerRecreatesWhenRootfsChanges(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Resources.RootfsStorage = "tank"
+	svc.Spec.Resources.RootfsSizeGB = 16
+
+	fpve := &fakePVE{actual: pve.ActualState{
+		Exists: true, Managed: true, CurrentDigest: "sha256:same", SpecHash: "stale",
+		Config: map[string]string{"hostname": "composer", "rootfs": "local-lvm:vm-160-disk-0,size=8G"},
+	}}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:same"}, PVE: fpve, Health: fakeHealth{}}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if strings.Join(fpve.op, ",") != "stop,destroy,create,start" {
+		t.Fatalf("expected recreate, got %v", fpve.op)
+	}
+}
+
+func TestReconcilerHandlesDrift(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	svc.Spec.Resources.MemoryMB = 4096
+	svc.Spec.Features.Nesting = true
+
+	drifted := func() *fakePVE {
+		return &fakePVE{actual: pve.ActualState{
+			Exists: true, Managed: true, CurrentDigest: "sha256:same", SpecHash: svc.Hash(),
+			Config: map[string]string{"hostname": "composer", "memory": "1024", "features": "nesting=1"},
+		}}
+	}
+
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	fpve := drifted()
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:same"}, PVE: fpve, Health: fakeHealth{}, Store: store}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(fpve.op) != 0 {
+		t.Fatalf("report policy must not change the container, got %v", fpve.op)
+	}
+	entry, ok, err := store.Load(160)
+	if err != nil || !ok || len(entry.Drift) != 1 || !strings.HasPrefix(entry.Drift[0], "memory:") {
+		t.Fatalf("expected memory drift in status, got %+v (ok=%v, err=%v)", entry, ok, err)
+	}
+
+	svc.Spec.DriftPolicy = "correct"
+	fpve = drifted()
+	fpve.actual.SpecHash = svc.Hash()
+	rec.PVE = fpve
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if strings.Join(fpve.op, ",") != "update" || fpve.changes[0].To != "4096" {
+		t.Fatalf("expected drift to be corrected in place, got %v %+v", fpve.op, fpve.changes)
+	}
+
+	// Drift that needs a new container is reported, never corrected.
+	svc.Spec.Resources.RootfsStorage, svc.Spec.Resources.RootfsSizeGB = "local-lvm", 8
+	fpve = drifted()
+	fpve.actual.SpecHash = svc.Hash()
+	fpve.actual.Config["rootfs"] = "local-lvm:vm-160-disk-0,size=4G"
+	rec.PVE = fpve
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if strings.Join(fpve.op, ",") != "update" || len(fpve.changes) != 1 || fpve.changes[0].Key != "memory" {
+		t.Fatalf("expected only memory to be corrected, got %v %+v", fpve.op, fpve.changes)
+	}
+	fpve.actual.Config["memory"] = "4096"
+	fpve.op = nil
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(fpve.op) != 0 {
+		t.Fatalf("rootfs drift must not recreate the container, got %v", fpve.op)
+	}
+	entry, _, err = store.Load(160)
+	if err != nil || len(entry.Drift) != 1 || !strings.HasPrefix(entry.Drift[0], "rootfs:") {
+		t.Fatalf("expected rootfs drift in status, got %+v (err=%v)", entry, err)
+	}
+}
+
+func TestReconcilerRestoresStashWhenRecreateFails(t *testing.T) {
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CTID: 160, Service: "composer", CurrentDigest: "sha256:old", Status: "running"}}
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Rollout.AutoRollback = true
+	svc.Spec.Rollout.Snapshot = spec.SnapshotSpec{Enabled: true, StashCTID: 9160}
+
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: &failingHealth{fails: 1}}
+	if err := rec.Reconcile(context.Background(), svc); err == nil {
+		t.Fatalf("expected the failed rollout to be reported")
+	}
+	snapshot := fpve.snapshots[0].Name
+	want := "snapshot,clone 160 9160 from " + snapshot + ",delsnapshot " + snapshot + ",stop,destroy,create,start,stop,destroy,clone 9160 160,destroy 9160,start"
+	if got := strings.Join(fpve.op, ","); got != want {
+		t.Fatalf("ops = %s, want %s", got, want)
+	}
+	if len(fpve.created) != 1 {
+		t.Fatalf("restore must not rebuild from the old digest, created %d containers", len(fpve.created))
+	}
+}
+
+func TestReconcilerRebuildsInsteadOfStashingVolumeMounts(t *testing.T) {
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CTID: 160, Service: "composer", CurrentDigest: "sha256:old", Status: "running"}}
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Mounts = []spec.MountSpec{{Volume: "tank:subvol-900-composer-data", Guest: "/data"}}
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Rollout.AutoRollback = true
+	svc.Spec.Rollout.Snapshot = spec.SnapshotSpec{Enabled: true, StashCTID: 9160}
+
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: &failingHealth{fails: 1}}
+	if err := rec.Reconcile(context.Background(), svc); err == nil {
+		t.Fatalf("expected the failed rollout to be reported")
+	}
+	// A clone would move the service onto a copy of its volume, so the old
+	// container is rebuilt from its digest and the volume reattached.
+	if got := strings.Join(fpve.op, ","); got != "stop,destroy,create,start,destroy,create,start" {
+		t.Fatalf("unexpected ops %s", got)
+	}
+}
+
+func TestReconcilerRecreateDropsStashOnSuccess(t *testing.T) {
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CTID: 160, CurrentDigest: "sha256:old"}}
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Rollout.Snapshot = spec.SnapshotSpec{Enabled: true, StashCTID: 9160}
+
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// The stash is cloned from a snapshot before the container stops.
+	snapshot := fpve.snapshots[0].Name
+	if got := strings.Join(fpve.op, ","); got != "snapshot,clone 160 9160 from "+snapshot+",delsnapshot "+snapshot+",stop,destroy,create,start,destroy 9160" {
+		t.Fatalf("unexpected ops %s", got)
+	}
+}
+
+func TestSnapshotNamesWithinASecondDiffer(t *testing.T) {
+	now := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	first, second := snapshotName(now), snapshotName(now.Add(time.Millisecond))
+	if first == second || first >= second || strings.Contains(first, ".") {
+		t.Fatalf("names %q and %q must differ and sort by time", first, second)
+	}
+	if older := snapshotPrefix + "20261017-075959"; older >= first {
+		t.Fatalf("%q sorts after the newer %q", older, first)
+	}
+}
+
+func TestReconcilerRollsBackSnapshotWhenUpdateFails(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Features.Nesting = true
+	svc.Spec.Rollout.AutoRollback = true
+	svc.Spec.Rollout.Snapshot = spec.SnapshotSpec{Enabled: true, Retain: 1, StashCTID: 9160}
+
+	fpve := &fakePVE{
+		actual: pve.ActualState{Exists: true, CurrentDigest: "sha256:same", Status: "running",
+			Config: map[string]string{"hostname": "composer"}},
+		snapshots: []pve.Snapshot{{Name: "pveoci-20260101-000000"}, {Name: "manual"}},
+	}
+	now := time.Date(2026, 10, 17, 8, 0, 0, 123456000, time.UTC)
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:same"}, PVE: fpve, Health: &failingHealth{fails: 1}, now: func() time.Time { return now }}
+	if err := rec.Reconcile(context.Background(), svc); err == nil {
+		t.Fatalf("expected the failed update to be reported")
+	}
+	snapshot := "pveoci-20261017-080000123456"
+	want := "snapshot,update,stop,start,stop,rollback " + snapshot + ",start"
+	if got := strings.Join(fpve.op, ","); got != want {
+		t.Fatalf("ops = %s, want %s", got, want)
+	}
+
+	fpve.op = nil
+	rec.Health = fakeHealth{}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// Retain 1 keeps only the newest operator snapshot and never touches
+	// snapshots the operator did not take.
+	if got := strings.Join(fpve.op, ","); !strings.HasSuffix(got, ",start,delsnapshot pveoci-20260101-000000,delsnapshot "+snapshot) {
+		t.Fatalf("unexpected ops %s", got)
+	}
+}
+
+func TestReconcilerBacksUpBeforeRecreate(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Backup = spec.BackupSpec{Storage: "pbs", KeepLast: 3}
+
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CurrentDigest: "sha256:old"}}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "backup,stop,destroy,create,start" {
+		t.Fatalf("unexpected ops %s", got)
+	}
+
+	fpve = &fakePVE{actual: pve.ActualState{Exists: true, CurrentDigest: "sha256:old"}, backupErr: errors.New("storage full")}
+	rec.PVE = fpve
+	if err := rec.Reconcile(context.Background(), svc); err == nil || !strings.Contains(err.Error(), "storage full") {
+		t.Fatalf("expected backup failure to abort the rollout, got %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "backup" {
+		t.Fatalf("rollout continued after failed backup: %s", got)
+	}
+}
+
+func blueGreenService() spec.ServiceSpec {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Network.Bridge = "vmbr0"
+	svc.Spec.Network.IP = "192.168.4.160/24"
+	svc.Spec.Rollout.Strategy = "blueGreen"
+	svc.Spec.Rollout.AutoRollback = true
+	svc.Spec.Rollout.BlueGreen = spec.BlueGreenSpec{CTIDs: []int{160, 161}, PreviewIP: "192.168.4.161/24"}
+	return svc
+}
+
+func TestBlueGreenSwitchesToStandby(t *testing.T) {
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CTID: 160, Managed: true, Service: "composer", CurrentDigest: "sha256:old", Status: "running"}}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}}
+	if err := rec.Reconcile(context.Background(), blueGreenService()); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "create 161,start 161,stop,update 161,destroy" {
+		t.Fatalf("unexpected ops %s", got)
+	}
+	if ip := fpve.created[0].Spec.Network.IP; ip != "192.168.4.161/24" {
+		t.Fatalf("standby must come up on the preview address, got %s", ip)
+	}
+	if len(fpve.changes) != 1 || fpve.changes[0].Key != "net0" || !strings.Contains(fpve.changes[0].To, "ip=192.168.4.160/24") {
+		t.Fatalf("expected the service address to move to the standby, got %+v", fpve.changes)
+	}
+}
+
+func TestBlueGreenSwitchesBackWhenUnhealthy(t *testing.T) {
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CTID: 160, Managed: true, Service: "composer", CurrentDigest: "sha256:old", Status: "running"}}
+	// The standby passes its preview check and fails once it owns the
+	// service address.
+	health := &switchHealth{failCTID: 161, after: 1}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: health}
+	if err := rec.Reconcile(context.Background(), blueGreenService()); err == nil {
+		t.Fatalf("expected the failed switch to be reported")
+	}
+	if got := strings.Join(fpve.op, ","); got != "create 161,start 161,stop,update 161,stop 161,destroy 161,start" {
+		t.Fatalf("unexpected ops %s", got)
+	}
+}
+
+func TestBlueGreenRestoresActiveWithoutAutoRollback(t *testing.T) {
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CTID: 160, Managed: true, Service: "composer", CurrentDigest: "sha256:old", Status: "running"}}
+	health := &previewHealth{switchHealth: switchHealth{failCTID: 161, after: 1}}
+	svc := blueGreenService()
+	svc.Spec.Rollout.AutoRollback = false
+	svc.Spec.Health.URL = "http://192.168.4.160:8080/healthz"
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: health}
+	if err := rec.Reconcile(context.Background(), svc); err == nil {
+		t.Fatalf("expected the failed switch to be reported")
+	}
+	// The old container serves again and the failed standby is kept
+	// stopped instead of destroyed.
+	if got := strings.Join(fpve.op, ","); got != "create 161,start 161,stop,update 161,stop 161,start" {
+		t.Fatalf("unexpected ops %s", got)
+	}
+	if fpve.actual.Status != "running" {
+		t.Fatalf("active container left %s", fpve.actual.Status)
+	}
+	if health.urls[0] != "http://192.168.4.161:8080/healthz" {
+		t.Fatalf("standby must be checked on its preview address, got %s", health.urls[0])
+	}
+}
+
+// previewHealth records the URLs it checks.
+type previewHealth struct {
+	switchHealth
+	urls []string
+}
+
+func (h *previewHealth) Wait(ctx context.Context, svc spec.ServiceSpec) error {
+	h.urls = append(h.urls, svc.Spec.Health.URL)
+	return h.switchHealth.Wait(ctx, svc)
+}
+
+func TestBlueGreenFindsActiveSlot(t *testing.T) {
+	fpve := &fakePVE{
+		actual: pve.ActualState{Exists: true, CTID: 160, Managed: true, Service: "composer", CurrentDigest: "sha256:old", Status: "stopped"},
+		others: map[int]pve.ActualState{161: {Exists: true, CTID: 161, Managed: true, Service: "composer", CurrentDigest: "sha256:new", Status: "running"}},
+	}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}}
+	if err := rec.Reconcile(context.Background(), blueGreenService()); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	for _, op := range fpve.op {
+		if strings.HasPrefix(op, "create") || strings.HasPrefix(op, "destroy") {
+			t.Fatalf("running standby slot should be treated as active, got %v", fpve.op)
+		}
+	}
+}
+
+func TestBlueGreenRefusesUnmanagedPoolMember(t *testing.T) {
+	fpve := &fakePVE{
+		actual: pve.ActualState{Exists: true, CTID: 160, Managed: true, Service: "composer", CurrentDigest: "sha256:old", Status: "running"},
+		others: map[int]pve.ActualState{161: {Exists: true, CTID: 161, Status: "running"}},
+	}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}}
+	err := rec.Reconcile(context.Background(), blueGreenService())
+	if Classify(err) != ClassInvalidSpec {
+		t.Fatalf("expected an invalid-spec error, got %v", err)
+	}
+	if len(fpve.op) != 0 {
+		t.Fatalf("an unmanaged container in the pool must not be touched, got %v", fpve.op)
+	}
+}
+
+// switchHealth fails checks of failCTID after it has passed after times.
+type switchHealth struct {
+	failCTID int
+	after    int
+}
+
+func (h *switchHealth) Wait(_ context.Context, svc spec.ServiceSpec) error {
+	if svc.Spec.CTID != h.failCTID {
+		return nil
+	}
+	if h.after > 0 {
+		h.after--
+		return nil
+	}
+	return errors.New("unhealthy")
+}
+
+func replicatedService() spec.ServiceSpec {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTIDs = []int{160, 161, 162, 163}
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Network.Bridge = "vmbr0"
+	svc.Spec.Network.IP = "192.168.4.160/24"
+	svc.Spec.Rollout.Strategy = "rolling"
+	svc.Spec.Rollout.MaxUnavailable = 2
+	svc.Spec.Rollout.AutoRollback = true
+	return svc
+}
+
+func outdatedReplicas(ctids ...int) *fakePVE {
+	fpve := &fakePVE{actual: pve.ActualState{CTID: 1}, others: map[int]pve.ActualState{}}
+	for _, ctid := range ctids {
+		fpve.others[ctid] = pve.ActualState{Exists: true, CTID: ctid, CurrentDigest: "sha256:old", Status: "running"}
+	}
+	return fpve
+}
+
+// replicaHealth fails the health check of the listed CTIDs.
+type replicaHealth struct {
+	fail map[int]bool
+}
+
+func (h replicaHealth) Wait(_ context.Context, svc spec.ServiceSpec) error {
+	if h.fail[svc.Spec.CTID] {
+		return errors.New("unhealthy")
+	}
+	return nil
+}
+
+func TestRollingUpdatesInBatches(t *testing.T) {
+	fpve := outdatedReplicas(160, 161, 162, 163)
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: replicaHealth{}}
+	if err := rec.Reconcile(context.Background(), replicatedService()); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// Both replicas of the first batch are replaced before the second batch
+	// is touched.
+	first := strings.Join(fpve.op, ",")
+	for _, ctid := range []string{"160", "161"} {
+		if strings.Index(first, "start "+ctid) > strings.Index(first, "stop 162") {
+			t.Fatalf("batch boundary violated: %s", first)
+		}
+	}
+	if len(fpve.created) != 4 {
+		t.Fatalf("expected 4 replicas to be recreated, got %d", len(fpve.created))
+	}
+	for _, created := range fpve.created {
+		want := fmt.Sprintf("192.168.4.%d/24", created.Spec.CTID)
+		if created.Spec.Network.IP != want || created.Spec.Hostname != fmt.Sprintf("composer-%d", created.Spec.CTID-160) {
+			t.Fatalf("replica %d got ip %s hostname %s", created.Spec.CTID, created.Spec.Network.IP, created.Spec.Hostname)
+		}
+	}
+}
+
+func TestRollingHaltsAndRollsBack(t *testing.T) {
+	fpve := outdatedReplicas(160, 161, 162, 163)
+	svc := replicatedService()
+	svc.Spec.Rollout.MaxUnavailable = 1
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: replicaHealth{fail: map[int]bool{161: true}}}
+	if err := rec.Reconcile(context.Background(), svc); err == nil {
+		t.Fatalf("expected the failed batch to be reported")
+	}
+	for _, op := range fpve.op {
+		if strings.HasSuffix(op, " 162") || strings.HasSuffix(op, " 163") {
+			t.Fatalf("rollout continued past the failed batch: %v", fpve.op)
+		}
+	}
+	// 160 and 161 were replaced and are rebuilt from the old digest.
+	if len(fpve.created) != 4 {
+		t.Fatalf("expected 2 replacements and 2 rollbacks, got %d creates (%v)", len(fpve.created), fpve.op)
+	}
+}
+
+func TestRollingStashesAndBacksUpEachReplicaOnce(t *testing.T) {
+	fpve := outdatedReplicas(160, 161)
+	svc := replicatedService()
+	svc.Spec.CTIDs = []int{160, 161}
+	svc.Spec.Rollout.MaxUnavailable = 1
+	svc.Spec.Rollout.Snapshot = spec.SnapshotSpec{Enabled: true, StashCTID: 9160}
+	svc.Spec.Backup = spec.BackupSpec{Storage: "pbs"}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: replicaHealth{fail: map[int]bool{161: true}}}
+	if err := rec.Reconcile(context.Background(), svc); err == nil {
+		t.Fatalf("expected the failed batch to be reported")
+	}
+	ops := strings.Join(fpve.op, ",")
+	for _, want := range []string{"clone 160 9160 from ", "clone 161 9161 from ", "clone 9161 161"} {
+		if !strings.Contains(ops, want) {
+			t.Fatalf("expected %q in %s", want, ops)
+		}
+	}
+	// Each replica is backed up before it is replaced; rolling back does
+	// not back up the broken containers again.
+	if got := strings.Count(ops, "backup"); got != 2 {
+		t.Fatalf("expected 2 backups, got %d: %s", got, ops)
+	}
+}
+
+// fakeAnalyzer records the canaries of each step and fails step failAt
+// (1-based).
+type fakeAnalyzer struct {
+	steps  [][]int
+	failAt int
+}
+
+func (a *fakeAnalyzer) Analyze(_ context.Context, canaries []spec.ServiceSpec, _ time.Duration) error {
+	var ctids []int
+	for _, c := range canaries {
+		ctids = append(ctids, c.Spec.CTID)
+	}
+	a.steps = append(a.steps, ctids)
+	if len(a.steps) == a.failAt {
+		return errors.New("error rate too high")
+	}
+	return nil
+}
+
+func canaryService() spec.ServiceSpec {
+	svc := replicatedService()
+	svc.Spec.Rollout.Strategy = "canary"
+	svc.Spec.Rollout.Canary.Steps = []spec.CanaryStep{{Count: 1}, {Percent: 50}}
+	return svc
+}
+
+func TestCanaryAdvancesThroughSteps(t *testing.T) {
+	fpve := outdatedReplicas(160, 161, 162, 163)
+	analyzer := &fakeAnalyzer{}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: replicaHealth{}, Analyzer: analyzer}
+	if err := rec.Reconcile(context.Background(), canaryService()); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if fmt.Sprint(analyzer.steps) != "[[160] [160 161]]" {
+		t.Fatalf("unexpected analysed canaries %v", analyzer.steps)
+	}
+	if len(fpve.created) != 4 {
+		t.Fatalf("expected all replicas to be updated after the last step, got %d", len(fpve.created))
+	}
+}
+
+func TestCanaryAnalyzesReplicasAlreadyUpdated(t *testing.T) {
+	svc := canaryService()
+	replicas, err := svc.Expand()
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	fpve := outdatedReplicas(161, 162, 163)
+	fpve.others[160] = pve.ActualState{
+		Exists: true, Managed: true, CTID: 160, CurrentDigest: "sha256:new", SpecHash: replicas[0].Hash(), Status: "running",
+		Config: map[string]string{"hostname": "composer-0", "net0": "name=eth0,bridge=vmbr0,ip=192.168.4.160/24"},
+	}
+	analyzer := &fakeAnalyzer{}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: replicaHealth{}, Analyzer: analyzer}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	// The first step is already met by 160, which is still analysed.
+	if fmt.Sprint(analyzer.steps) != "[[160] [160 161]]" {
+		t.Fatalf("unexpected analysed canaries %v", analyzer.steps)
+	}
+	if len(fpve.created) != 3 {
+		t.Fatalf("expected the 3 outdated replicas to be updated, got %d", len(fpve.created))
+	}
+}
+
+func TestCanaryRollsBackWhenAnalysisFails(t *testing.T) {
+	fpve := outdatedReplicas(160, 161, 162, 163)
+	analyzer := &fakeAnalyzer{failAt: 2}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: replicaHealth{}, Analyzer: analyzer}
+	err := rec.Reconcile(context.Background(), canaryService())
+	if err == nil || !strings.Contains(err.Error(), "error rate too high") {
+		t.Fatalf("expected analysis failure, got %v", err)
+	}
+	for _, op := range fpve.op {
+		if strings.HasSuffix(op, " 162") || strings.HasSuffix(op, " 163") {
+			t.Fatalf("canary continued past the failed analysis: %v", fpve.op)
+		}
+	}
+	// Two canaries were created and both are rebuilt from the old digest.
+	if len(fpve.created) != 4 || fpve.created[2].Spec.CTID != 160 || fpve.created[3].Spec.CTID != 161 {
+		t.Fatalf("expected the canaries to be rolled back, got %v", fpve.op)
+	}
+}
+
+func TestPlanDoesNotTouchContainers(t *testing.T) {
+	svc := replicatedService()
+	svc.Spec.CTIDs = []int{160, 161, 162}
+	replicas, err := svc.Expand()
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	current := replicas[2]
+	fpve := outdatedReplicas(161)
+	fpve.others[162] = pve.ActualState{
+		Exists: true, Managed: true, CTID: 162, CurrentDigest: "sha256:new", SpecHash: current.Hash(),
+		Config: map[string]string{"hostname": "composer-2", "net0": "name=eth0,bridge=vmbr0,ip=192.168.4.162/24"},
+	}
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}, Store: store}
+	plan, err := rec.Plan(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(fpve.op) != 0 {
+		t.Fatalf("plan changed containers: %v", fpve.op)
+	}
+	if entries, _ := store.List(); len(entries) != 0 {
+		t.Fatalf("plan wrote state: %+v", entries)
+	}
+	var kinds []string
+	for _, a := range plan.Actions {
+		kinds = append(kinds, string(a.Kind))
+	}
+	if strings.Join(kinds, ",") != "deploy,rollout,noop" || !plan.Changed() {
+		t.Fatalf("unexpected plan %v", kinds)
+	}
+	want := "composer (sha256:new):\n" +
+		"  ct 160: deploy none -> sha256:new: container does not exist\n" +
+		"  ct 161: rollout (rolling) sha256:old -> sha256:new: image digest changed\n" +
+		"  ct 162: noop: up to date\n"
+	if got := plan.String(); got != want {
+		t.Fatalf("unexpected rendering:\n%s", got)
+	}
+}
+
+func TestReconcilerRecordsHistoryAndHonoursPins(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	svc.Spec.Rollout.Strategy = "recreate"
+
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CurrentDigest: "sha256:old"}}
+	registry := &fakeRegistry{digest: "sha256:new"}
+	health := &failingHealth{}
+	rec := Reconciler{Registry: registry, PVE: fpve, Health: health, History: store}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+
+	// A failing rollout retried on the next tick stays one revision.
+	fpve.actual.CurrentDigest = "sha256:new"
+	registry.digest = "sha256:broken"
+	health.fails = 2
+	for range 2 {
+		if err := rec.Reconcile(context.Background(), svc); err == nil {
+			t.Fatalf("expected rollout to fail")
+		}
+	}
+	history, err := store.LoadHistory("composer")
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if len(history.Revisions) != 2 || history.Revisions[0].Outcome != "succeeded" || history.Revisions[1].Attempts != 2 {
+		t.Fatalf("unexpected history %+v", history.Revisions)
+	}
+	if _, err := history.PinRevision(2, svc.Hash()); err == nil {
+		t.Fatalf("expected pinning a failed revision to fail")
+	}
+	if _, err := history.PinRevision(1, svc.Hash()); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	if err := store.SaveHistory(history); err != nil {
+		t.Fatalf("save history: %v", err)
+	}
+
+	fpve.actual.CurrentDigest = "sha256:broken"
+	plan, err := rec.Plan(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.Digest != "sha256:new" || plan.Pinned != 1 {
+		t.Fatalf("expected plan pinned to revision 1, got %s pinned %d", plan.Digest, plan.Pinned)
+	}
+	if err := rec.Apply(context.Background(), plan); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	history, _ = store.LoadHistory("composer")
+	if last := history.Revisions[len(history.Revisions)-1]; last.Trigger != "rollback to revision 1" || last.Digest != "sha256:new" {
+		t.Fatalf("unexpected rollback revision %+v", last)
+	}
+
+	// Changing the spec releases the pin.
+	fpve.actual.CurrentDigest = "sha256:new"
+	svc.Spec.Tag = "stable"
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if history, _ = store.LoadHistory("composer"); history.Pin != nil {
+		t.Fatalf("expected pin to be cleared, got %+v", history.Pin)
+	}
+}
+
+func TestReconcilerHandlesOrphans(t *testing.T) {
+	svc := replicatedService()
+	svc.Spec.CTIDs = []int{160, 161}
+	fpve := &fakePVE{actual: pve.ActualState{CTID: 1}, others: map[int]pve.ActualState{}}
+	for _, ctid := range []int{160, 161, 162} {
+		fpve.others[ctid] = pve.ActualState{Exists: true, Managed: true, CTID: ctid, Service: "composer", Status: "running"}
+	}
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	// Container 170 predates the markers and is only known to the store.
+	fpve.others[170] = pve.ActualState{Exists: true, CTID: 170, Status: "running"}
+	if err := store.Save(state.Entry{CTID: 170, Service: "legacy", Node: "node1"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	rec := Reconciler{PVE: fpve, Health: fakeHealth{}, Store: store, Freeze: store}
+	services := []spec.ServiceSpec{svc}
+
+	orphans, err := rec.Orphans(context.Background(), services)
+	if err != nil || len(orphans) != 2 || orphans[0].CTID != 162 || orphans[1].Service != "legacy" {
+		t.Fatalf("orphans = %+v, %v", orphans, err)
+	}
+
+	if err := rec.HandleOrphans(context.Background(), services, OrphanPolicy{Action: "destroy"}); err == nil {
+		t.Fatalf("expected destroy without a grace period to be refused")
+	}
+
+	// A freeze records the orphans but leaves them running.
+	policy := OrphanPolicy{Action: "destroy", GracePeriod: time.Hour, AutoConfirm: true}
+	if err := store.SaveFreeze(state.Freeze{Reason: "release week"}); err != nil {
+		t.Fatalf("freeze: %v", err)
+	}
+	if err := rec.HandleOrphans(context.Background(), services, policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	if len(fpve.op) != 0 {
+		t.Fatalf("frozen orphans were changed: %v", fpve.op)
+	}
+	if entry, _, _ := store.Load(162); entry.OrphanedAt.IsZero() {
+		t.Fatalf("expected the frozen orphan to be recorded")
+	}
+	if err := store.RemoveFreeze(); err != nil {
+		t.Fatalf("unfreeze: %v", err)
+	}
+
+	// Within the grace period nothing happens either.
+	policy.AutoConfirm = false
+	if err := rec.HandleOrphans(context.Background(), services, policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	if len(fpve.op) != 0 {
+		t.Fatalf("orphans changed within the grace period: %v", fpve.op)
+	}
+	for _, ctid := range []int{162, 170} {
+		entry, _, _ := store.Load(ctid)
+		entry.OrphanedAt = entry.OrphanedAt.Add(-2 * time.Hour)
+		if err := store.Save(entry); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	if err := rec.HandleOrphans(context.Background(), services, policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	// Without confirmation the orphans are only stopped.
+	if got := strings.Join(fpve.op, ","); got != "stop 162,stop 170" {
+		t.Fatalf("unexpected operations %s", got)
+	}
+	entry, _, _ := store.Load(162)
+	if entry.OrphanedAt.IsZero() {
+		t.Fatalf("expected orphan to be recorded")
+	}
+	entry.DestroyConfirmed = true
+	if err := store.Save(entry); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := rec.HandleOrphans(context.Background(), services, policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "stop 162,stop 170,destroy 162" {
+		t.Fatalf("unexpected operations %s", got)
+	}
+
+	// A spec claiming 170 again clears its orphan mark.
+	legacy := spec.ServiceSpec{}
+	legacy.Metadata.Name = "legacy"
+	legacy.Spec.CTID = 170
+	if err := rec.HandleOrphans(context.Background(), append(services, legacy), policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	if entry, _, _ := store.Load(170); !entry.OrphanedAt.IsZero() {
+		t.Fatalf("expected orphan mark to be cleared")
+	}
+}
+
+func TestOrphanIsLockedAndRecheckedBeforeStop(t *testing.T) {
+	fpve := &fakePVE{actual: pve.ActualState{CTID: 1}, others: map[int]pve.ActualState{
+		162: {Exists: true, Managed: true, CTID: 162, Service: "composer", Status: "running"},
+	}}
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	rec := Reconciler{PVE: fpve, Health: fakeHealth{}, Store: store, now: func() time.Time { return now }}
+	policy := OrphanPolicy{Action: "stop", GracePeriod: time.Hour}
+	if err := rec.HandleOrphans(context.Background(), nil, policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+
+	// A renamed spec takes the container over while the orphan handler
+	// waits for its lock.
+	var locked []int
+	rec.LockCTID = func(ctid int) func() {
+		locked = append(locked, ctid)
+		fpve.mu.Lock()
+		other := fpve.others[ctid]
+		other.Service = "composer-v2"
+		fpve.others[ctid] = other
+		fpve.mu.Unlock()
+		return func() {}
+	}
+	if err := rec.HandleOrphans(context.Background(), nil, policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	if !slices.Equal(locked, []int{162}) || len(fpve.op) != 0 {
+		t.Fatalf("expected the taken over container to be left alone, locked %v, ops %v", locked, fpve.op)
+	}
+
+	rec.LockCTID = func(ctid int) func() { return func() {} }
+	fpve.others[162] = pve.ActualState{Exists: true, Managed: true, CTID: 162, Service: "composer", Status: "running"}
+	if err := rec.HandleOrphans(context.Background(), nil, policy); err != nil {
+		t.Fatalf("handle orphans: %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "stop 162" {
+		t.Fatalf("unexpected operations %s", got)
+	}
+}
+
+func TestReconcilerPauseSuspendAndFreeze(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Metadata.Annotations = map[string]string{spec.PausedAnnotation: "true"}
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Rollout.Strategy = "recreate"
+
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CurrentDigest: "sha256:old", Status: "running"}}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}, Store: store, Freeze: store}
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(fpve.op) != 0 {
+		t.Fatalf("paused service was changed: %v", fpve.op)
+	}
+
+	delete(svc.Metadata.Annotations, spec.PausedAnnotation)
+	if err := store.SaveFreeze(state.Freeze{Reason: "release week"}); err != nil {
+		t.Fatalf("freeze: %v", err)
+	}
+	plan, err := rec.Plan(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.Paused != "rollouts are frozen: release week" || plan.Changed() {
+		t.Fatalf("expected frozen plan, got %q", plan.Paused)
+	}
+	if err := store.RemoveFreeze(); err != nil {
+		t.Fatalf("unfreeze: %v", err)
+	}
+
+	svc.Metadata.Annotations[spec.SuspendedAnnotation] = "true"
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "stop" {
+		t.Fatalf("expected suspended service to be stopped, got %s", got)
+	}
+
+	// Resuming starts the stopped, otherwise up-to-date container.
+	delete(svc.Metadata.Annotations, spec.SuspendedAnnotation)
+	fpve.actual = pve.ActualState{Exists: true, Managed: true, CurrentDigest: "sha256:new", SpecHash: svc.Hash(), Status: "stopped",
+		Config: map[string]string{"hostname": "composer"}}
+	fpve.op = nil
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if got := strings.Join(fpve.op, ","); got != "start" {
+		t.Fatalf("expected resumed service to be started, got %s", got)
+	}
+}
+
+func TestReconcilerDefersRolloutsOutsideWindow(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Rollout.Window = spec.WindowSpec{Ranges: []spec.WindowRange{{Start: "22:00", End: "06:00"}}}
+
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	noon := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CurrentDigest: "sha256:old", Status: "running"}}
+	rec := Reconciler{Registry: &fakeRegistry{digest: "sha256:new"}, PVE: fpve, Health: fakeHealth{}, Store: store, now: func() time.Time { return noon }}
+	plan, err := rec.Plan(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.Changed() || plan.Deferred != "outside rollout window until 2026-10-14 22:00 UTC" {
+		t.Fatalf("expected deferred plan, got %q", plan.Deferred)
+	}
+	if err := rec.Apply(context.Background(), plan); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	entry, _, _ := store.Load(160)
+	if len(fpve.op) != 0 || !strings.HasPrefix(entry.Pending, "rollout to sha256:new") {
+		t.Fatalf("expected pending rollout, got ops %v pending %q", fpve.op, entry.Pending)
+	}
+
+	// A blackout wins over an open window.
+	night := time.Date(2026, 12, 24, 23, 0, 0, 0, time.UTC)
+	rec.now = func() time.Time { return night }
+	rec.Blackouts = []spec.Blackout{{Start: time.Date(2026, 12, 20, 0, 0, 0, 0, time.UTC), End: time.Date(2027, 1, 4, 0, 0, 0, 0, time.UTC), Reason: "holidays"}}
+	if plan, _ = rec.Plan(context.Background(), svc); !strings.HasSuffix(plan.Deferred, ": holidays") {
+		t.Fatalf("expected blackout, got %q", plan.Deferred)
+	}
+
+	rec.Blackouts = nil
+	if err := rec.Reconcile(context.Background(), svc); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if entry, _, _ = store.Load(160); len(fpve.op) == 0 || entry.Pending != "" {
+		t.Fatalf("expected rollout inside the window, got ops %v pending %q", fpve.op, entry.Pending)
+	}
+}
+
+func TestRolledBackDigestIsHeld(t *testing.T) {
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.Node = "node1"
+	svc.Spec.CTID = 160
+	svc.Spec.Image = "ghcr.io/haasonsaas/composer"
+	svc.Spec.Tag = "main"
+	svc.Spec.Rollout.Strategy = "recreate"
+	svc.Spec.Rollout.AutoRollback = true
+
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	fpve := &fakePVE{actual: pve.ActualState{Exists: true, CurrentDigest: "sha256:old"}}
+	registry := &fakeRegistry{digest: "sha256:broken"}
+	rec := Reconciler{Registry: registry, PVE: fpve, Health: &failingHealth{fails: 1}, History: store}
+	if err := rec.Reconcile(context.Background(), svc); Classify(err) != ClassRolledBack {
+		t.Fatalf("expected a rolled-back rollout, got %v", err)
+	}
+
+	// Retrying the same digest would only fail and roll back again.
+	fpve.op = nil
+	plan, err := rec.Plan(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if plan.Changed() || !strings.Contains(plan.Actions[0].Held, "rolled back") {
+		t.Fatalf("expected the rolled-back digest to be held, got %+v", plan.Actions)
+	}
+	if err := rec.Apply(context.Background(), plan); err != nil || len(fpve.op) != 0 {
+		t.Fatalf("held rollout must not touch the container, got %v (err=%v)", fpve.op, err)
+	}
+
+	// A new digest for the tag rolls out again.
+	registry.digest = "sha256:fixed"
+	if err := rec.Reconcile(context.Background(), svc); err != nil || len(fpve.op) == 0 {
+		t.Fatalf("expected the new digest to roll out, got %v (err=%v)", fpve.op, err)
+	}
+}
+
+func TestClassifyErrors(t *testing.T) {
+	cases := map[ErrorClass]error{
+		ClassTransient:      errors.New("dial tcp: connection refused"),
+		ClassLocked:         fmt.Errorf("pct [stop 160]: exit status 2: CT 160 is locked (backup)"),
+		ClassUnhealthy:      fmt.Errorf("replace ct 160: %w", classified(ClassUnhealthy, errors.New("unhealthy"))),
+		ClassRollbackFailed: rolledBack(classified(ClassUnhealthy, errors.New("unhealthy")), errors.New("restore failed")),
+	}
+	for want, err := range cases {
+		if got := Classify(err); got != want {
+			t.Errorf("%v: got %s, want %s", err, got, want)
+		}
+	}
+	if err := rolledBack(classified(ClassUnhealthy, errors.New("unhealthy")), nil); Classify(err) != ClassRolledBack {
+		t.Fatalf("a successful rollback must be classed rolled-back, got %s", Classify(err))
+	}
+
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.CTID = 160
+	svc.Spec.PullPolicy = "sometimes"
+	rec := Reconciler{Registry: &fakeRegistry{}, PVE: &fakePVE{}, Health: fakeHealth{}}
+	if _, err := rec.Plan(context.Background(), svc); !Classify(err).Permanent() {
+		t.Fatalf("expected invalid spec, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/pve"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+type replica struct {
+	svc    spec.ServiceSpec
+	actual pve.ActualState
+}
+
+// rolloutReplicas moves outdated replicas of a service to digest, letting the
+// strategy bound how many are down at once. current are the replicas already
+// running digest.
+func (r *Reconciler) rolloutReplicas(ctx context.Context, outdated []replica, current []spec.ServiceSpec, digest string) error {
+	switch strings.ToLower(outdated[0].svc.Spec.Rollout.Strategy) {
+	case "rolling":
+		return r.rolling(ctx, outdated, digest)
+	case "canary":
+		return r.canary(ctx, outdated, current, digest)
+	}
+	for _, rep := range outdated {
+		if err := r.rollout(ctx, rep.svc, rep.actual, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rolling recreates outdated replicas in batches of maxUnavailable (default
+// 1), each backed up and stashed like a single container. A batch must pass
+// its health checks before the next one starts; on failure the rollout halts
+// and, with autoRollback, every replica it touched goes back to its previous
+// digest.
+func (r *Reconciler) rolling(ctx context.Context, outdated []replica, digest string) error {
+	svc := outdated[0].svc
+	if r.Templates != nil {
+		// Import once up front instead of racing the batch for it.
+		if _, err := r.Templates.Import(ctx, svc, digest); err != nil {
+			return fmt.Errorf("import %s@%s: %w", svc.Spec.Image, digest, err)
+		}
+	}
+	size := max(svc.Spec.Rollout.MaxUnavailable, 1)
+	for start := 0; start < len(outdated); start += size {
+		batch := outdated[start:min(start+size, len(outdated))]
+		ctids := make([]int, len(batch))
+		for i, rep := range batch {
+			ctids[i] = rep.svc.Spec.CTID
+		}
+		r.Logger.Info("rolling batch", "service", svc.Metadata.Name, "ctids", ctids)
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for i, rep := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = r.recreate(ctx, rep.svc, rep.actual, digest)
+			}()
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			err = fmt.Errorf("rolling update halted at ctids %v: %w", ctids, err)
+			if !svc.Spec.Rollout.AutoRollback {
+				return err
+			}
+			r.Logger.Error("rolling update failed, rolling back", "service", svc.Metadata.Name, "error", err)
+			return rolledBack(err, r.rollBackReplicas(ctx, outdated[:start+len(batch)]))
+		}
+	}
+	return nil
+}
+
+// rollBackReplicas redeploys the previous digest on every replica that no
+// longer runs it.
+func (r *Reconciler) rollBackReplicas(ctx context.Context, touched []replica) error {
+	var errs []error
+	for _, rep := range touched {
+		previous := rep.actual.CurrentDigest
+		if previous == "" {
+			continue
+		}
+		actual, err := r.PVE.GetContainer(ctx, rep.svc.Spec.Node, rep.svc.Spec.CTID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch {
+		case !actual.Exists:
+			errs = append(errs, r.deployFresh(ctx, rep.svc, previous))
+		case actual.CurrentDigest != previous || actual.Status != "running":
+			if actual.Status == "running" {
+				if err := r.PVE.StopContainer(ctx, rep.svc.Spec.Node, rep.svc.Spec.CTID); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+			errs = append(errs, r.rollback(ctx, rep.svc, previous))
+		}
+	}
+	return errors.Join(errs...)
+}
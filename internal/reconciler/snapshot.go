@@ -0,0 +1,153 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// snapshotPrefix marks snapshots the operator owns; retention never touches
+// snapshots taken by anyone else.
+const snapshotPrefix = "pveoci-"
+
+// snapshotName names a snapshot taken at now. Microseconds keep rollouts in
+// the same second apart; Proxmox does not allow a dot in the name, and the
+// names still sort by time.
+func snapshotName(now time.Time) string {
+	now = now.UTC()
+	return fmt.Sprintf("%s%s%06d", snapshotPrefix, now.Format("20060102-150405"), now.Nanosecond()/1000)
+}
+
+// rollbackSnapshot restores the container to snapshot and starts it again.
+func (r *Reconciler) rollbackSnapshot(ctx context.Context, svc spec.ServiceSpec, snapshot string) error {
+	node, ctid := svc.Spec.Node, svc.Spec.CTID
+	actual, err := r.PVE.GetContainer(ctx, node, ctid)
+	if err != nil {
+		return err
+	}
+	if actual.Status == "running" {
+		if err := r.PVE.StopContainer(ctx, node, ctid); err != nil {
+			return err
+		}
+	}
+	if err := r.PVE.RollbackSnapshot(ctx, node, ctid, snapshot); err != nil {
+		return fmt.Errorf("rollback to snapshot %s: %w", snapshot, err)
+	}
+	if err := r.PVE.StartContainer(ctx, node, ctid); err != nil {
+		return err
+	}
+	return r.waitHealthy(ctx, svc)
+}
+
+// pruneSnapshots deletes the oldest operator snapshots beyond the retention.
+func (r *Reconciler) pruneSnapshots(ctx context.Context, svc spec.ServiceSpec) error {
+	snapshots, err := r.PVE.ListSnapshots(ctx, svc.Spec.Node, svc.Spec.CTID)
+	if err != nil {
+		return fmt.Errorf("list snapshots: %w", err)
+	}
+	var owned []string
+	for _, snap := range snapshots {
+		if strings.HasPrefix(snap.Name, snapshotPrefix) {
+			owned = append(owned, snap.Name)
+		}
+	}
+	for len(owned) > svc.Spec.Rollout.Snapshot.Retain {
+		if err := r.PVE.DeleteSnapshot(ctx, svc.Spec.Node, svc.Spec.CTID, owned[0]); err != nil {
+			return fmt.Errorf("delete snapshot %s: %w", owned[0], err)
+		}
+		owned = owned[1:]
+	}
+	return nil
+}
+
+// stash clones the container to the stash CTID so it survives the destroy
+// of a recreate rollout. The clone is made from a snapshot, so the container
+// keeps serving while it is copied; the snapshot goes once the clone exists.
+func (r *Reconciler) stash(ctx context.Context, svc spec.ServiceSpec) error {
+	node, stash := svc.Spec.Node, svc.Spec.Rollout.Snapshot.StashCTID
+	existing, err := r.PVE.GetContainer(ctx, node, stash)
+	if err != nil {
+		return err
+	}
+	if existing.Exists {
+		if existing.Service != "" && existing.Service != svc.Metadata.Name {
+			return fmt.Errorf("stash ct %d belongs to service %q", stash, existing.Service)
+		}
+		r.Logger.Warn("replacing leftover stash container", "service", svc.Metadata.Name, "stash", stash)
+		if err := r.dropStash(ctx, svc); err != nil {
+			return err
+		}
+	}
+	ctid, snapshot := svc.Spec.CTID, snapshotName(r.clock())
+	if err := r.PVE.Snapshot(ctx, node, ctid, snapshot); err != nil {
+		return fmt.Errorf("snapshot ct %d for its stash: %w", ctid, err)
+	}
+	cloneErr := r.PVE.CloneContainer(ctx, node, ctid, stash, snapshot)
+	if cloneErr != nil {
+		cloneErr = fmt.Errorf("stash ct %d as %d: %w", ctid, stash, cloneErr)
+	}
+	if err := r.PVE.DeleteSnapshot(ctx, node, ctid, snapshot); err != nil {
+		return errors.Join(cloneErr, fmt.Errorf("delete snapshot %s: %w", snapshot, err))
+	}
+	return cloneErr
+}
+
+// stashes reports whether a recreate of svc keeps the old container as a
+// stash. A clone copies every volume mount into a new volume owned by the
+// clone, so a service with volume mounts would come back on copies; it is
+// rebuilt from its previous digest instead, which reattaches the volumes.
+func stashes(svc spec.ServiceSpec) bool {
+	if !svc.Spec.Rollout.Snapshot.Enabled {
+		return false
+	}
+	for _, mount := range svc.Spec.Mounts {
+		if mount.Volume != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreStash replaces the failed container with a clone of the stash.
+func (r *Reconciler) restoreStash(ctx context.Context, svc spec.ServiceSpec) error {
+	node, ctid, stash := svc.Spec.Node, svc.Spec.CTID, svc.Spec.Rollout.Snapshot.StashCTID
+	actual, err := r.PVE.GetContainer(ctx, node, ctid)
+	if err != nil {
+		return err
+	}
+	if actual.Exists {
+		if actual.Status == "running" {
+			if err := r.PVE.StopContainer(ctx, node, ctid); err != nil {
+				return err
+			}
+		}
+		if err := r.PVE.DestroyContainer(ctx, node, ctid); err != nil {
+			return err
+		}
+	}
+	if err := r.PVE.CloneContainer(ctx, node, stash, ctid, ""); err != nil {
+		return fmt.Errorf("restore ct %d from stash %d: %w", ctid, stash, err)
+	}
+	if err := r.dropStash(ctx, svc); err != nil {
+		return err
+	}
+	if err := r.PVE.StartContainer(ctx, node, ctid); err != nil {
+		return err
+	}
+	return r.waitHealthy(ctx, svc)
+}
+
+func (r *Reconciler) dropStash(ctx context.Context, svc spec.ServiceSpec) error {
+	stash := svc.Spec.Rollout.Snapshot.StashCTID
+	if err := r.PVE.DestroyContainer(ctx, svc.Spec.Node, stash); err != nil {
+		return fmt.Errorf("destroy stash ct %d: %w", stash, err)
+	}
+	if r.Store != nil {
+		return r.Store.Remove(stash)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package reconciler
+
+import (
+	"fmt"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+	"github.com/haasonsaas/pve-oci-operator/internal/state"
+)
+
+const windowTimeLayout = "2006-01-02 15:04 MST"
+
+// deferReason says why updates and rollouts of svc must wait, or returns ""
+// when they may start now.
+func (r *Reconciler) deferReason(svc spec.ServiceSpec) string {
+	now := r.clock()
+	for _, b := range r.Blackouts {
+		if b.Active(now) {
+			reason := "blackout until " + b.End.Format(windowTimeLayout)
+			if b.Reason != "" {
+				reason += ": " + b.Reason
+			}
+			return reason
+		}
+	}
+	window := svc.Spec.Rollout.Window
+	if window.Open(now) {
+		return ""
+	}
+	if next := window.Next(now); !next.IsZero() {
+		return "outside rollout window until " + next.Format(windowTimeLayout)
+	}
+	return "outside rollout window"
+}
+
+// recordPending stores what a held action is waiting for in the state entry
+// and clears it once nothing is held.
+func (r *Reconciler) recordPending(a Action) error {
+	if r.Store == nil {
+		return nil
+	}
+	var pending string
+	if a.Held != "" {
+		pending = fmt.Sprintf("%s to %s: %s", a.Kind, a.To, a.Held)
+	}
+	return r.Store.Update(a.CTID, func(entry *state.Entry, found bool) error {
+		if !found && pending != "" {
+			*entry = state.Entry{CTID: a.CTID, Service: a.svc.Metadata.Name, Node: a.svc.Spec.Node}
+		}
+		entry.Pending = pending
+		return nil
+	})
+}
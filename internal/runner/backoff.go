@@ -0,0 +1,93 @@
+package runner
+
+import (
+	"maps"
+	"math/rand/v2"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/reconciler"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// backoff is the retry state of a failing service. It is dropped when the
+// service reconciles cleanly or its spec or annotations change.
+type backoff struct {
+	specHash    string
+	annotations map[string]string
+	failures    int
+	class       reconciler.ErrorClass
+	next        time.Time
+}
+
+// stale reports whether svc changed since the backoff started.
+func (b *backoff) stale(svc spec.ServiceSpec) bool {
+	return b.specHash != svc.Hash() || !maps.Equal(b.annotations, svc.Metadata.Annotations)
+}
+
+// waiting reports whether svc must sit this tick out, and why.
+func (r *Runner) waiting(svc spec.ServiceSpec, now time.Time) (*backoff, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.backoffs[svc.Metadata.Name]
+	if !ok {
+		return nil, false
+	}
+	if b.stale(svc) {
+		delete(r.backoffs, svc.Metadata.Name)
+		return nil, false
+	}
+	return b, b.class.Permanent() || now.Before(b.next)
+}
+
+// fail records a failure of svc and returns its updated backoff.
+func (r *Runner) fail(svc spec.ServiceSpec, err error, now time.Time) *backoff {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backoffs == nil {
+		r.backoffs = make(map[string]*backoff)
+	}
+	b, ok := r.backoffs[svc.Metadata.Name]
+	if !ok || b.stale(svc) {
+		b = &backoff{specHash: svc.Hash(), annotations: maps.Clone(svc.Metadata.Annotations)}
+		r.backoffs[svc.Metadata.Name] = b
+	}
+	b.failures++
+	b.class = reconciler.Classify(err)
+	b.next = now.Add(retryDelay(r.Interval, r.MaxBackoff, b.failures, rand.Float64()))
+	return b
+}
+
+// succeeded drops the backoff of svc.
+func (r *Runner) succeeded(svc spec.ServiceSpec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.backoffs, svc.Metadata.Name)
+}
+
+// skipFiles reports spec files that cannot be loaded. Like a permanent
+// error, a file is reported once and then waits until its content changes.
+func (r *Runner) skipFiles(skipped []spec.FileError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	broken := make(map[string]string, len(skipped))
+	for _, f := range skipped {
+		broken[f.File] = f.Hash
+		if hash, ok := r.broken[f.File]; ok && hash == f.Hash {
+			r.Logger.Debug("skipping spec file", "file", f.File)
+			continue
+		}
+		r.Logger.Error("skipping spec file", "file", f.File, "error", f.Err, "retry", "after the file changes")
+	}
+	r.broken = broken
+}
+
+// retryDelay doubles base for every failure after the first, caps it at
+// limit and spreads it by ±20% using jitter in [0, 1).
+func retryDelay(base, limit time.Duration, failures int, jitter float64) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+	return time.Duration(float64(delay) * (0.8 + 0.4*jitter))
+}
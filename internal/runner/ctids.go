@@ -0,0 +1,49 @@
+package runner
+
+import "sync"
+
+// ctidLocks serializes work per container: a worker holds every CTID its
+// service claims while it reconciles the service, so two specs that claim
+// the same container, such as a renamed spec and its predecessor, never
+// change it at the same time.
+type ctidLocks struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	held map[int]bool
+}
+
+func newCTIDLocks() *ctidLocks {
+	l := &ctidLocks{held: make(map[int]bool)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// lock waits until none of ctids is held, takes them all and returns the
+// function that releases them.
+func (l *ctidLocks) lock(ctids []int) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.anyHeld(ctids) {
+		l.cond.Wait()
+	}
+	for _, ctid := range ctids {
+		l.held[ctid] = true
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, ctid := range ctids {
+			delete(l.held, ctid)
+		}
+		l.cond.Broadcast()
+	}
+}
+
+func (l *ctidLocks) anyHeld(ctids []int) bool {
+	for _, ctid := range ctids {
+		if l.held[ctid] {
+			return true
+		}
+	}
+	return false
+}
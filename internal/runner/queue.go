@@ -0,0 +1,150 @@
+package runner
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// queue hands services to workers, keyed by service name. A service is in
+// the queue at most once: adding it while it waits only refreshes its spec,
+// and adding it while a worker reconciles it marks it dirty, so that it is
+// queued again with the newest spec once the worker is done.
+type queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting []string
+	// specs holds the spec of every waiting or active service and done a
+	// channel that is closed when it leaves the queue.
+	specs  map[string]spec.ServiceSpec
+	active map[string]bool
+	dirty  map[string]spec.ServiceSpec
+	done   map[string]chan struct{}
+	closed bool
+}
+
+func newQueue() *queue {
+	q := &queue{specs: make(map[string]spec.ServiceSpec), active: make(map[string]bool), dirty: make(map[string]spec.ServiceSpec), done: make(map[string]chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// add queues svc and reports whether it was not queued yet.
+func (q *queue) add(svc spec.ServiceSpec) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	name := svc.Metadata.Name
+	if q.closed {
+		return false
+	}
+	if q.active[name] {
+		q.dirty[name] = svc
+		return false
+	}
+	_, queued := q.specs[name]
+	q.specs[name] = svc
+	if queued {
+		return false
+	}
+	q.waiting = append(q.waiting, name)
+	q.done[name] = make(chan struct{})
+	q.cond.Signal()
+	return true
+}
+
+// get blocks until a service is ready for a worker and returns false once
+// the queue is shut down. Services are handed out in the order they were
+// added, except that one whose dependency still waits goes after it.
+func (q *queue) get() (spec.ServiceSpec, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.waiting) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return spec.ServiceSpec{}, false
+	}
+	i := q.next()
+	name := q.waiting[i]
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	q.active[name] = true
+	return q.specs[name], true
+}
+
+// next picks the first waiting service none of whose dependencies wait. If
+// every one does, stale specs form a cycle and the oldest goes first.
+func (q *queue) next() int {
+	for i, name := range q.waiting {
+		ready := true
+		for _, dep := range q.specs[name].Spec.DependsOn {
+			if _, ok := q.specs[dep]; ok && !q.active[dep] {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			return i
+		}
+	}
+	return 0
+}
+
+// finish removes a service a worker is done with, or queues it again when
+// it was added in the meantime.
+func (q *queue) finish(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.active, name)
+	// Whoever waits for this run may go on, even if another one follows.
+	close(q.done[name])
+	delete(q.done, name)
+	svc, ok := q.dirty[name]
+	delete(q.dirty, name)
+	if !ok || q.closed {
+		delete(q.specs, name)
+		return
+	}
+	q.specs[name] = svc
+	q.waiting = append(q.waiting, name)
+	q.done[name] = make(chan struct{})
+	q.cond.Signal()
+}
+
+// wait blocks until the queued or active run of name is done and reports
+// whether there was one.
+func (q *queue) wait(ctx context.Context, name string) (bool, error) {
+	q.mu.Lock()
+	done, ok := q.done[name]
+	q.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	select {
+	case <-done:
+		return true, nil
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// pending returns the specs of every waiting or active service.
+func (q *queue) pending() []spec.ServiceSpec {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	specs := make([]spec.ServiceSpec, 0, len(q.specs))
+	for _, svc := range q.specs {
+		specs = append(specs, svc)
+	}
+	return specs
+}
+
+// shutDown wakes every worker blocked in get. Services still waiting are
+// dropped.
+func (q *queue) shutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -2,7 +2,12 @@ package runner
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"reflect"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/haasonsaas/pve-oci-operator/internal/reconciler"
@@ -12,20 +17,77 @@ import (
 type Runner struct {
 	Reconciler  *reconciler.Reconciler
 	ServicesDir string
-	Interval    time.Duration
-	Logger      *slog.Logger
+	// Interval is how often every service is reconciled, whether or not its
+	// spec changed. Edited specs are picked up sooner by watching
+	// ServicesDir.
+	Interval time.Duration
+	// Debounce is how long the spec files must be left alone after a change
+	// before the changed services are queued. It defaults to 1s.
+	Debounce time.Duration
+	// Workers is how many services are reconciled at once. It defaults to
+	// 4.
+	Workers int
+	// DryRun logs each service's plan instead of applying it.
+	DryRun bool
+	// DependencyTimeout bounds how long a service waits for the services it
+	// depends on to finish reconciling and to pass their health checks.
+	DependencyTimeout time.Duration
+	// Orphans decides what happens to managed containers whose spec was
+	// removed.
+	Orphans reconciler.OrphanPolicy
+	// MaxBackoff caps how long a failing service waits before it is
+	// retried. The first retry waits one Interval.
+	MaxBackoff time.Duration
+	Logger     *slog.Logger
+
+	queue *queue
+	ctids *ctidLocks
+	// orphanJobs hands the specs of the latest sync to the orphan handler.
+	// It holds one job; a newer sync replaces a job not yet started.
+	orphanJobs chan []spec.ServiceSpec
+
+	mu       sync.Mutex
+	services map[string]spec.ServiceSpec
+	backoffs map[string]*backoff
+	// broken maps each spec file that cannot be loaded to the hash of its
+	// content when it was last reported.
+	broken map[string]string
+	// outcomes holds how the last run of each service ended, for its
+	// dependents.
+	outcomes map[string]outcome
 }
 
 func (r *Runner) Start(ctx context.Context) error {
 	if r.Logger == nil {
 		r.Logger = slog.Default()
 	}
+	if r.Reconciler.Logger == nil {
+		r.Reconciler.Logger = r.Logger
+	}
 	if r.Interval == 0 {
 		r.Interval = 10 * time.Second
 	}
+	if r.Debounce == 0 {
+		r.Debounce = time.Second
+	}
+	if r.Workers <= 0 {
+		r.Workers = 4
+	}
+	if r.DependencyTimeout == 0 {
+		r.DependencyTimeout = 2 * time.Minute
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 30 * time.Minute
+	}
+	var wg sync.WaitGroup
+	r.startWorkers(ctx, &wg)
+	defer wg.Wait()
+	defer r.queue.shutDown()
+	defer close(r.orphanJobs)
+	changed := r.watch(ctx)
 	ticker := time.NewTicker(r.Interval)
 	defer ticker.Stop()
-	if err := r.runOnce(ctx); err != nil {
+	if err := r.sync(true); err != nil {
 		return err
 	}
 	for {
@@ -33,21 +95,232 @@ func (r *Runner) Start(ctx context.Context) error {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			if err := r.runOnce(ctx); err != nil {
+			if err := r.sync(true); err != nil {
 				r.Logger.Error("reconcile tick failed", "error", err)
 			}
+		case <-changed:
+			if err := r.sync(false); err != nil {
+				r.Logger.Error("reloading changed specs failed", "error", err)
+			}
 		}
 	}
 }
 
-func (r *Runner) runOnce(ctx context.Context) error {
-	services, err := spec.LoadServiceSpecs(r.ServicesDir)
+// startWorkers starts the workers and the orphan handler, which runs apart
+// from the sync loop so that stopping or destroying orphans never holds up
+// queueing services.
+func (r *Runner) startWorkers(ctx context.Context, wg *sync.WaitGroup) {
+	r.queue, r.ctids = newQueue(), newCTIDLocks()
+	r.orphanJobs = make(chan []spec.ServiceSpec, 1)
+	r.Reconciler.LockCTID = func(ctid int) func() { return r.ctids.lock([]int{ctid}) }
+	for range r.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for services := range r.orphanJobs {
+			if err := r.orphans(ctx, services); err != nil {
+				r.Logger.Error("orphan handling failed", "error", err)
+			}
+		}
+	}()
+}
+
+// sync loads the specs, queues every service when all is set and only the
+// new or changed ones otherwise, and queues orphan handling. A service that is
+// still queued or being reconciled is not queued twice, so a slow rollout
+// only delays itself and its dependents.
+func (r *Runner) sync(all bool) error {
+	services, skipped, err := spec.LoadServiceSpecs(r.ServicesDir)
 	if err != nil {
 		return err
 	}
+	r.skipFiles(skipped)
+	queue := r.refresh(services)
+	if all {
+		queue = services
+	}
+	for _, svc := range queue {
+		if !r.queue.add(svc) {
+			r.Logger.Debug("service already queued", "service", svc.Metadata.Name)
+		}
+	}
+	if len(skipped) > 0 {
+		// The containers of a service whose file is broken would look
+		// orphaned.
+		r.Logger.Warn("orphan handling held while spec files are broken", "files", len(skipped))
+		return nil
+	}
+	// A service whose spec was removed while it is being reconciled keeps
+	// its containers until the worker is done with them.
+	r.queueOrphans(slices.Concat(services, r.queue.pending()))
+	return nil
+}
+
+// queueOrphans queues orphan handling for services, replacing a queued run
+// that has not started yet. Only sync queues, so the send never blocks.
+func (r *Runner) queueOrphans(services []spec.ServiceSpec) {
+	select {
+	case <-r.orphanJobs:
+		r.Logger.Debug("orphan handling still busy, replacing queued run")
+	default:
+	}
+	r.orphanJobs <- services
+}
+
+// refresh replaces the known specs with services and returns the services
+// that are new or differ from the spec known before.
+func (r *Runner) refresh(services []spec.ServiceSpec) []spec.ServiceSpec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var changed []spec.ServiceSpec
+	known := make(map[string]spec.ServiceSpec, len(services))
 	for _, svc := range services {
-		if err := r.Reconciler.Reconcile(ctx, svc); err != nil {
-			r.Logger.Error("reconcile failed", "service", svc.Metadata.Name, "error", err)
+		if prev, ok := r.services[svc.Metadata.Name]; !ok || !reflect.DeepEqual(prev, svc) {
+			changed = append(changed, svc)
+		}
+		known[svc.Metadata.Name] = svc
+	}
+	r.services = known
+	return changed
+}
+
+// outcome is how one run of a service ended.
+type outcome int
+
+const (
+	// outcomeReconciled means the plan was applied, or logged in a dry run.
+	outcomeReconciled outcome = iota
+	// outcomeFailed means planning or applying the plan failed.
+	outcomeFailed
+	// outcomeSkipped means nothing was tried, because the service backs off
+	// or waits for its dependencies.
+	outcomeSkipped
+)
+
+func (r *Runner) work(ctx context.Context) {
+	for {
+		svc, ok := r.queue.get()
+		if !ok {
+			return
+		}
+		result := r.reconcile(ctx, svc)
+		r.mu.Lock()
+		if r.outcomes == nil {
+			r.outcomes = make(map[string]outcome)
+		}
+		r.outcomes[svc.Metadata.Name] = result
+		r.mu.Unlock()
+		r.queue.finish(svc.Metadata.Name)
+	}
+}
+
+// reconcile plans and applies svc once its dependencies are reconciled. It
+// is skipped when a dependency it waited for failed, and a plan with changes
+// only rolls out once the dependencies are healthy. A failing service backs
+// off: permanent errors wait for a spec change, others are retried after an
+// exponentially growing delay.
+func (r *Runner) reconcile(ctx context.Context, svc spec.ServiceSpec) outcome {
+	name := svc.Metadata.Name
+	if dep, err := r.awaitDependencies(ctx, svc); err != nil {
+		r.Logger.Warn("skipping service", "service", name, "dependency", dep, "error", err)
+		return outcomeSkipped
+	}
+	if b, wait := r.waiting(svc, time.Now()); wait {
+		r.Logger.Debug("backing off", "service", name, "class", b.class, "failures", b.failures, "retryAt", b.next)
+		return outcomeSkipped
+	}
+	unlock := r.ctids.lock(svc.ClaimedCTIDs())
+	defer unlock()
+	plan, err := r.Reconciler.Plan(ctx, svc)
+	if err != nil {
+		r.failed(svc, "plan failed", err)
+		return outcomeFailed
+	}
+	if r.DryRun {
+		r.Logger.Info("dry run", "service", name, "changed", plan.Changed(), "plan", plan)
+		return outcomeReconciled
+	}
+	if plan.Changed() {
+		if err := r.dependenciesReady(ctx, svc); err != nil {
+			r.Logger.Warn("rollout waiting for dependencies", "service", name, "error", err)
+			return outcomeSkipped
+		}
+	}
+	if err := r.Reconciler.Apply(ctx, plan); err != nil {
+		r.failed(svc, "reconcile failed", err)
+		return outcomeFailed
+	}
+	r.succeeded(svc)
+	return outcomeReconciled
+}
+
+// awaitDependencies waits up to DependencyTimeout for the runs of the
+// dependencies of svc that are queued or in progress. It fails with the
+// first dependency that is still busy or whose run failed. A dependency
+// that merely backs off, or failed in an earlier run, does not hold svc
+// back; the health check before its rollout decides then.
+func (r *Runner) awaitDependencies(ctx context.Context, svc spec.ServiceSpec) (string, error) {
+	if len(svc.Spec.DependsOn) == 0 {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.DependencyTimeout)
+	defer cancel()
+	for _, dep := range svc.Spec.DependsOn {
+		waited, err := r.queue.wait(ctx, dep)
+		if err != nil {
+			return dep, fmt.Errorf("dependency still reconciling: %w", err)
+		}
+		r.mu.Lock()
+		result := r.outcomes[dep]
+		r.mu.Unlock()
+		if waited && result == outcomeFailed {
+			return dep, errors.New("dependency failed")
+		}
+	}
+	return "", nil
+}
+
+func (r *Runner) orphans(ctx context.Context, services []spec.ServiceSpec) error {
+	if !r.DryRun {
+		return r.Reconciler.HandleOrphans(ctx, services, r.Orphans)
+	}
+	orphans, err := r.Reconciler.Orphans(ctx, services)
+	if err != nil {
+		return err
+	}
+	for _, orphan := range orphans {
+		r.Logger.Info("dry run: container has no spec", "ctid", orphan.CTID, "service", orphan.Service, "policy", r.Orphans.Action)
+	}
+	return nil
+}
+
+func (r *Runner) failed(svc spec.ServiceSpec, msg string, err error) {
+	b := r.fail(svc, err, time.Now())
+	if b.class.Permanent() {
+		r.Logger.Error(msg, "service", svc.Metadata.Name, "class", b.class, "error", err, "retry", "after the spec changes")
+		return
+	}
+	r.Logger.Error(msg, "service", svc.Metadata.Name, "class", b.class, "error", err, "failures", b.failures, "retryAt", b.next)
+}
+
+func (r *Runner) dependenciesReady(ctx context.Context, svc spec.ServiceSpec) error {
+	if len(svc.Spec.DependsOn) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.DependencyTimeout)
+	defer cancel()
+	for _, dep := range svc.Spec.DependsOn {
+		r.mu.Lock()
+		depSvc := r.services[dep]
+		r.mu.Unlock()
+		if err := r.Reconciler.Ready(ctx, depSvc); err != nil {
+			return fmt.Errorf("%s not ready: %w", dep, err)
 		}
 	}
 	return nil
@@ -0,0 +1,420 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haasonsaas/pve-oci-operator/internal/pve"
+	"github.com/haasonsaas/pve-oci-operator/internal/reconciler"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		failures int
+		jitter   float64
+		want     time.Duration
+	}{
+		{1, 0.5, 10 * time.Second},
+		{3, 0.5, 40 * time.Second},
+		{10, 0.5, 5 * time.Minute},
+		{1, 0, 8 * time.Second},
+		{1, 0.999999, 12 * time.Second},
+	}
+	for _, c := range cases {
+		got := retryDelay(10*time.Second, 5*time.Minute, c.failures, c.jitter)
+		if got.Round(time.Second) != c.want {
+			t.Errorf("failures %d jitter %v: got %s, want %s", c.failures, c.jitter, got, c.want)
+		}
+	}
+}
+
+func TestBackoffWaitsForSpecChangeOnPermanentErrors(t *testing.T) {
+	r := &Runner{Interval: 10 * time.Second, MaxBackoff: time.Minute}
+	svc := spec.ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	now := time.Now()
+
+	r.fail(svc, errors.New("registry unreachable"), now)
+	if _, wait := r.waiting(svc, now); !wait {
+		t.Fatalf("expected transient failure to back off")
+	}
+	if _, wait := r.waiting(svc, now.Add(time.Minute)); wait {
+		t.Fatalf("expected retry once the delay passed")
+	}
+
+	b := r.fail(svc, &reconciler.Error{Class: reconciler.ClassRollbackFailed, Err: errors.New("restore failed")}, now)
+	if b.failures != 2 {
+		t.Fatalf("expected failures to accumulate, got %d", b.failures)
+	}
+	if _, wait := r.waiting(svc, now.Add(24*time.Hour)); !wait {
+		t.Fatalf("expected permanent failure to wait")
+	}
+	svc.Spec.Tag = "fixed"
+	if _, wait := r.waiting(svc, now); wait {
+		t.Fatalf("expected spec change to clear the backoff")
+	}
+
+	r.fail(svc, &reconciler.Error{Class: reconciler.ClassInvalidSpec, Err: errors.New("bad mount")}, now)
+	svc.Metadata.Annotations = map[string]string{spec.PausedAnnotation: "true"}
+	if _, wait := r.waiting(svc, now); wait {
+		t.Fatalf("expected an annotation change to clear the backoff")
+	}
+}
+
+func TestSyncSkipsBrokenSpecFiles(t *testing.T) {
+	dir := t.TempDir()
+	good := "apiVersion: pve.haasonsaas/v1\nkind: Service\nmetadata:\n  name: web\nspec:\n  node: pve1\n  ctid: 170\n  image: ghcr.io/haasonsaas/web\n"
+	files := map[string]string{"web.yaml": good, "db.yaml": "metadata: [\n"}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Orphan handling would need a reconciler; it is held while a file is
+	// broken.
+	r := &Runner{ServicesDir: dir, Logger: slog.New(slog.DiscardHandler), queue: newQueue()}
+	if err := r.sync(true); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	pending := r.queue.pending()
+	if len(pending) != 1 || pending[0].Metadata.Name != "web" {
+		t.Fatalf("expected web to be queued, got %v", pending)
+	}
+	hash, ok := r.broken["db.yaml"]
+	if !ok || hash == "" {
+		t.Fatalf("expected db.yaml to be recorded as broken, got %v", r.broken)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "db.yaml"), []byte("metadata: {\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.sync(false); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if r.broken["db.yaml"] == hash {
+		t.Fatalf("expected the edited file to be reported again")
+	}
+}
+
+func TestQueueDeduplicatesAndOrdersByDependency(t *testing.T) {
+	q := newQueue()
+	web := spec.ServiceSpec{}
+	web.Metadata.Name = "web"
+	web.Spec.DependsOn = []string{"db"}
+	db := spec.ServiceSpec{}
+	db.Metadata.Name = "db"
+
+	if !q.add(web) || !q.add(db) {
+		t.Fatalf("expected both services to be queued")
+	}
+	web.Spec.Tag = "v2"
+	if q.add(web) {
+		t.Fatalf("expected a waiting service not to be queued twice")
+	}
+	first, _ := q.get()
+	if first.Metadata.Name != "db" {
+		t.Fatalf("expected db before its dependent, got %s", first.Metadata.Name)
+	}
+	db.Spec.Tag = "v2"
+	if q.add(db) {
+		t.Fatalf("expected an active service not to be queued twice")
+	}
+	second, _ := q.get()
+	if second.Metadata.Name != "web" || second.Spec.Tag != "v2" {
+		t.Fatalf("expected the refreshed web spec, got %+v", second)
+	}
+
+	waited := make(chan error)
+	go func() {
+		_, err := q.wait(context.Background(), "db")
+		waited <- err
+	}()
+	select {
+	case <-waited:
+		t.Fatalf("wait returned while db is active")
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.finish("db")
+	if err := <-waited; err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	// db changed while it was being reconciled, so it runs again.
+	again, _ := q.get()
+	if again.Metadata.Name != "db" || again.Spec.Tag != "v2" {
+		t.Fatalf("expected db to be queued again with its new spec, got %+v", again)
+	}
+	q.finish("db")
+	if len(q.pending()) != 1 {
+		t.Fatalf("expected only web to be pending, got %v", q.pending())
+	}
+
+	q.shutDown()
+	if _, ok := q.get(); ok {
+		t.Fatalf("expected get to stop after shutdown")
+	}
+}
+
+func TestCTIDLocksSerializeOverlappingServices(t *testing.T) {
+	locks := newCTIDLocks()
+	unlock := locks.lock([]int{160, 161})
+	locked := make(chan struct{})
+	go func() {
+		locks.lock([]int{161, 170})()
+		close(locked)
+	}()
+	locks.lock([]int{162})()
+	select {
+	case <-locked:
+		t.Fatalf("overlapping CTIDs were locked twice")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
+
+func TestRefreshReturnsChangedServices(t *testing.T) {
+	r := &Runner{}
+	web := spec.ServiceSpec{}
+	web.Metadata.Name = "web"
+	db := spec.ServiceSpec{}
+	db.Metadata.Name = "db"
+	if changed := r.refresh([]spec.ServiceSpec{web, db}); len(changed) != 2 {
+		t.Fatalf("expected new services to count as changed, got %d", len(changed))
+	}
+	web.Metadata.Annotations = map[string]string{"pve.haasonsaas/paused": "true"}
+	changed := r.refresh([]spec.ServiceSpec{web, db})
+	if len(changed) != 1 || changed[0].Metadata.Name != "web" {
+		t.Fatalf("expected only web to change, got %v", changed)
+	}
+	if changed := r.refresh([]spec.ServiceSpec{web}); len(changed) != 0 {
+		t.Fatalf("expected a removed service not to be queued, got %v", changed)
+	}
+}
+
+func TestWatchDebouncesSpecChanges(t *testing.T) {
+	dir := t.TempDir()
+	r := &Runner{ServicesDir: dir, Debounce: 50 * time.Millisecond, Logger: slog.Default()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := r.watch(ctx)
+	if changed == nil {
+		t.Skip("fsnotify is not available")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+		t.Fatalf("a non-spec file triggered a reload")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	for _, name := range []string{"web.yaml", "db.yml", "web.yaml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("metadata: {}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a reload after the specs changed")
+	}
+	select {
+	case <-changed:
+		t.Fatalf("expected one reload for a burst of writes")
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+type fakeRegistry struct{}
+
+func (fakeRegistry) ResolveDigest(context.Context, string, string) (string, error) {
+	return "sha256:abc", nil
+}
+
+// fakePVE records which containers were created; containers holds the ones
+// that exist up front. Methods a fresh deploy does not call are left to the
+// embedded nil Client.
+type fakePVE struct {
+	pve.Client
+	created    chan int
+	containers map[int]pve.ActualState
+}
+
+func (f *fakePVE) GetContainer(_ context.Context, node string, ctid int) (pve.ActualState, error) {
+	if actual, ok := f.containers[ctid]; ok {
+		return actual, nil
+	}
+	return pve.ActualState{CTID: ctid, Node: node}, nil
+}
+
+func (f *fakePVE) CreateContainer(_ context.Context, svc spec.ServiceSpec, _, _ string) error {
+	f.created <- svc.Spec.CTID
+	return nil
+}
+
+func (f *fakePVE) StartContainer(context.Context, string, int) error { return nil }
+
+func (f *fakePVE) ListManaged(context.Context) ([]pve.ActualState, error) { return nil, nil }
+
+// blockingHealth holds the health check of the service named block until
+// release is closed.
+type blockingHealth struct {
+	block   string
+	release chan struct{}
+}
+
+func (h blockingHealth) Wait(ctx context.Context, svc spec.ServiceSpec) error {
+	if svc.Metadata.Name != h.block {
+		return nil
+	}
+	select {
+	case <-h.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestSlowHealthCheckDoesNotStallOtherServices(t *testing.T) {
+	dir := t.TempDir()
+	writeSpec(t, dir, "slow", 170)
+	writeSpec(t, dir, "fast", 171)
+	created := make(chan int, 2)
+	health := blockingHealth{block: "slow", release: make(chan struct{})}
+	r := startRunner(t, dir, &fakePVE{created: created}, health)
+
+	seen := map[int]bool{}
+	timeout := time.After(5 * time.Second)
+	for !seen[170] || !seen[171] {
+		select {
+		case ctid := <-created:
+			seen[ctid] = true
+		case <-timeout:
+			t.Fatalf("created %v, want both services while slow is still checked", seen)
+		}
+	}
+	r.mu.Lock()
+	result, ok := r.outcomes["fast"]
+	r.mu.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		r.mu.Lock()
+		result, ok = r.outcomes["fast"]
+		r.mu.Unlock()
+	}
+	if !ok || result != outcomeReconciled {
+		t.Fatalf("fast did not finish while slow was checked: %v %v", ok, result)
+	}
+}
+
+func TestDependentWaitsForHealthyDependencies(t *testing.T) {
+	dir := t.TempDir()
+	db := writeSpec(t, dir, "db", 170)
+	writeSpec(t, dir, "web", 171, "db")
+	// db is deployed and up to date, so only its health check stands
+	// between web and its rollout.
+	created := make(chan int, 2)
+	fpve := &fakePVE{created: created, containers: map[int]pve.ActualState{
+		170: {Exists: true, Managed: true, CTID: 170, Node: "pve1", Status: "running", Service: "db", CurrentDigest: "sha256:abc", SpecHash: db.Hash()},
+	}}
+	health := blockingHealth{block: "db", release: make(chan struct{})}
+	startRunner(t, dir, fpve, health)
+
+	select {
+	case ctid := <-created:
+		t.Fatalf("ct %d was created before db passed its health check", ctid)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(health.release)
+	select {
+	case ctid := <-created:
+		if ctid != 171 {
+			t.Fatalf("unexpected container %d", ctid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("web was not rolled out once db was healthy")
+	}
+}
+
+// writeSpec writes a minimal spec for name into dir and returns it parsed.
+func writeSpec(t *testing.T, dir, name string, ctid int, dependsOn ...string) spec.ServiceSpec {
+	t.Helper()
+	data := fmt.Sprintf("apiVersion: pve.haasonsaas/v1\nkind: Service\nmetadata:\n  name: %s\nspec:\n  node: pve1\n  ctid: %d\n  image: ghcr.io/haasonsaas/%s\n  tag: main\n", name, ctid, name)
+	if len(dependsOn) > 0 {
+		data += fmt.Sprintf("  dependsOn: [%s]\n", strings.Join(dependsOn, ", "))
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".yaml"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := spec.ParseServiceSpec([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+// startRunner runs a runner for the specs in dir until the test ends. A
+// blocked health check is released first.
+func startRunner(t *testing.T, dir string, client pve.Client, health blockingHealth) *Runner {
+	t.Helper()
+	r := &Runner{
+		Reconciler:  &reconciler.Reconciler{Registry: fakeRegistry{}, PVE: client, Health: health},
+		ServicesDir: dir,
+		Interval:    time.Hour,
+		Workers:     2,
+		Logger:      slog.New(slog.DiscardHandler),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.Start(ctx) }()
+	t.Cleanup(func() {
+		select {
+		case <-health.release:
+		default:
+			close(health.release)
+		}
+		cancel()
+		<-done
+	})
+	return r
+}
+
+func TestDependentsSkipOnlyFailedRuns(t *testing.T) {
+	r := &Runner{DependencyTimeout: time.Second, queue: newQueue()}
+	web := spec.ServiceSpec{}
+	web.Metadata.Name = "web"
+	web.Spec.DependsOn = []string{"db"}
+
+	// A failure from an earlier run, or a run that only backed off, leaves
+	// the decision to the health check before the rollout.
+	r.outcomes = map[string]outcome{"db": outcomeFailed}
+	if _, err := r.awaitDependencies(context.Background(), web); err != nil {
+		t.Fatalf("earlier failure skipped the dependent: %v", err)
+	}
+	for _, result := range []outcome{outcomeSkipped, outcomeFailed} {
+		db := spec.ServiceSpec{}
+		db.Metadata.Name = "db"
+		r.queue.add(db)
+		r.queue.get()
+		go func() {
+			r.mu.Lock()
+			r.outcomes["db"] = result
+			r.mu.Unlock()
+			r.queue.finish("db")
+		}()
+		_, err := r.awaitDependencies(context.Background(), web)
+		if (err != nil) != (result == outcomeFailed) {
+			t.Fatalf("outcome %d: got %v", result, err)
+		}
+	}
+}
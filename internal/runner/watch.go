@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/haasonsaas/pve-oci-operator/internal/spec"
+)
+
+// watch signals on the returned channel once the spec files in ServicesDir
+// changed and then stayed untouched for Debounce, so that saving several
+// files, or one file in several writes, reloads the specs once. It returns
+// nil when the directory cannot be watched, leaving the periodic resync as
+// the only trigger.
+func (r *Runner) watch(ctx context.Context) <-chan struct{} {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		r.Logger.Warn("cannot watch services, polling only", "dir", r.ServicesDir, "error", err)
+		return nil
+	}
+	if err := watcher.Add(r.ServicesDir); err != nil {
+		watcher.Close()
+		r.Logger.Warn("cannot watch services, polling only", "dir", r.ServicesDir, "error", err)
+		return nil
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		var settled <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod || !spec.IsSpecFile(event.Name) {
+					continue
+				}
+				settled = time.After(r.Debounce)
+			case <-settled:
+				settled = nil
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				r.Logger.Warn("watching services failed", "dir", r.ServicesDir, "error", err)
+			}
+		}
+	}()
+	return changed
+}
@@ -0,0 +1,41 @@
+package spec
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// PausedAnnotation set to "true" stops the operator from changing the
+	// service's containers. Drift is still detected and reported.
+	PausedAnnotation = "pve.haasonsaas/paused"
+	// SuspendedAnnotation set to "true" stops the service's containers and
+	// keeps them stopped until it is removed.
+	SuspendedAnnotation = "pve.haasonsaas/suspended"
+)
+
+// Paused reports whether the service is paused.
+func (s ServiceSpec) Paused() bool {
+	return s.Metadata.annotation(PausedAnnotation)
+}
+
+// Suspended reports whether the service is suspended.
+func (s ServiceSpec) Suspended() bool {
+	return s.Metadata.annotation(SuspendedAnnotation)
+}
+
+func (m MetadataSpec) annotation(key string) bool {
+	on, _ := strconv.ParseBool(m.Annotations[key])
+	return on
+}
+
+func (m MetadataSpec) validateAnnotations() error {
+	for _, key := range []string{PausedAnnotation, SuspendedAnnotation} {
+		if value, ok := m.Annotations[key]; ok {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("metadata.annotations: %s must be true or false", key)
+			}
+		}
+	}
+	return nil
+}
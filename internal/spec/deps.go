@@ -0,0 +1,115 @@
+package spec
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Order sorts services so every service comes after the services it depends
+// on; among the services whose dependencies are met, the one listed first
+// goes first. Services that cannot be ordered are left out and returned in
+// rejected, keyed by their index in services: both copies of a duplicate
+// name, services with an unknown dependency, the members of a dependency
+// cycle and every service that depends on one of those. The rest are still
+// ordered.
+func Order(services []ServiceSpec) (ordered []ServiceSpec, rejected map[int]error) {
+	rejected = make(map[int]error)
+	count := make(map[string]int, len(services))
+	for _, svc := range services {
+		count[svc.Metadata.Name]++
+	}
+	index := make(map[string]int, len(services))
+	for i, svc := range services {
+		name := svc.Metadata.Name
+		if count[name] > 1 {
+			rejected[i] = fmt.Errorf("service %s is defined %d times", name, count[name])
+			continue
+		}
+		index[name] = i
+		for _, dep := range svc.Spec.DependsOn {
+			if count[dep] == 0 {
+				rejected[i] = fmt.Errorf("%s: spec.dependsOn: unknown service %q", name, dep)
+				break
+			}
+		}
+	}
+
+	emitted := make([]bool, len(services))
+	ready := func(i int) bool {
+		for _, dep := range services[i].Spec.DependsOn {
+			if j, ok := index[dep]; !ok || !emitted[j] {
+				return false
+			}
+		}
+		return true
+	}
+	for progress := true; progress; {
+		progress = false
+		for i, svc := range services {
+			if emitted[i] || rejected[i] != nil || !ready(i) {
+				continue
+			}
+			emitted[i] = true
+			ordered = append(ordered, svc)
+			progress = true
+			break
+		}
+	}
+
+	// Whatever is left is part of a cycle or depends on a rejected
+	// service.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	mark := make([]int, len(services))
+	var path []int
+	var visit func(i int)
+	visit = func(i int) {
+		mark[i] = visiting
+		path = append(path, i)
+		for _, dep := range services[i].Spec.DependsOn {
+			j, ok := index[dep]
+			if !ok || emitted[j] || rejected[j] != nil {
+				continue
+			}
+			switch mark[j] {
+			case unvisited:
+				visit(j)
+			case visiting:
+				cycle := path[slices.Index(path, j):]
+				names := make([]string, 0, len(cycle)+1)
+				for _, k := range cycle {
+					names = append(names, services[k].Metadata.Name)
+				}
+				err := fmt.Errorf("dependency cycle: %s -> %s", strings.Join(names, " -> "), dep)
+				for _, k := range cycle {
+					if rejected[k] == nil {
+						rejected[k] = err
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		mark[i] = done
+	}
+	for i := range services {
+		if !emitted[i] && rejected[i] == nil && mark[i] == unvisited {
+			visit(i)
+		}
+	}
+	for i, svc := range services {
+		if emitted[i] || rejected[i] != nil {
+			continue
+		}
+		for _, dep := range svc.Spec.DependsOn {
+			if j, ok := index[dep]; !ok || !emitted[j] {
+				rejected[i] = fmt.Errorf("%s: spec.dependsOn: service %q cannot be reconciled", svc.Metadata.Name, dep)
+				break
+			}
+		}
+	}
+	return ordered, rejected
+}
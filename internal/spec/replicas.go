@@ -0,0 +1,171 @@
+package spec
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReplicaCount returns how many containers the service runs.
+func (b ServiceSpecBody) ReplicaCount() int {
+	if len(b.CTIDs) > 0 {
+		return len(b.CTIDs)
+	}
+	return max(b.Replicas, 1)
+}
+
+// replicaCTIDs returns the CTID of each replica in order.
+func (b ServiceSpecBody) replicaCTIDs() []int {
+	if len(b.CTIDs) > 0 {
+		return slices.Clone(b.CTIDs)
+	}
+	ctids := make([]int, b.ReplicaCount())
+	for i := range ctids {
+		ctids[i] = b.CTID + i
+	}
+	return ctids
+}
+
+// ClaimedCTIDs returns every CTID the service may use, sorted: its
+// replicas, blueGreen slots and snapshot stashes.
+func (s ServiceSpec) ClaimedCTIDs() []int {
+	ctids := append([]int{s.Spec.CTID}, s.Spec.replicaCTIDs()...)
+	ctids = append(ctids, s.Spec.Rollout.BlueGreen.CTIDs...)
+	if stash := s.Spec.Rollout.Snapshot.StashCTID; stash > 0 {
+		for i := range s.Spec.ReplicaCount() {
+			ctids = append(ctids, stash+i)
+		}
+	}
+	slices.Sort(ctids)
+	ctids = slices.DeleteFunc(ctids, func(ctid int) bool { return ctid <= 0 })
+	return slices.Compact(ctids)
+}
+
+// Hostname returns the container hostname, defaulting to the service name.
+func (s ServiceSpec) Hostname() string {
+	if s.Spec.Hostname != "" {
+		return s.Spec.Hostname
+	}
+	return s.Metadata.Name
+}
+
+// Expand returns one spec per replica. Replica i gets its CTID, a hostname
+// suffixed with -i, the stash CTID stashCtid+i and every static address and
+// hwaddr moved up by i. The {{ip}} and {{ctid}} placeholders in the health
+// check URL are filled in for each replica, including a service that runs a
+// single container.
+func (s ServiceSpec) Expand() ([]ServiceSpec, error) {
+	count := s.Spec.ReplicaCount()
+	if count == 1 && len(s.Spec.CTIDs) == 0 {
+		return []ServiceSpec{s.withHealthURL()}, nil
+	}
+	replicas := make([]ServiceSpec, 0, count)
+	for i, ctid := range s.Spec.replicaCTIDs() {
+		rep := s
+		rep.Spec.CTID = ctid
+		if stash := s.Spec.Rollout.Snapshot.StashCTID; stash > 0 {
+			rep.Spec.Rollout.Snapshot.StashCTID = stash + i
+		}
+		rep.Spec.Hostname = fmt.Sprintf("%s-%d", s.Hostname(), i)
+		var err error
+		if rep.Spec.Network.IP, err = offsetAddress(s.Spec.Network.IP, i); err != nil {
+			return nil, err
+		}
+		rep.Spec.Network.Interfaces = slices.Clone(s.Spec.Network.Interfaces)
+		for j := range rep.Spec.Network.Interfaces {
+			iface := &rep.Spec.Network.Interfaces[j]
+			if iface.IP, err = offsetAddress(iface.IP, i); err != nil {
+				return nil, err
+			}
+			if iface.IP6, err = offsetAddress(iface.IP6, i); err != nil {
+				return nil, err
+			}
+			if iface.HWAddr, err = offsetMAC(iface.HWAddr, i); err != nil {
+				return nil, err
+			}
+		}
+		replicas = append(replicas, rep.withHealthURL())
+	}
+	return replicas, nil
+}
+
+func (s ServiceSpec) withHealthURL() ServiceSpec {
+	s.Spec.Health.URL = s.Substitute(s.Spec.Health.URL)
+	return s
+}
+
+// Substitute replaces {{ip}} with the address of the first interface and
+// {{ctid}} with the container ID.
+func (s ServiceSpec) Substitute(text string) string {
+	ip := s.Spec.Network.IP
+	if ifaces := s.Spec.Network.Interfaces; len(ifaces) > 0 {
+		ip = ifaces[0].IP
+	}
+	ip, _, _ = strings.Cut(ip, "/")
+	return strings.NewReplacer("{{ip}}", ip, "{{ctid}}", strconv.Itoa(s.Spec.CTID)).Replace(text)
+}
+
+// offsetAddress moves a static CIDR address n addresses up, staying inside
+// its subnet. Keywords such as dhcp are returned unchanged.
+func offsetAddress(addr string, n int) (string, error) {
+	if n == 0 || !strings.Contains(addr, "/") {
+		return addr, nil
+	}
+	prefix, err := netip.ParsePrefix(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	ip := prefix.Addr()
+	for range n {
+		ip = ip.Next()
+	}
+	if !ip.IsValid() || !prefix.Masked().Contains(ip) {
+		return "", fmt.Errorf("address %s plus %d replicas leaves the subnet", addr, n)
+	}
+	return netip.PrefixFrom(ip, prefix.Bits()).String(), nil
+}
+
+// offsetMAC moves a MAC address n up within its device part (the last three
+// bytes), so replicas on one bridge do not share it. An empty address is
+// returned unchanged.
+func offsetMAC(mac string, n int) (string, error) {
+	if n == 0 || mac == "" {
+		return mac, nil
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid hwaddr %q", mac)
+	}
+	device := int(hw[3])<<16 | int(hw[4])<<8 | int(hw[5]) + n
+	if device > 0xffffff {
+		return "", fmt.Errorf("hwaddr %s plus %d replicas overflows", mac, n)
+	}
+	hw[3], hw[4], hw[5] = byte(device>>16), byte(device>>8), byte(device)
+	return strings.ToUpper(hw.String()), nil
+}
+
+func (b ServiceSpecBody) validateReplicas() error {
+	if b.Replicas < 0 {
+		return fmt.Errorf("spec.replicas must be >= 0")
+	}
+	if len(b.CTIDs) > 0 && b.Replicas > 0 && b.Replicas != len(b.CTIDs) {
+		return fmt.Errorf("spec.replicas does not match the number of spec.ctids")
+	}
+	seen := map[int]bool{}
+	for _, id := range b.CTIDs {
+		if id <= 0 || seen[id] {
+			return fmt.Errorf("spec.ctids must be distinct and > 0")
+		}
+		seen[id] = true
+	}
+	if b.Rollout.MaxUnavailable < 0 {
+		return fmt.Errorf("spec.rollout.maxUnavailable must be >= 0")
+	}
+	if b.ReplicaCount() > 1 && strings.EqualFold(b.Rollout.Strategy, "bluegreen") {
+		return fmt.Errorf("blueGreen rollouts need a single replica")
+	}
+	return nil
+}
@@ -1,10 +1,18 @@
 package spec
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io/fs"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,38 +26,138 @@ type ServiceSpec struct {
 
 type MetadataSpec struct {
 	Name string `yaml:"name"`
+	// Annotations control the operator without changing the spec hash; see
+	// PausedAnnotation and SuspendedAnnotation.
+	Annotations map[string]string `yaml:"annotations"`
 }
 
 type ServiceSpecBody struct {
-	Node       string       `yaml:"node"`
-	CTID       int          `yaml:"ctid"`
-	Image      string       `yaml:"image"`
-	Tag        string       `yaml:"tag"`
-	PullPolicy string       `yaml:"pullPolicy"`
-	Resources  ResourceSpec `yaml:"resources"`
-	Network    NetworkSpec  `yaml:"network"`
-	Mounts     []MountSpec  `yaml:"mounts"`
-	Health     HealthSpec   `yaml:"healthCheck"`
-	Rollout    RolloutSpec  `yaml:"rollout"`
+	Node       string `yaml:"node"`
+	CTID       int    `yaml:"ctid"`
+	Image      string `yaml:"image"`
+	Tag        string `yaml:"tag"`
+	PullPolicy string `yaml:"pullPolicy"`
+	// Command, Args, Env and WorkingDir override the image's Entrypoint,
+	// Cmd, Env and WorkingDir in the generated container init.
+	Command    []string          `yaml:"command"`
+	Args       []string          `yaml:"args"`
+	Env        map[string]string `yaml:"env"`
+	WorkingDir string            `yaml:"workingDir"`
+	Resources  ResourceSpec      `yaml:"resources"`
+	Network    NetworkSpec       `yaml:"network"`
+	Mounts     []MountSpec       `yaml:"mounts"`
+	Features   FeatureSpec       `yaml:"features"`
+	Health     HealthSpec        `yaml:"healthCheck"`
+	Rollout    RolloutSpec       `yaml:"rollout"`
+	Backup     BackupSpec        `yaml:"backup"`
+	// DriftPolicy decides what happens when the live container no longer
+	// matches the spec it was deployed from: ignore, report (default) or
+	// correct.
+	DriftPolicy string `yaml:"driftPolicy"`
+	// Replicas runs the service in several containers, on CTIDs when given
+	// and on consecutive CTIDs starting at CTID otherwise.
+	Replicas int   `yaml:"replicas"`
+	CTIDs    []int `yaml:"ctids"`
+	// Hostname defaults to the service name. Replicas get "-<index>"
+	// appended.
+	Hostname string `yaml:"hostname"`
+	// DependsOn names services that must be healthy before this one rolls
+	// out.
+	DependsOn []string `yaml:"dependsOn"`
 }
 
+// ResourceSpec sizes the container. RootfsStorage falls back to the node's
+// configured default and RootfsSizeGB to the Proxmox default when unset.
 type ResourceSpec struct {
-	Cores    int `yaml:"cores"`
-	MemoryMB int `yaml:"memoryMB"`
+	Cores         int    `yaml:"cores"`
+	MemoryMB      int    `yaml:"memoryMB"`
+	RootfsStorage string `yaml:"rootfsStorage"`
+	RootfsSizeGB  int    `yaml:"rootfsSizeGB"`
 }
 
+var (
+	storageIDPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9._-]*$`)
+	envNamePattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	fsTypePattern    = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// NetworkSpec configures the container's interfaces and DNS. Bridge, IP and
+// GW are shorthand for a single eth0 and may not be combined with Interfaces.
 type NetworkSpec struct {
-	Bridge string `yaml:"bridge"`
-	IP     string `yaml:"ip"`
-	GW     string `yaml:"gw"`
+	Bridge       string          `yaml:"bridge"`
+	IP           string          `yaml:"ip"`
+	GW           string          `yaml:"gw"`
+	Interfaces   []InterfaceSpec `yaml:"interfaces"`
+	Nameservers  []string        `yaml:"nameservers"`
+	SearchDomain string          `yaml:"searchDomain"`
+}
+
+// InterfaceSpec is one container NIC (net0..netN). IP is "dhcp", "manual" or
+// an IPv4 CIDR; IP6 is "auto", "dhcp", "manual" or an IPv6 CIDR. VLAN 0, the
+// default, leaves the interface untagged.
+type InterfaceSpec struct {
+	Name     string  `yaml:"name"`
+	Bridge   string  `yaml:"bridge"`
+	VLAN     int     `yaml:"vlan"`
+	MTU      int     `yaml:"mtu"`
+	HWAddr   string  `yaml:"hwaddr"`
+	Firewall bool    `yaml:"firewall"`
+	RateMBps float64 `yaml:"rateMBps"`
+	IP       string  `yaml:"ip"`
+	GW       string  `yaml:"gw"`
+	IP6      string  `yaml:"ip6"`
+	GW6      string  `yaml:"gw6"`
 }
 
+// MountSpec describes one mount point (mp0..mpN). Exactly one source is set:
+// Host bind-mounts a host directory and Volume attaches an existing storage
+// volume (e.g. tank:subvol-900-composer-data) that no CTID of the service
+// owns. Both outlive the container, so every
+// rollout hands them to its replacement. Storage, which would allocate a
+// volume owned by the container, is rejected because a rollout destroys it
+// with the old container.
 type MountSpec struct {
 	Host    string `yaml:"host"`
+	Volume  string `yaml:"volume"`
+	Storage string `yaml:"storage"`
 	Guest   string `yaml:"guest"`
+	// Options is a comma separated list of ro, rw, backup, nobackup,
+	// replicate, noreplicate and shared.
 	Options string `yaml:"options"`
 }
 
+// volumeOwnerPattern matches the volume names Proxmox derives the owning
+// guest from, such as vm-160-disk-1 or 160/subvol-160-data.
+var volumeOwnerPattern = regexp.MustCompile(`(?:^|/)(?:vm|subvol|base|basevol)-(\d+)-`)
+
+// volumeOwner returns the CTID Proxmox considers the owner of Volume, or 0.
+// Destroying that container destroys the volume too.
+func (m MountSpec) volumeOwner() int {
+	_, name, _ := strings.Cut(m.Volume, ":")
+	match := volumeOwnerPattern.FindStringSubmatch(name)
+	if match == nil {
+		return 0
+	}
+	owner, _ := strconv.Atoi(match[1])
+	return owner
+}
+
+var mountOptions = map[string]bool{
+	"ro": true, "rw": true,
+	"backup": true, "nobackup": true,
+	"replicate": true, "noreplicate": true,
+	"shared": true,
+}
+
+// FeatureSpec toggles LXC features. Mount lists the filesystem types the
+// container may mount (e.g. nfs, cifs).
+type FeatureSpec struct {
+	Nesting bool     `yaml:"nesting"`
+	Keyctl  bool     `yaml:"keyctl"`
+	Fuse    bool     `yaml:"fuse"`
+	Mount   []string `yaml:"mount"`
+}
+
 type HealthSpec struct {
 	Type             string `yaml:"type"`
 	URL              string `yaml:"url"`
@@ -59,9 +167,246 @@ type HealthSpec struct {
 }
 
 type RolloutSpec struct {
-	Strategy       string `yaml:"strategy"`
-	MaxUnavailable int    `yaml:"maxUnavailable"`
-	AutoRollback   bool   `yaml:"autoRollback"`
+	Strategy       string        `yaml:"strategy"`
+	MaxUnavailable int           `yaml:"maxUnavailable"`
+	AutoRollback   bool          `yaml:"autoRollback"`
+	Snapshot       SnapshotSpec  `yaml:"snapshot"`
+	BlueGreen      BlueGreenSpec `yaml:"blueGreen"`
+	Canary         CanarySpec    `yaml:"canary"`
+	Window         WindowSpec    `yaml:"window"`
+}
+
+// CanarySpec configures the canary strategy. Each step moves the new digest
+// to more replicas and then bakes for PauseSeconds while Analysis watches the
+// updated replicas. Replicas left over after the last step are updated once
+// it passes.
+type CanarySpec struct {
+	Steps    []CanaryStep `yaml:"steps"`
+	Analysis AnalysisSpec `yaml:"analysis"`
+}
+
+// CanaryStep sets how many replicas run the new digest after the step,
+// either as a Count or as a Percent of all replicas (rounded up).
+type CanaryStep struct {
+	Count        int `yaml:"count"`
+	Percent      int `yaml:"percent"`
+	PauseSeconds int `yaml:"pauseSeconds"`
+}
+
+// Target returns the number of replicas the step updates out of total.
+func (c CanaryStep) Target(total int) int {
+	if c.Percent > 0 {
+		return min((total*c.Percent+99)/100, total)
+	}
+	return min(c.Count, total)
+}
+
+func (c CanaryStep) Pause() time.Duration {
+	return time.Duration(c.PauseSeconds) * time.Second
+}
+
+// AnalysisSpec samples a metric of every canary each IntervalSeconds (default
+// 30) while a step bakes. With Query set, URL is a Prometheus server and the
+// query's first sample is used; otherwise URL is scraped in the Prometheus
+// text format and the samples matching Metric (name{label="value",...}) are
+// summed. A sample outside Min/Max or a failed fetch counts as a failure and
+// the analysis fails after more than FailureLimit of them. URL, Query and
+// Metric accept the {{ip}} and {{ctid}} placeholders.
+type AnalysisSpec struct {
+	URL             string   `yaml:"url"`
+	Query           string   `yaml:"query"`
+	Metric          string   `yaml:"metric"`
+	Max             *float64 `yaml:"max"`
+	Min             *float64 `yaml:"min"`
+	IntervalSeconds int      `yaml:"intervalSeconds"`
+	FailureLimit    int      `yaml:"failureLimit"`
+}
+
+func (c CanarySpec) Validate() error {
+	if len(c.Steps) == 0 {
+		return fmt.Errorf("steps are required")
+	}
+	for i, step := range c.Steps {
+		if (step.Count > 0) == (step.Percent > 0) {
+			return fmt.Errorf("steps[%d]: set exactly one of count or percent", i)
+		}
+		if step.Count < 0 || step.Percent < 0 || step.Percent > 100 || step.PauseSeconds < 0 {
+			return fmt.Errorf("steps[%d]: count, percent (up to 100) and pauseSeconds must be >= 0", i)
+		}
+	}
+	return c.Analysis.Validate()
+}
+
+func (a AnalysisSpec) Validate() error {
+	if a.URL == "" {
+		if a.Query != "" || a.Metric != "" {
+			return fmt.Errorf("analysis.url is required")
+		}
+		return nil
+	}
+	if (a.Query == "") == (a.Metric == "") {
+		return fmt.Errorf("analysis: set exactly one of query or metric")
+	}
+	if a.Max == nil && a.Min == nil {
+		return fmt.Errorf("analysis: max or min is required")
+	}
+	if a.IntervalSeconds < 0 || a.FailureLimit < 0 {
+		return fmt.Errorf("analysis: intervalSeconds and failureLimit must be >= 0")
+	}
+	return nil
+}
+
+// BlueGreenSpec configures the blueGreen strategy. CTIDs is the pool the
+// service alternates between and must include spec.ctid. The standby comes
+// up on PreviewIP (replacing the first interface's address), which a
+// service with a static address must set, and is checked against
+// PreviewURL before it takes over the service address. Without PreviewIP
+// the regular health URL would reach the active container, so PreviewURL is
+// required;
+// SwitchCommand runs on the operator host after every switch, for example to
+// update a proxy.
+type BlueGreenSpec struct {
+	CTIDs         []int    `yaml:"ctids"`
+	PreviewIP     string   `yaml:"previewIP"`
+	PreviewURL    string   `yaml:"previewURL"`
+	SwitchCommand []string `yaml:"switchCommand"`
+}
+
+func (b BlueGreenSpec) Validate(ctid int, network NetworkSpec) error {
+	if len(b.CTIDs) < 2 {
+		return fmt.Errorf("ctids needs at least two containers")
+	}
+	seen := map[int]bool{}
+	for _, id := range b.CTIDs {
+		if id <= 0 || seen[id] {
+			return fmt.Errorf("ctids must be distinct and > 0")
+		}
+		seen[id] = true
+	}
+	if !seen[ctid] {
+		return fmt.Errorf("ctids must include spec.ctid")
+	}
+	if b.PreviewIP != "" {
+		if ip, _, err := net.ParseCIDR(b.PreviewIP); err != nil || ip.To4() == nil {
+			return fmt.Errorf("previewIP must be an IPv4 CIDR address")
+		}
+	}
+	// The standby runs next to the active container, so it may only share
+	// an address the switch moves over.
+	primary, others := network.IP, []string(nil)
+	if len(network.Interfaces) > 0 {
+		primary, others = network.Interfaces[0].IP, []string{network.Interfaces[0].IP6}
+		for _, iface := range network.Interfaces[1:] {
+			others = append(others, iface.IP, iface.IP6)
+		}
+	}
+	if isStaticAddress(primary) && b.PreviewIP == "" {
+		return fmt.Errorf("previewIP is required when the service has a static address")
+	}
+	if b.PreviewIP == "" && b.PreviewURL == "" {
+		return fmt.Errorf("previewURL is required without previewIP, or the active container would answer the standby's health check")
+	}
+	for _, iface := range network.Interfaces {
+		if iface.HWAddr != "" {
+			return fmt.Errorf("hwaddr %s would be shared by the active and standby containers", iface.HWAddr)
+		}
+	}
+	for _, addr := range others {
+		if isStaticAddress(addr) {
+			return fmt.Errorf("static address %s would be shared by the active and standby containers; only the first interface's IPv4 address can be static", addr)
+		}
+	}
+	return nil
+}
+
+// isStaticAddress reports whether addr is a CIDR address rather than a
+// keyword such as dhcp.
+func isStaticAddress(addr string) bool {
+	return strings.Contains(addr, "/")
+}
+
+// SnapshotSpec keeps the previous container restorable during a rollout.
+// In-place updates that restart the container take a snapshot first. A
+// recreate destroys the container together with its snapshots, so the old
+// container is cloned to StashCTID from a snapshot taken while it still
+// runs, and cloned back if the new one fails; replica i of a replicated
+// service uses StashCTID+i. Retain is how many operator snapshots stay on
+// the container after a successful update.
+type SnapshotSpec struct {
+	Enabled   bool `yaml:"enabled"`
+	Retain    int  `yaml:"retain"`
+	StashCTID int  `yaml:"stashCtid"`
+}
+
+// Validate checks the snapshot settings against the CTIDs of the service's
+// replicas; replica i stashes to StashCTID+i.
+func (s SnapshotSpec) Validate(replicas []int) error {
+	if s.Retain < 0 {
+		return fmt.Errorf("retain must be >= 0")
+	}
+	if s.StashCTID < 0 {
+		return fmt.Errorf("stashCtid must be > 0")
+	}
+	if s.Enabled && s.StashCTID == 0 {
+		return fmt.Errorf("stashCtid is required when snapshots are enabled")
+	}
+	for i := range replicas {
+		if s.StashCTID != 0 && slices.Contains(replicas, s.StashCTID+i) {
+			return fmt.Errorf("stash ct %d of replica %d is also a replica", s.StashCTID+i, i)
+		}
+	}
+	return nil
+}
+
+// BackupSpec makes the operator run vzdump before destroying or replacing the
+// container. Backups are enabled by naming a Storage; KeepLast prunes older
+// backups of the container on that storage (0 leaves pruning to the storage's
+// own retention).
+type BackupSpec struct {
+	Storage  string `yaml:"storage"`
+	Mode     string `yaml:"mode"`
+	Compress string `yaml:"compress"`
+	KeepLast int    `yaml:"keepLast"`
+}
+
+func (b BackupSpec) Enabled() bool {
+	return b.Storage != ""
+}
+
+// EffectiveMode returns the vzdump mode, defaulting to snapshot.
+func (b BackupSpec) EffectiveMode() string {
+	if b.Mode == "" {
+		return "snapshot"
+	}
+	return b.Mode
+}
+
+// EffectiveCompress returns the vzdump compression, defaulting to zstd.
+func (b BackupSpec) EffectiveCompress() string {
+	if b.Compress == "" {
+		return "zstd"
+	}
+	return b.Compress
+}
+
+func (b BackupSpec) Validate() error {
+	switch b.Mode {
+	case "", "snapshot", "suspend", "stop":
+	default:
+		return fmt.Errorf("mode must be snapshot, suspend or stop")
+	}
+	switch b.Compress {
+	case "", "0", "1", "gzip", "lzo", "zstd":
+	default:
+		return fmt.Errorf("compress must be 0, 1, gzip, lzo or zstd")
+	}
+	if b.KeepLast < 0 {
+		return fmt.Errorf("keepLast must be >= 0")
+	}
+	if !b.Enabled() && (b.Mode != "" || b.Compress != "" || b.KeepLast != 0) {
+		return fmt.Errorf("storage is required")
+	}
+	return nil
 }
 
 func ParseServiceSpec(data []byte) (ServiceSpec, error) {
@@ -72,35 +417,70 @@ func ParseServiceSpec(data []byte) (ServiceSpec, error) {
 	return svc, svc.Validate()
 }
 
-func LoadServiceSpecs(dir string) ([]ServiceSpec, error) {
+// FileError is a spec file that was skipped because it cannot be read,
+// parsed or ordered. Hash fingerprints its content, so callers can tell when it
+// changed.
+type FileError struct {
+	File string
+	Hash string
+	Err  error
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.File, e.Err)
+}
+
+func (e FileError) Unwrap() error {
+	return e.Err
+}
+
+// LoadServiceSpecs reads every spec in dir, ordered so dependencies come
+// before their dependents. Files that cannot be read, parsed or ordered are
+// skipped and returned, so that one broken file does not hold back the
+// rest.
+func LoadServiceSpecs(dir string) ([]ServiceSpec, []FileError, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, fmt.Errorf("read services dir: %w", err)
+		return nil, nil, fmt.Errorf("read services dir: %w", err)
 	}
 	var specs []ServiceSpec
+	var loaded, skipped []FileError
 	for _, entry := range entries {
 		if entry.IsDir() {
 			continue
 		}
-		if !isSpecFile(entry) {
+		if !IsSpecFile(entry.Name()) {
 			continue
 		}
 		path := filepath.Join(dir, entry.Name())
 		bytes, err := os.ReadFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("read spec %s: %w", entry.Name(), err)
+			skipped = append(skipped, FileError{File: entry.Name(), Err: fmt.Errorf("read spec: %w", err)})
+			continue
 		}
+		sum := sha256.Sum256(bytes)
+		file := FileError{File: entry.Name(), Hash: hex.EncodeToString(sum[:])[:16]}
 		svc, err := ParseServiceSpec(bytes)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+			file.Err = err
+			skipped = append(skipped, file)
+			continue
 		}
 		specs = append(specs, svc)
+		loaded = append(loaded, file)
+	}
+	ordered, rejected := Order(specs)
+	for i, file := range loaded {
+		if err, ok := rejected[i]; ok {
+			file.Err = err
+			skipped = append(skipped, file)
+		}
 	}
-	return specs, nil
+	return ordered, skipped, nil
 }
 
-func isSpecFile(entry fs.DirEntry) bool {
-	name := entry.Name()
+// IsSpecFile reports whether a file in the services directory holds a spec.
+func IsSpecFile(name string) bool {
 	return filepath.Ext(name) == ".yml" || filepath.Ext(name) == ".yaml"
 }
 
@@ -108,15 +488,77 @@ func (s ServiceSpec) Validate() error {
 	if s.Metadata.Name == "" {
 		return fmt.Errorf("metadata.name is required")
 	}
-	if s.Spec.CTID <= 0 {
+	if s.Spec.CTID <= 0 && len(s.Spec.CTIDs) == 0 {
 		return fmt.Errorf("spec.ctid must be > 0")
 	}
+	if err := s.Metadata.validateAnnotations(); err != nil {
+		return err
+	}
+	if err := s.Spec.validateReplicas(); err != nil {
+		return err
+	}
 	if s.Spec.Node == "" {
 		return fmt.Errorf("spec.node is required")
 	}
 	if s.Spec.Image == "" {
 		return fmt.Errorf("spec.image is required")
 	}
+	for key := range s.Spec.Env {
+		if !envNamePattern.MatchString(key) {
+			return fmt.Errorf("spec.env: invalid variable name %q", key)
+		}
+	}
+	if s.Spec.WorkingDir != "" && !strings.HasPrefix(s.Spec.WorkingDir, "/") {
+		return fmt.Errorf("spec.workingDir must be an absolute path")
+	}
+	switch s.Spec.DriftPolicy {
+	case "", "ignore", "report", "correct":
+	default:
+		return fmt.Errorf("spec.driftPolicy must be ignore, report or correct")
+	}
+	if err := s.Spec.Resources.Validate(); err != nil {
+		return fmt.Errorf("spec.resources: %w", err)
+	}
+	if err := s.Spec.Network.Validate(); err != nil {
+		return fmt.Errorf("spec.network: %w", err)
+	}
+	if err := s.Spec.Features.Validate(); err != nil {
+		return fmt.Errorf("spec.features: %w", err)
+	}
+	for i, mount := range s.Spec.Mounts {
+		if err := mount.Validate(); err != nil {
+			return fmt.Errorf("spec.mounts[%d]: %w", i, err)
+		}
+		if owner := mount.volumeOwner(); owner != 0 && slices.Contains(s.ClaimedCTIDs(), owner) {
+			return fmt.Errorf("spec.mounts[%d]: volume %s belongs to ct %d and would be destroyed with it; name it after a CTID the service does not use", i, mount.Volume, owner)
+		}
+		// Proxmox cannot snapshot or clone a container with bind mounts.
+		if mount.Host != "" && s.Spec.Rollout.Snapshot.Enabled {
+			return fmt.Errorf("spec.mounts[%d]: host bind mounts cannot be combined with spec.rollout.snapshot.enabled", i)
+		}
+	}
+	if err := s.Spec.Rollout.Snapshot.Validate(s.Spec.replicaCTIDs()); err != nil {
+		return fmt.Errorf("spec.rollout.snapshot: %w", err)
+	}
+	if err := s.Spec.Rollout.Window.Validate(); err != nil {
+		return fmt.Errorf("spec.rollout.window: %w", err)
+	}
+	if strings.EqualFold(s.Spec.Rollout.Strategy, "bluegreen") {
+		if err := s.Spec.Rollout.BlueGreen.Validate(s.Spec.CTID, s.Spec.Network); err != nil {
+			return fmt.Errorf("spec.rollout.blueGreen: %w", err)
+		}
+	}
+	if strings.EqualFold(s.Spec.Rollout.Strategy, "canary") {
+		if err := s.Spec.Rollout.Canary.Validate(); err != nil {
+			return fmt.Errorf("spec.rollout.canary: %w", err)
+		}
+	}
+	if err := s.Spec.Backup.Validate(); err != nil {
+		return fmt.Errorf("spec.backup: %w", err)
+	}
+	if _, err := s.Expand(); err != nil {
+		return fmt.Errorf("spec.network: %w", err)
+	}
 	if s.Spec.Tag == "" {
 		s.Spec.Tag = "latest"
 	}
@@ -128,3 +570,192 @@ func (s ServiceSpec) Validate() error {
 	}
 	return nil
 }
+
+func (r ResourceSpec) Validate() error {
+	if r.Cores < 0 {
+		return fmt.Errorf("cores must be >= 0")
+	}
+	if r.MemoryMB < 0 {
+		return fmt.Errorf("memoryMB must be >= 0")
+	}
+	if r.RootfsSizeGB < 0 {
+		return fmt.Errorf("rootfsSizeGB must be >= 0")
+	}
+	if r.RootfsStorage != "" && !storageIDPattern.MatchString(r.RootfsStorage) {
+		return fmt.Errorf("invalid rootfsStorage %q", r.RootfsStorage)
+	}
+	return nil
+}
+
+// EffectiveDriftPolicy returns the drift policy, defaulting to report.
+func (s ServiceSpecBody) EffectiveDriftPolicy() string {
+	if s.DriftPolicy == "" {
+		return "report"
+	}
+	return s.DriftPolicy
+}
+
+// Validate checks that Mount holds plain filesystem type names, which end up
+// ;-separated in the features option.
+func (f FeatureSpec) Validate() error {
+	for i, fs := range f.Mount {
+		if !fsTypePattern.MatchString(fs) {
+			return fmt.Errorf("mount[%d]: invalid filesystem type %q", i, fs)
+		}
+		if slices.Contains(f.Mount[:i], fs) {
+			return fmt.Errorf("mount[%d]: filesystem type %q is listed twice", i, fs)
+		}
+	}
+	return nil
+}
+
+func (m MountSpec) Validate() error {
+	if m.Storage != "" {
+		return fmt.Errorf("storage volumes are destroyed with the container on every rollout; create the volume once and attach it with volume")
+	}
+	if (m.Host == "") == (m.Volume == "") {
+		return fmt.Errorf("exactly one of host or volume is required")
+	}
+	if !strings.HasPrefix(m.Guest, "/") {
+		return fmt.Errorf("guest must be an absolute path")
+	}
+	if m.Host != "" && !strings.HasPrefix(m.Host, "/") {
+		return fmt.Errorf("host must be an absolute path")
+	}
+	if m.Volume != "" && !strings.Contains(m.Volume, ":") {
+		return fmt.Errorf("volume must be a storage:volume id")
+	}
+	for _, opt := range m.OptionList() {
+		if !mountOptions[opt] {
+			return fmt.Errorf("unknown mount option %q", opt)
+		}
+	}
+	return nil
+}
+
+// OptionList splits Options into its individual flags.
+func (m MountSpec) OptionList() []string {
+	var opts []string
+	for _, opt := range strings.Split(m.Options, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// EffectiveInterfaces returns the interfaces to configure, expanding the
+// single-bridge shorthand and filling in default ethN names.
+func (n NetworkSpec) EffectiveInterfaces() []InterfaceSpec {
+	ifaces := n.Interfaces
+	if len(ifaces) == 0 && n.Bridge != "" {
+		ifaces = []InterfaceSpec{{Bridge: n.Bridge, IP: n.IP, GW: n.GW}}
+	}
+	out := make([]InterfaceSpec, len(ifaces))
+	for i, iface := range ifaces {
+		if iface.Name == "" {
+			iface.Name = fmt.Sprintf("eth%d", i)
+		}
+		out[i] = iface
+	}
+	return out
+}
+
+func (n NetworkSpec) Validate() error {
+	if len(n.Interfaces) > 0 && (n.Bridge != "" || n.IP != "" || n.GW != "") {
+		return fmt.Errorf("bridge/ip/gw cannot be combined with interfaces")
+	}
+	names := map[string]bool{}
+	for i, iface := range n.EffectiveInterfaces() {
+		if err := iface.Validate(); err != nil {
+			return fmt.Errorf("interfaces[%d]: %w", i, err)
+		}
+		if names[iface.Name] {
+			return fmt.Errorf("interfaces[%d]: duplicate name %q", i, iface.Name)
+		}
+		names[iface.Name] = true
+	}
+	for _, ns := range n.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("invalid nameserver %q", ns)
+		}
+	}
+	if strings.ContainsAny(n.SearchDomain, " ,") {
+		return fmt.Errorf("searchDomain must be a single domain")
+	}
+	return nil
+}
+
+func (i InterfaceSpec) Validate() error {
+	if i.Bridge == "" {
+		return fmt.Errorf("bridge is required")
+	}
+	if i.VLAN < 0 || i.VLAN > 4094 {
+		return fmt.Errorf("vlan must be between 1 and 4094, or 0 for untagged")
+	}
+	if i.MTU < 0 || (i.MTU > 0 && i.MTU < 64) || i.MTU > 65535 {
+		return fmt.Errorf("mtu must be between 64 and 65535")
+	}
+	if i.RateMBps < 0 {
+		return fmt.Errorf("rateMBps must be >= 0")
+	}
+	if i.HWAddr != "" {
+		if _, err := net.ParseMAC(i.HWAddr); err != nil {
+			return fmt.Errorf("invalid hwaddr %q", i.HWAddr)
+		}
+	}
+	if err := validateAddress(i.IP, i.GW, false, "dhcp", "manual"); err != nil {
+		return fmt.Errorf("ip: %w", err)
+	}
+	if err := validateAddress(i.IP6, i.GW6, true, "auto", "dhcp", "manual"); err != nil {
+		return fmt.Errorf("ip6: %w", err)
+	}
+	return nil
+}
+
+// validateAddress checks an ip/ip6 value, which is either one of the keywords
+// or a CIDR of the right family, and its gateway, which only makes sense with
+// a static address.
+func validateAddress(addr, gw string, v6 bool, keywords ...string) error {
+	static := addr != "" && !slices.Contains(keywords, addr)
+	if static {
+		ip, _, err := net.ParseCIDR(addr)
+		if err != nil || (ip.To4() == nil) != v6 {
+			return fmt.Errorf("%q must be one of %s or a CIDR address", addr, strings.Join(keywords, ", "))
+		}
+	}
+	if gw == "" {
+		return nil
+	}
+	if !static {
+		return fmt.Errorf("gateway requires a static address")
+	}
+	if ip := net.ParseIP(gw); ip == nil || (ip.To4() == nil) != v6 {
+		return fmt.Errorf("invalid gateway %q", gw)
+	}
+	return nil
+}
+
+// Hash fingerprints the service definition so the deployed configuration can
+// be compared with the current spec.
+func (s ServiceSpec) Hash() string {
+	// ServiceSpecBody only holds plain values, so marshalling cannot fail.
+	data, _ := json.Marshal(struct {
+		Name string
+		Spec ServiceSpecBody
+	}{s.Metadata.Name, s.Spec})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// InitHash fingerprints the fields baked into the generated container init.
+// Changing any of them needs a new template and therefore a new container.
+func (s ServiceSpec) InitHash() string {
+	data, _ := json.Marshal(struct {
+		Command, Args []string
+		Env           map[string]string
+		WorkingDir    string
+	}{s.Spec.Command, s.Spec.Args, s.Spec.Env, s.Spec.WorkingDir})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16]
+}
@@ -3,7 +3,10 @@ package spec
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 const sampleYAML = `apiVersion: pve.haasonsaas/v1
@@ -50,6 +53,26 @@ func TestParseServiceSpec(t *testing.T) {
 	if svc.Spec.Rollout.Strategy != "recreate" {
 		t.Fatalf("unexpected strategy %s", svc.Spec.Rollout.Strategy)
 	}
+	if svc.Spec.EffectiveDriftPolicy() != "report" {
+		t.Fatalf("unexpected drift policy %s", svc.Spec.EffectiveDriftPolicy())
+	}
+
+	hash := svc.Hash()
+	svc.Metadata.Annotations = map[string]string{PausedAnnotation: "true"}
+	if !svc.Paused() || svc.Suspended() || svc.Hash() != hash {
+		t.Fatalf("pausing must not change the spec hash")
+	}
+	svc.Metadata.Annotations[SuspendedAnnotation] = "soon"
+	if err := svc.Validate(); err == nil {
+		t.Fatalf("expected error for invalid annotation value")
+	}
+
+	svc.Metadata.Annotations = nil
+	svc.Spec.Mounts = []MountSpec{{Host: "/srv/data", Guest: "/data"}}
+	svc.Spec.Rollout.Snapshot = SnapshotSpec{Enabled: true, StashCTID: 9000}
+	if err := svc.Validate(); err == nil {
+		t.Fatalf("expected error for snapshots with a bind mount")
+	}
 }
 
 func TestLoadServiceSpecs(t *testing.T) {
@@ -58,11 +81,323 @@ func TestLoadServiceSpecs(t *testing.T) {
 	if err := os.WriteFile(path, []byte(sampleYAML), 0o644); err != nil {
 		t.Fatalf("write spec: %v", err)
 	}
-	specs, err := LoadServiceSpecs(dir)
+	if err := os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("metadata: [\n"), 0o644); err != nil {
+		t.Fatalf("write spec: %v", err)
+	}
+	specs, skipped, err := LoadServiceSpecs(dir)
 	if err != nil {
 		t.Fatalf("LoadServiceSpecs error: %v", err)
 	}
 	if len(specs) != 1 {
 		t.Fatalf("expected 1 spec got %d", len(specs))
 	}
+	if len(skipped) != 1 || skipped[0].File != "broken.yaml" || skipped[0].Hash == "" {
+		t.Fatalf("expected broken.yaml to be skipped, got %v", skipped)
+	}
+}
+
+func TestValidateMounts(t *testing.T) {
+	cases := map[string]MountSpec{
+		"no source":      {Guest: "/data"},
+		"two sources":    {Host: "/srv/data", Volume: "tank:subvol-160-data", Guest: "/data"},
+		"relative guest": {Host: "/srv/data", Guest: "data"},
+		"storage volume": {Storage: "local-lvm", Guest: "/data"},
+		"bad option":     {Host: "/srv/data", Guest: "/data", Options: "rw,noexec"},
+	}
+	for name, mount := range cases {
+		if err := mount.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+	ok := MountSpec{Volume: "tank:subvol-160-data", Guest: "/data", Options: "backup,ro"}
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateFeatures(t *testing.T) {
+	for _, mount := range [][]string{{"nfs;cifs"}, {"nfs,nesting=1"}, {""}, {"nfs", "nfs"}} {
+		if err := (FeatureSpec{Mount: mount}).Validate(); err == nil {
+			t.Errorf("%q: expected validation error", mount)
+		}
+	}
+	if err := (FeatureSpec{Nesting: true, Mount: []string{"nfs", "cifs"}}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateNetwork(t *testing.T) {
+	cases := map[string]NetworkSpec{
+		"mixed shorthand": {Bridge: "vmbr0", Interfaces: []InterfaceSpec{{Bridge: "vmbr1"}}},
+		"missing bridge":  {Interfaces: []InterfaceSpec{{IP: "dhcp"}}},
+		"dhcp gateway":    {Interfaces: []InterfaceSpec{{Bridge: "vmbr0", IP: "dhcp", GW: "10.0.0.1"}}},
+		"v6 in ip":        {Interfaces: []InterfaceSpec{{Bridge: "vmbr0", IP: "fd00::10/64"}}},
+		"bad vlan":        {Interfaces: []InterfaceSpec{{Bridge: "vmbr0", VLAN: 5000}}},
+		"negative vlan":   {Interfaces: []InterfaceSpec{{Bridge: "vmbr0", VLAN: -1}}},
+		"duplicate name":  {Interfaces: []InterfaceSpec{{Bridge: "vmbr0"}, {Name: "eth0", Bridge: "vmbr1"}}},
+		"bad nameserver":  {Bridge: "vmbr0", Nameservers: []string{"dns.example"}},
+	}
+	for name, network := range cases {
+		if err := network.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+	ok := NetworkSpec{
+		Interfaces: []InterfaceSpec{
+			{Bridge: "vmbr0", IP: "192.168.4.160/24", GW: "192.168.4.1", IP6: "fd00::160/64", GW6: "fd00::1"},
+			{Bridge: "vmbr1", VLAN: 20, IP: "dhcp", IP6: "auto"},
+		},
+		Nameservers: []string{"192.168.4.1"},
+	}
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	if err := (ResourceSpec{RootfsStorage: "local lvm"}).Validate(); err == nil {
+		t.Errorf("expected error for invalid storage id")
+	}
+	if err := (ResourceSpec{RootfsSizeGB: -1}).Validate(); err == nil {
+		t.Errorf("expected error for negative size")
+	}
+	if err := (ResourceSpec{Cores: 2, MemoryMB: 2048, RootfsStorage: "local-lvm", RootfsSizeGB: 16}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateBlueGreen(t *testing.T) {
+	cases := map[string]BlueGreenSpec{
+		"single ctid":    {CTIDs: []int{160}},
+		"missing ctid":   {CTIDs: []int{161, 162}},
+		"duplicate ctid": {CTIDs: []int{160, 160}},
+		"bad preview ip": {CTIDs: []int{160, 161}, PreviewIP: "192.168.4.161"},
+		"v6 preview ip":  {CTIDs: []int{160, 161}, PreviewIP: "fd00::161/64"},
+		"no preview ip":  {CTIDs: []int{160, 161}},
+	}
+	static := NetworkSpec{IP: "192.168.4.160/24"}
+	for name, bg := range cases {
+		if err := bg.Validate(160, static); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+	ok := BlueGreenSpec{CTIDs: []int{160, 161}, PreviewIP: "192.168.4.161/24"}
+	if err := ok.Validate(160, static); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dhcp := BlueGreenSpec{CTIDs: []int{160, 161}}
+	if err := dhcp.Validate(160, NetworkSpec{IP: "dhcp"}); err == nil {
+		t.Fatalf("expected dhcp without previewURL to be rejected")
+	}
+	dhcp.PreviewURL = "http://composer-preview.lan/healthz"
+	if err := dhcp.Validate(160, NetworkSpec{IP: "dhcp"}); err != nil {
+		t.Fatalf("dhcp needs no previewIP: %v", err)
+	}
+	mac := NetworkSpec{Interfaces: []InterfaceSpec{{IP: "192.168.4.160/24", HWAddr: "BC:24:11:00:00:10"}}}
+	if err := ok.Validate(160, mac); err == nil {
+		t.Fatalf("expected an hwaddr shared with the standby to be rejected")
+	}
+	shared := NetworkSpec{Interfaces: []InterfaceSpec{{IP: "192.168.4.160/24"}, {IP: "10.0.0.160/24"}}}
+	if err := ok.Validate(160, shared); err == nil {
+		t.Fatalf("expected a static address on a second interface to be rejected")
+	}
+}
+
+func TestExpandReplicas(t *testing.T) {
+	svc := ServiceSpec{}
+	svc.Metadata.Name = "composer"
+	svc.Spec.CTID = 160
+	svc.Spec.Replicas = 3
+	svc.Spec.Network.Interfaces = []InterfaceSpec{
+		{Bridge: "vmbr0", IP: "192.168.4.254/24", IP6: "fd00::10/64"},
+		{Bridge: "vmbr1", IP: "dhcp"},
+	}
+	svc.Spec.Health.URL = "http://{{ip}}:8080/healthz"
+	if _, err := svc.Expand(); err == nil {
+		t.Fatalf("expected error for addresses leaving the subnet")
+	}
+	svc.Spec.Network.Interfaces[0].IP = "192.168.4.160/24"
+	replicas, err := svc.Expand()
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	if len(replicas) != 3 {
+		t.Fatalf("expected 3 replicas, got %d", len(replicas))
+	}
+	last := replicas[2]
+	iface := last.Spec.Network.Interfaces[0]
+	if last.Spec.CTID != 162 || last.Hostname() != "composer-2" || iface.IP != "192.168.4.162/24" || iface.IP6 != "fd00::12/64" {
+		t.Fatalf("unexpected replica %+v", last.Spec)
+	}
+	if last.Spec.Network.Interfaces[1].IP != "dhcp" || last.Spec.Health.URL != "http://192.168.4.162:8080/healthz" {
+		t.Fatalf("unexpected replica %+v", last.Spec)
+	}
+	if svc.Spec.Network.Interfaces[0].IP != "192.168.4.160/24" {
+		t.Fatalf("expand modified the original spec")
+	}
+
+	// Replicas share a bridge, so each gets its own MAC.
+	svc.Spec.Network.Interfaces[0].HWAddr = "bc:24:11:00:00:ff"
+	replicas, err = svc.Expand()
+	if err != nil {
+		t.Fatalf("expand: %v", err)
+	}
+	var macs []string
+	for _, rep := range replicas {
+		macs = append(macs, rep.Spec.Network.Interfaces[0].HWAddr)
+	}
+	if strings.Join(macs, ",") != "bc:24:11:00:00:ff,BC:24:11:00:01:00,BC:24:11:00:01:01" {
+		t.Fatalf("unexpected replica hwaddrs %v", macs)
+	}
+	svc.Spec.Network.Interfaces[0].HWAddr = "bc:24:11:ff:ff:ff"
+	if _, err := svc.Expand(); err == nil {
+		t.Fatalf("expected error for an hwaddr that overflows")
+	}
+	svc.Spec.Network.Interfaces[0].HWAddr = ""
+
+	svc.Spec.CTIDs = []int{300, 400}
+	svc.Spec.Replicas = 0
+	svc.Spec.Rollout.Snapshot = SnapshotSpec{Enabled: true, StashCTID: 9300}
+	replicas, err = svc.Expand()
+	if err != nil || len(replicas) != 2 || replicas[1].Spec.CTID != 400 {
+		t.Fatalf("unexpected replicas from ctids: %v", err)
+	}
+	// Every replica stashes to its own CTID.
+	if replicas[0].Spec.Rollout.Snapshot.StashCTID != 9300 || replicas[1].Spec.Rollout.Snapshot.StashCTID != 9301 {
+		t.Fatalf("unexpected stash ctids %d, %d", replicas[0].Spec.Rollout.Snapshot.StashCTID, replicas[1].Spec.Rollout.Snapshot.StashCTID)
+	}
+	if got := svc.ClaimedCTIDs(); !slices.Equal(got, []int{160, 300, 400, 9300, 9301}) {
+		t.Fatalf("unexpected claimed ctids %v", got)
+	}
+	if err := (SnapshotSpec{Enabled: true, StashCTID: 299}).Validate([]int{300, 400}); err == nil {
+		t.Fatalf("expected a stash overlapping a replica to be rejected")
+	}
+}
+
+func TestValidateCanary(t *testing.T) {
+	limit := 0.05
+	cases := map[string]CanarySpec{
+		"no steps":         {},
+		"count and pct":    {Steps: []CanaryStep{{Count: 1, Percent: 10}}},
+		"percent over 100": {Steps: []CanaryStep{{Percent: 150}}},
+		"no threshold":     {Steps: []CanaryStep{{Count: 1}}, Analysis: AnalysisSpec{URL: "http://prom:9090", Query: "up"}},
+		"query and metric": {Steps: []CanaryStep{{Count: 1}}, Analysis: AnalysisSpec{URL: "http://prom:9090", Query: "up", Metric: "up", Max: &limit}},
+	}
+	for name, canary := range cases {
+		if err := canary.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
+	ok := CanarySpec{
+		Steps:    []CanaryStep{{Count: 1, PauseSeconds: 300}, {Percent: 50, PauseSeconds: 300}},
+		Analysis: AnalysisSpec{URL: "http://{{ip}}:9100/metrics", Metric: `http_requests_total{code="500"}`, Max: &limit},
+	}
+	if err := ok.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := (CanaryStep{Percent: 30}).Target(4); got != 2 {
+		t.Fatalf("30%% of 4 replicas = %d, want 2", got)
+	}
+}
+
+func TestOrderServices(t *testing.T) {
+	service := func(name string, deps ...string) ServiceSpec {
+		svc := ServiceSpec{}
+		svc.Metadata.Name = name
+		svc.Spec.DependsOn = deps
+		return svc
+	}
+	ordered, rejected := Order([]ServiceSpec{service("web", "api"), service("api", "db", "cache"), service("cache"), service("db")})
+	if len(rejected) != 0 {
+		t.Fatalf("order: %v", rejected)
+	}
+	names := func(services []ServiceSpec) string {
+		var names []string
+		for _, svc := range services {
+			names = append(names, svc.Metadata.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	if got := names(ordered); got != "cache,db,api,web" {
+		t.Fatalf("unexpected order %s", got)
+	}
+
+	cases := map[string][]ServiceSpec{
+		"cycle":     {service("web", "api"), service("api", "db"), service("db", "web")},
+		"self":      {service("web", "web")},
+		"unknown":   {service("web", "db")},
+		"duplicate": {service("web"), service("web")},
+	}
+	for name, services := range cases {
+		if ordered, rejected := Order(services); len(ordered) != 0 || len(rejected) != len(services) {
+			t.Errorf("%s: expected every service to be rejected, got %v", name, rejected)
+		}
+	}
+	if _, rejected := Order(cases["cycle"]); rejected[0] == nil || rejected[0].Error() != "dependency cycle: web -> api -> db -> web" {
+		t.Fatalf("unexpected cycle error %v", rejected[0])
+	}
+
+	// Only the services involved are rejected.
+	ordered, rejected = Order([]ServiceSpec{service("web", "api"), service("api", "queue"), service("queue", "api"), service("db"), service("worker", "db", "ghost")})
+	if got := names(ordered); got != "db" {
+		t.Fatalf("unexpected order %s", got)
+	}
+	for i, want := range []string{`web: spec.dependsOn: service "api" cannot be reconciled`, "dependency cycle: api -> queue -> api", "dependency cycle: api -> queue -> api", "", `worker: spec.dependsOn: unknown service "ghost"`} {
+		got := ""
+		if rejected[i] != nil {
+			got = rejected[i].Error()
+		}
+		if got != want {
+			t.Errorf("service %d: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestRolloutWindow(t *testing.T) {
+	window := WindowSpec{TimeZone: "Europe/Berlin", Ranges: []WindowRange{
+		{Days: []string{"mon-fri"}, Start: "22:00", End: "06:00"},
+		{Days: []string{"sat", "sun"}, Start: "00:00", End: "00:00"},
+	}}
+	if err := window.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	cases := map[string]bool{
+		"2026-10-14 12:00": false, // Wednesday noon
+		"2026-10-14 23:30": true,
+		"2026-10-15 05:59": true,  // carried over from Wednesday night
+		"2026-10-17 13:00": true,  // Saturday
+		"2026-10-19 03:00": false, // Monday morning: the weekend ended at midnight
+	}
+	for at, want := range cases {
+		ts, _ := time.ParseInLocation("2006-01-02 15:04", at, berlin)
+		if got := window.Open(ts); got != want {
+			t.Errorf("%s: open = %v, want %v", at, got, want)
+		}
+	}
+	noon, _ := time.ParseInLocation("2006-01-02 15:04", "2026-10-14 12:00", berlin)
+	if next := window.Next(noon); next.Format("Mon 15:04 MST") != "Wed 22:00 CEST" {
+		t.Fatalf("unexpected next opening %s", next)
+	}
+	// Next agrees with stepping minute by minute through a week.
+	for at := noon; at.Before(noon.AddDate(0, 0, 7)); at = at.Add(131 * time.Minute) {
+		want := at.Truncate(time.Minute).Add(time.Minute)
+		for !window.Open(want) {
+			want = want.Add(time.Minute)
+		}
+		if got := window.Next(at); !got.Equal(want) {
+			t.Fatalf("next after %s: got %s, want %s", at, got, want)
+		}
+	}
+
+	bad := map[string]WindowSpec{
+		"time zone": {TimeZone: "Mars/Olympus"},
+		"day":       {Ranges: []WindowRange{{Days: []string{"funday"}, Start: "01:00", End: "02:00"}}},
+		"clock":     {Ranges: []WindowRange{{Start: "25:00", End: "02:00"}}},
+	}
+	for name, w := range bad {
+		if err := w.Validate(); err == nil {
+			t.Errorf("%s: expected validation error", name)
+		}
+	}
 }
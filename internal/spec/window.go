@@ -0,0 +1,188 @@
+package spec
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WindowSpec limits when changes to existing containers may roll out. With
+// no ranges rollouts may happen at any time.
+type WindowSpec struct {
+	// TimeZone is an IANA name such as Europe/Berlin; it defaults to UTC.
+	TimeZone string        `yaml:"timeZone"`
+	Ranges   []WindowRange `yaml:"ranges"`
+}
+
+// WindowRange opens the window from Start to End (HH:MM) on Days. An End
+// before Start runs past midnight into the next day, Start equal to End
+// covers the whole day and no days means every day.
+type WindowRange struct {
+	Days  []string `yaml:"days"`
+	Start string   `yaml:"start"`
+	End   string   `yaml:"end"`
+}
+
+// Blackout is a period in which nothing rolls out, whatever the windows say.
+type Blackout struct {
+	Start  time.Time `yaml:"start"`
+	End    time.Time `yaml:"end"`
+	Reason string    `yaml:"reason"`
+}
+
+// Active reports whether t falls into the blackout.
+func (b Blackout) Active(t time.Time) bool {
+	return !t.Before(b.Start) && t.Before(b.End)
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (w WindowSpec) Validate() error {
+	if _, err := w.location(); err != nil {
+		return err
+	}
+	for i, r := range w.Ranges {
+		if _, err := r.days(); err != nil {
+			return fmt.Errorf("ranges[%d]: %w", i, err)
+		}
+		if _, err := clockMinutes(r.Start); err != nil {
+			return fmt.Errorf("ranges[%d].start: %w", i, err)
+		}
+		if _, err := clockMinutes(r.End); err != nil {
+			return fmt.Errorf("ranges[%d].end: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Open reports whether a rollout may start at t.
+func (w WindowSpec) Open(t time.Time) bool {
+	if len(w.Ranges) == 0 {
+		return true
+	}
+	loc, err := w.location()
+	if err != nil {
+		return false
+	}
+	return w.openIn(t, loc)
+}
+
+func (w WindowSpec) openIn(t time.Time, loc *time.Location) bool {
+	local := t.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	today, yesterday := local.Weekday(), local.AddDate(0, 0, -1).Weekday()
+	for _, r := range w.Ranges {
+		days, err := r.days()
+		if err != nil {
+			continue
+		}
+		start, _ := clockMinutes(r.Start)
+		end, _ := clockMinutes(r.End)
+		switch {
+		case start == end:
+			if days[today] {
+				return true
+			}
+		case start < end:
+			if days[today] && minute >= start && minute < end {
+				return true
+			}
+		default:
+			if (days[today] && minute >= start) || (days[yesterday] && minute < end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Next returns when the window next opens after t, or the zero time if it
+// does not open within a week.
+func (w WindowSpec) Next(t time.Time) time.Time {
+	loc, err := w.location()
+	if err != nil || len(w.Ranges) == 0 {
+		return time.Time{}
+	}
+	after := t.Truncate(time.Minute).Add(time.Minute)
+	if w.openIn(after, loc) {
+		return after.In(loc)
+	}
+	// The window is closed at after, so it next opens where one of its
+	// ranges starts.
+	local := after.In(loc)
+	var next time.Time
+	for _, r := range w.Ranges {
+		days, err := r.days()
+		if err != nil {
+			continue
+		}
+		start, _ := clockMinutes(r.Start)
+		if end, _ := clockMinutes(r.End); start == end {
+			start = 0
+		}
+		for d := range 8 {
+			day := time.Date(local.Year(), local.Month(), local.Day()+d, 0, 0, 0, 0, loc)
+			open := time.Date(day.Year(), day.Month(), day.Day(), 0, start, 0, 0, loc)
+			if days[day.Weekday()] && open.After(t) {
+				if next.IsZero() || open.Before(next) {
+					next = open
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+func (w WindowSpec) location() (*time.Location, error) {
+	if w.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timeZone %q", w.TimeZone)
+	}
+	return loc, nil
+}
+
+// days expands Days, which may hold names such as "mon" and ranges such as
+// "mon-fri", into a lookup by weekday.
+func (r WindowRange) days() (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool, 7)
+	if len(r.Days) == 0 {
+		for d := range 7 {
+			days[time.Weekday(d)] = true
+		}
+		return days, nil
+	}
+	for _, spec := range r.Days {
+		from, to, isRange := strings.Cut(strings.ToLower(spec), "-")
+		if !isRange {
+			to = from
+		}
+		first, last := slices.Index(weekdays, from), slices.Index(weekdays, to)
+		if first < 0 || last < 0 {
+			return nil, fmt.Errorf("invalid day %q", spec)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[time.Weekday(d)] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// clockMinutes parses HH:MM, allowing 24:00 for the end of the day.
+func clockMinutes(clock string) (int, error) {
+	h, m, ok := strings.Cut(clock, ":")
+	hours, herr := strconv.Atoi(h)
+	minutes, merr := strconv.Atoi(m)
+	if !ok || herr != nil || merr != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", clock)
+	}
+	return hours*60 + minutes, nil
+}
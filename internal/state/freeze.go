@@ -0,0 +1,73 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Freeze stops the operator from changing any container until it is lifted.
+type Freeze struct {
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// FreezeStore keeps the operator-wide freeze.
+type FreezeStore interface {
+	LoadFreeze() (Freeze, bool, error)
+	SaveFreeze(freeze Freeze) error
+	RemoveFreeze() error
+}
+
+// freezePath has no .json extension so List does not mistake it for an
+// entry.
+func (s *FileStore) freezePath() string {
+	return filepath.Join(s.dir, "freeze")
+}
+
+func (s *FileStore) LoadFreeze() (Freeze, bool, error) {
+	var freeze Freeze
+	unlock, err := s.lock()
+	if err != nil {
+		return freeze, false, err
+	}
+	defer unlock()
+	data, err := os.ReadFile(s.freezePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return freeze, false, nil
+		}
+		return freeze, false, fmt.Errorf("read freeze: %w", err)
+	}
+	if err := json.Unmarshal(data, &freeze); err != nil {
+		return freeze, false, fmt.Errorf("decode freeze: %w", err)
+	}
+	return freeze, true, nil
+}
+
+func (s *FileStore) SaveFreeze(freeze Freeze) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := json.MarshalIndent(freeze, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode freeze: %w", err)
+	}
+	return writeFile(s.freezePath(), data)
+}
+
+func (s *FileStore) RemoveFreeze() error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(s.freezePath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove freeze: %w", err)
+	}
+	return nil
+}
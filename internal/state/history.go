@@ -0,0 +1,181 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// maxRevisions bounds how many revisions a service's history keeps.
+const maxRevisions = 20
+
+// Revision is one rollout of a service.
+type Revision struct {
+	ID       int       `json:"id"`
+	Digest   string    `json:"digest"`
+	Tag      string    `json:"tag,omitempty"`
+	SpecHash string    `json:"specHash"`
+	Time     time.Time `json:"time"`
+	// Outcome is "succeeded" or "failed"; Attempts counts how often a
+	// failing revision was retried.
+	Outcome  string `json:"outcome"`
+	Attempts int    `json:"attempts,omitempty"`
+	// Trigger says why the rollout happened, such as a new image digest or a
+	// manual rollback.
+	Trigger string `json:"trigger"`
+	Error   string `json:"error,omitempty"`
+	// RolledBack says the failed rollout was undone.
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+// Pin holds a service at an earlier revision until its spec changes.
+type Pin struct {
+	Revision int       `json:"revision"`
+	Digest   string    `json:"digest"`
+	SpecHash string    `json:"specHash"`
+	Time     time.Time `json:"time"`
+}
+
+// History is the bounded revision log of a service, oldest first.
+type History struct {
+	Service   string     `json:"service"`
+	Revisions []Revision `json:"revisions"`
+	Pin       *Pin       `json:"pin,omitempty"`
+}
+
+// Revision returns the revision with the given id.
+func (h History) Revision(id int) (Revision, bool) {
+	for _, rev := range h.Revisions {
+		if rev.ID == id {
+			return rev, true
+		}
+	}
+	return Revision{}, false
+}
+
+// Add appends rev with the next id, or folds it into the latest revision
+// when that is the same failing rollout being retried.
+func (h *History) Add(rev Revision) Revision {
+	if n := len(h.Revisions); n > 0 {
+		last := &h.Revisions[n-1]
+		if last.Outcome == "failed" && last.Digest == rev.Digest && last.SpecHash == rev.SpecHash && last.Trigger == rev.Trigger {
+			last.Outcome, last.Error, last.Time, last.RolledBack = rev.Outcome, rev.Error, rev.Time, rev.RolledBack
+			last.Attempts++
+			return *last
+		}
+		rev.ID = last.ID + 1
+	} else {
+		rev.ID = 1
+	}
+	rev.Attempts = 1
+	h.Revisions = append(h.Revisions, rev)
+	if len(h.Revisions) > maxRevisions {
+		h.Revisions = h.Revisions[len(h.Revisions)-maxRevisions:]
+	}
+	return rev
+}
+
+// PinRevision holds the service at revision id while its spec hash stays
+// specHash. Only revisions that rolled out successfully can be pinned.
+func (h *History) PinRevision(id int, specHash string) (Revision, error) {
+	rev, ok := h.Revision(id)
+	if !ok {
+		return rev, fmt.Errorf("service %s has no revision %d", h.Service, id)
+	}
+	if rev.Outcome != "succeeded" {
+		return rev, fmt.Errorf("revision %d of %s did not roll out successfully", id, h.Service)
+	}
+	h.Pin = &Pin{Revision: id, Digest: rev.Digest, SpecHash: specHash, Time: time.Now().UTC()}
+	return rev, nil
+}
+
+// HistoryStore keeps revision histories by service name.
+type HistoryStore interface {
+	LoadHistory(service string) (History, error)
+	SaveHistory(history History) error
+	// UpdateHistory loads the history of service, passes it to update and
+	// saves it under the store's lock. Nothing is saved when update fails or
+	// leaves the history unchanged.
+	UpdateHistory(service string, update func(history *History) error) error
+}
+
+func (s *FileStore) historyPath(service string) string {
+	return filepath.Join(s.dir, "history", url.PathEscape(service)+".json")
+}
+
+// LoadHistory returns the history of service, empty if none was recorded.
+func (s *FileStore) LoadHistory(service string) (History, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return History{}, err
+	}
+	defer unlock()
+	return s.loadHistory(service)
+}
+
+func (s *FileStore) loadHistory(service string) (History, error) {
+	history := History{Service: service}
+	data, err := os.ReadFile(s.historyPath(service))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return history, nil
+		}
+		return history, fmt.Errorf("read history: %w", err)
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return history, fmt.Errorf("decode history: %w", err)
+	}
+	return history, nil
+}
+
+func (s *FileStore) SaveHistory(history History) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.saveHistory(history)
+}
+
+func (s *FileStore) saveHistory(history History) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode history: %w", err)
+	}
+	path := s.historyPath(history.Service)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create history dir: %w", err)
+	}
+	return writeFile(path, data)
+}
+
+func (s *FileStore) UpdateHistory(service string, update func(history *History) error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	history, err := s.loadHistory(service)
+	if err != nil {
+		return err
+	}
+	before := history
+	before.Revisions = slices.Clone(history.Revisions)
+	if history.Pin != nil {
+		pin := *history.Pin
+		before.Pin = &pin
+	}
+	if err := update(&history); err != nil {
+		return err
+	}
+	if reflect.DeepEqual(history, before) {
+		return nil
+	}
+	history.Service = service
+	return s.saveHistory(history)
+}
@@ -5,24 +5,75 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
 
+// maxPreviousTemplates bounds how many earlier templates an entry remembers
+// for rollback.
+const maxPreviousTemplates = 5
+
 type Entry struct {
-	CTID   int       `json:"ctid"`
-	Digest string    `json:"digest"`
-	Status string    `json:"status"`
-	Node   string    `json:"node"`
-	Update time.Time `json:"update"`
+	CTID    int    `json:"ctid"`
+	Service string `json:"service,omitempty"`
+	Digest  string `json:"digest"`
+	// Template is the vztmpl volume the container was created from and
+	// PreviousTemplates the ones it ran before, most recent first.
+	Template          string   `json:"template,omitempty"`
+	PreviousTemplates []string `json:"previousTemplates,omitempty"`
+	Status            string   `json:"status"`
+	Node              string   `json:"node"`
+	// Drift lists the settings that differed from the deployed spec at the
+	// last reconcile, formatted as "key: live -> desired".
+	Drift []string `json:"drift,omitempty"`
+	// Pending describes a change the operator detected but holds back, such
+	// as a rollout waiting for its window.
+	Pending string `json:"pending,omitempty"`
+	// OrphanedAt is when the container was first seen without a spec, and
+	// DestroyConfirmed whether an operator approved destroying it.
+	OrphanedAt       time.Time `json:"orphanedAt,omitzero"`
+	DestroyConfirmed bool      `json:"destroyConfirmed,omitempty"`
+	Update           time.Time `json:"update"`
+}
+
+// SetTemplate records template as the current one, pushing the former
+// template onto PreviousTemplates.
+func (e *Entry) SetTemplate(template string) {
+	if template == e.Template {
+		return
+	}
+	if e.Template != "" {
+		previous := []string{e.Template}
+		for _, t := range e.PreviousTemplates {
+			if t != template && t != e.Template {
+				previous = append(previous, t)
+			}
+		}
+		if len(previous) > maxPreviousTemplates {
+			previous = previous[:maxPreviousTemplates]
+		}
+		e.PreviousTemplates = previous
+	}
+	e.Template = template
 }
 
 type Store interface {
 	Load(ctid int) (Entry, bool, error)
 	Save(entry Entry) error
+	// Update loads the entry of ctid, passes it to update and saves it, all
+	// under the store's lock. found reports whether the entry existed.
+	// Nothing is saved when update fails or leaves the entry unchanged.
+	Update(ctid int, update func(entry *Entry, found bool) error) error
 	Remove(ctid int) error
+	List() ([]Entry, error)
 }
 
+// FileStore keeps one JSON file per container in dir. Writes replace files
+// atomically and every access holds an flock on the dir, so the CLI and the
+// operator can share it.
 type FileStore struct {
 	dir string
 	mu  sync.Mutex
@@ -40,11 +91,17 @@ func (s *FileStore) path(ctid int) string {
 }
 
 func (s *FileStore) Load(ctid int) (Entry, bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return Entry{}, false, err
+	}
+	defer unlock()
+	return s.load(ctid)
+}
+
+func (s *FileStore) load(ctid int) (Entry, bool, error) {
 	var entry Entry
-	path := s.path(ctid)
-	data, err := os.ReadFile(path)
+	data, err := os.ReadFile(s.path(ctid))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return entry, false, nil
@@ -58,21 +115,80 @@ func (s *FileStore) Load(ctid int) (Entry, bool, error) {
 }
 
 func (s *FileStore) Save(entry Entry) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.save(entry)
+}
+
+func (s *FileStore) save(entry Entry) error {
 	entry.Update = time.Now().UTC()
 	data, err := json.MarshalIndent(entry, "", "  ")
 	if err != nil {
 		return fmt.Errorf("encode state: %w", err)
 	}
-	return os.WriteFile(s.path(entry.CTID), data, 0o644)
+	return writeFile(s.path(entry.CTID), data)
+}
+
+func (s *FileStore) Update(ctid int, update func(entry *Entry, found bool) error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entry, found, err := s.load(ctid)
+	if err != nil {
+		return err
+	}
+	before := entry
+	before.PreviousTemplates = slices.Clone(entry.PreviousTemplates)
+	before.Drift = slices.Clone(entry.Drift)
+	if err := update(&entry, found); err != nil {
+		return err
+	}
+	if reflect.DeepEqual(entry, before) {
+		return nil
+	}
+	entry.CTID = ctid
+	return s.save(entry)
 }
 
 func (s *FileStore) Remove(ctid int) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if err := os.Remove(s.path(ctid)); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("remove state: %w", err)
 	}
 	return nil
 }
+
+func (s *FileStore) List() ([]Entry, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("list state: %w", err)
+	}
+	entries := make([]Entry, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read state: %w", err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("decode state %s: %w", filepath.Base(path), err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CTID < entries[j].CTID })
+	return entries, nil
+}
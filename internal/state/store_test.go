@@ -0,0 +1,65 @@
+package state
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdatesFromSeparateStoresAreNotLost(t *testing.T) {
+	dir := t.TempDir()
+	// Two stores on one dir stand in for the CLI and the operator.
+	var stores []*FileStore
+	for range 2 {
+		s, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := stores[i%2].Update(100, func(entry *Entry, _ bool) error {
+				entry.Drift = append(entry.Drift, "x")
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	entry, ok, err := stores[0].Load(100)
+	if err != nil || !ok {
+		t.Fatalf("load: %v %v", ok, err)
+	}
+	if len(entry.Drift) != 50 || entry.CTID != 100 {
+		t.Fatalf("got ctid %d with %d updates, want 100 with 50", entry.CTID, len(entry.Drift))
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			t.Errorf("temp file %s left behind", f.Name())
+		}
+	}
+}
+
+func TestUpdateSkipsUnchangedEntries(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(7, func(*Entry, bool) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.Load(7); err != nil || ok {
+		t.Fatalf("untouched update created an entry: %v %v", ok, err)
+	}
+}